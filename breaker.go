@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerThreshold is the number of consecutive failures which trips a breaker by default
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerCooldown is how long a tripped breaker stays open by default
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// CircuitOpenError is returned instead of calling a service while its breaker is open
+type CircuitOpenError struct {
+	// RetryAfter is the time left until the breaker lets a call through again
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "DISTANCE_PROVIDER_UNAVAILABLE"
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker stops calls to a failing service. It trips open after Threshold consecutive
+// failures and rejects calls for Cooldown, then lets a single trial call through: the breaker
+// closes if it succeeds and opens again if it fails. A trial without an outcome, e.g. abandoned
+// by its caller, is replaced by another one after Cooldown
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+
+	// openedAt is when the breaker tripped, trialAt when the trial call was let through
+	openedAt time.Time
+	trialAt  time.Time
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// Allow returns a *CircuitOpenError if a call must not be made. An allowed call should be
+// followed by Success or Failure
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	var left time.Duration
+	switch cb.state {
+	case breakerOpen:
+		left = cb.Cooldown - time.Since(cb.openedAt)
+	case breakerHalfOpen:
+		// a trial call is in flight, it decides whether the breaker closes
+		left = cb.Cooldown - time.Since(cb.trialAt)
+	default:
+		return nil
+	}
+
+	if left > 0 {
+		return &CircuitOpenError{RetryAfter: left}
+	}
+
+	// this call is the trial
+	cb.state = breakerHalfOpen
+	cb.trialAt = time.Now()
+	return nil
+}
+
+// Success records an allowed call which succeeded, closing the breaker
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = breakerClosed
+	cb.failures = 0
+}
+
+// Failure records an allowed call which failed, opening the breaker if the call was a trial
+// or if it is the Threshold-th consecutive failure
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.Threshold {
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	cb := NewCircuitBreaker(2, 10*time.Millisecond)
+
+	// a success resets the count of consecutive failures
+	assert.Nil(cb.Allow())
+	cb.Failure()
+	assert.Nil(cb.Allow())
+	cb.Success()
+	assert.Nil(cb.Allow())
+	cb.Failure()
+	assert.Nil(cb.Allow())
+	cb.Failure()
+
+	err := cb.Allow()
+	if assert.IsType(&CircuitOpenError{}, err) {
+		assert.True(err.(*CircuitOpenError).RetryAfter > 0)
+	}
+
+	// once the cooldown is over a single trial is let through, its failure opens the breaker again
+	time.Sleep(15 * time.Millisecond)
+	assert.Nil(cb.Allow())
+	assert.NotNil(cb.Allow())
+	cb.Failure()
+	assert.NotNil(cb.Allow())
+
+	// a trial without an outcome is replaced after the cooldown
+	time.Sleep(15 * time.Millisecond)
+	assert.Nil(cb.Allow())
+	assert.NotNil(cb.Allow())
+	time.Sleep(15 * time.Millisecond)
+	assert.Nil(cb.Allow())
+
+	// a successful trial closes the breaker
+	cb.Success()
+	assert.Nil(cb.Allow())
+	assert.Nil(cb.Allow())
+}
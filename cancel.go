@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+var CancellationReasonRequiredError = errors.New("CANCELLATION_REASON_REQUIRED")
+
+const (
+	CancelReasonCustomerRequest    = "customer_request"
+	CancelReasonDuplicate          = "duplicate"
+	CancelReasonInvalidAddress     = "invalid_address"
+	CancelReasonNoCourierAvailable = "no_courier_available"
+	CancelReasonOther              = "other"
+)
+
+// cancelReasons lists the reason codes accepted when cancelling an order
+var cancelReasons = []string{
+	CancelReasonCustomerRequest,
+	CancelReasonDuplicate,
+	CancelReasonInvalidAddress,
+	CancelReasonNoCourierAvailable,
+	CancelReasonOther,
+}
+
+// maxCancelNoteLength bounds the free text note of a cancellation
+const maxCancelNoteLength = 500
+
+// IsValidCancelReason returns if `reason` is an accepted cancellation reason code
+func IsValidCancelReason(reason string) bool {
+	for _, r := range cancelReasons {
+		if r == reason {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cancelRequest is the body of POST /order/{id}/cancel
+type cancelRequest struct {
+	Reason string `json:"reason"`
+	Note   string `json:"note"`
+
+	// CourierId is the courier cancelling the order, required unless the order is unassigned
+	// or an admin cancels it. Its token must be sent in CourierTokenHeader
+	CourierId int `json:"courier_id,omitempty"`
+}
+
+// cancelOrder moves an order to the terminal `cancelled` status, recording the reason code
+// and optional note in the order's history. Delivered orders cannot be cancelled, and
+// assigned orders may only be cancelled by their courier or an admin
+func cancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderId, ok := parseOrderId(w, r)
+	if !ok {
+		return
+	}
+
+	var req cancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
+		return
+	}
+
+	if !IsValidCancelReason(req.Reason) {
+		writeError(w, http.StatusBadRequest,
+			fmt.Sprintf("reason must be one of %s", strings.Join(cancelReasons, ", ")))
+		return
+	}
+
+	if utf8.RuneCountInString(req.Note) > maxCancelNoteLength {
+		writeError(w, http.StatusBadRequest,
+			fmt.Sprintf("note must be at most %d characters", maxCancelNoteLength))
+		return
+	}
+
+	admin, err := authenticateUpdate(r, req.CourierId)
+	if err != nil {
+		writeOrderError(w, orderId, err)
+		return
+	}
+
+	err = defaultOrderStore.UpdateOrderStatus(orderId, StatusUpdate{
+		Status:     OrderStatusCancelled,
+		CourierId:  req.CourierId,
+		Admin:      admin,
+		Actor:      requestActor(r, admin, req.CourierId),
+		RequestId:  requestId(r),
+		Reason:     req.Reason,
+		Note:       req.Note,
+		IfVersions: parseIfMatch(r),
+	})
+	if err != nil {
+		writeOrderError(w, orderId, err)
+		return
+	}
+
+	log.Printf("order %d cancelled: %s", orderId, req.Reason)
+	writeJSON(w, http.StatusOK, orderUpdate{Status: "SUCCESS"})
+}
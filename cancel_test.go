@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	// a distance no other test uses selects the order in listings
+	const distance = 424242
+	id, _ := defaultOrderStore.InsertOrder(testOrder(distance))
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+
+	cancelEndpoint := fmt.Sprintf("%s/order/%d/cancel", srv.URL, id)
+	cancel := func(endpoint, body string) (int, string) {
+		resp, err := client.Post(endpoint, "application/json", bytes.NewReader([]byte(body)))
+		if !assert.Nil(err) {
+			return 0, ""
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	for _, bad := range []string{
+		`{}`,
+		`{"reason": "bored"}`,
+		fmt.Sprintf(`{"reason": "other", "note": "%s"}`, strings.Repeat("x", maxCancelNoteLength+1)),
+		fmt.Sprintf(`{"reason": "other", "note": "%s"}`, strings.Repeat("é", maxCancelNoteLength+1)),
+		`{"reason": `,
+	} {
+		code, _ := cancel(cancelEndpoint, bad)
+		assert.Equal(http.StatusBadRequest, code, bad)
+	}
+
+	// the note is bounded in characters, not bytes
+	multibyteId, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+	multibyteNote := strings.Repeat("é", maxCancelNoteLength)
+	code, body := cancel(fmt.Sprintf("%s/order/%d/cancel", srv.URL, multibyteId),
+		fmt.Sprintf(`{"reason": "other", "note": "%s"}`, multibyteNote))
+	assert.Equal(http.StatusOK, code, body)
+
+	events, _ := defaultOrderStore.OrderHistory(multibyteId)
+	if assert.Len(events, 2) {
+		assert.Equal(multibyteNote, events[1].Note)
+	}
+
+	// PUT cannot cancel an order, a reason is required
+	req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/order/%d", srv.URL, id),
+		bytes.NewReader([]byte(`{"status": "cancelled"}`)))
+	resp, err := client.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal("{\"error\":\"CANCELLATION_REASON_REQUIRED\"}\n", string(respBody))
+
+	code, body = cancel(cancelEndpoint, `{"reason": "customer_request", "note": "changed their mind"}`)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("{\"status\":\"SUCCESS\"}\n", body)
+
+	events, _ = defaultOrderStore.OrderHistory(id)
+	if assert.Len(events, 2) {
+		assert.Equal(OrderStatusCancelled, events[1].Type)
+		assert.Equal(CancelReasonCustomerRequest, events[1].Reason)
+		assert.Equal("changed their mind", events[1].Note)
+	}
+
+	// cancelled is terminal
+	code, body = cancel(cancelEndpoint, `{"reason": "duplicate"}`)
+	assert.Equal(http.StatusConflict, code)
+	assert.Contains(body, "\"current_status\":\"cancelled\"")
+
+	// cancelled orders are only listed when asked for
+	for _, mode := range []string{"page=1", "cursor="} {
+		listEndpoint := fmt.Sprintf("%s/orders?%s&min_distance=%d&max_distance=%d", srv.URL, mode, distance, distance)
+
+		for query, listed := range map[string]int{"": 0, "&status=cancelled": 1, "&status=UNASSIGN": 0} {
+			resp, err := client.Get(listEndpoint + query)
+			assert.Nil(err)
+			assert.Equal(http.StatusOK, resp.StatusCode)
+
+			var page struct {
+				Data []ResolvedOrder `json:"data"`
+			}
+			assert.Nil(json.NewDecoder(resp.Body).Decode(&page))
+			assert.Len(page.Data, listed, "%s%s", mode, query)
+		}
+	}
+
+	code, _ = cancel(fmt.Sprintf("%s/order/99999/cancel", srv.URL), `{"reason": "other"}`)
+	assert.Equal(http.StatusNotFound, code)
+}
+
+func TestCancelAssignedOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "let-me-in"
+
+	owner, other := newTestCourier(t), newTestCourier(t)
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+
+	// cancel sends a cancellation with an admin token and a courier token, when not empty
+	cancel := func(orderId int, body, token, courierToken string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/order/%d/cancel", srv.URL, orderId),
+			bytes.NewReader([]byte(body)))
+		if token != "" {
+			req.Header.Set(AdminTokenHeader, token)
+		}
+
+		if courierToken != "" {
+			req.Header.Set(CourierTokenHeader, courierToken)
+		}
+
+		resp, err := client.Do(req)
+		if !assert.Nil(err) {
+			return 0, ""
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	for _, status := range []string{OrderStatusTaken, OrderStatusPickedUp, OrderStatusInTransit} {
+		id, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+		for _, s := range []string{OrderStatusTaken, OrderStatusPickedUp, OrderStatusInTransit} {
+			assert.Nil(defaultOrderStore.UpdateOrderStatus(id, StatusUpdate{Status: s, CourierId: owner}))
+			if s == status {
+				break
+			}
+		}
+
+		// anonymous callers and other couriers cannot cancel an order held by a courier
+		for _, attempt := range []struct{ body, courierToken string }{
+			{`{"reason": "other"}`, ""},
+			{fmt.Sprintf(`{"reason": "other", "courier_id": %d}`, other), testCourierToken},
+		} {
+			code, body := cancel(id, attempt.body, "", attempt.courierToken)
+			assert.Equal(http.StatusForbidden, code, "%s %s", status, attempt.body)
+			assert.Contains(body, "ORDER_NOT_ASSIGNED_TO_COURIER")
+		}
+
+		code, body := cancel(id, fmt.Sprintf(`{"reason": "other", "courier_id": %d}`, owner), "", "guess")
+		assert.Equal(http.StatusUnauthorized, code)
+		assert.Contains(body, "COURIER_TOKEN_INVALID")
+
+		order, _ := defaultOrderStore.SelectOrder(id)
+		assert.Equal(status, order.Status)
+
+		// the assigned courier or an admin can
+		if status == OrderStatusPickedUp {
+			code, _ = cancel(id, `{"reason": "other"}`, adminToken, "")
+		} else {
+			code, _ = cancel(id, fmt.Sprintf(`{"reason": "other", "courier_id": %d}`, owner), "", testCourierToken)
+		}
+		assert.Equal(http.StatusOK, code, status)
+	}
+}
+
+func TestCancelDeliveredOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	id, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+	courierId := newTestCourier(t)
+
+	for _, status := range []string{OrderStatusTaken, OrderStatusPickedUp, OrderStatusInTransit, OrderStatusDelivered} {
+		assert.Nil(defaultOrderStore.UpdateOrderStatus(id, StatusUpdate{Status: status, CourierId: courierId}))
+	}
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(fmt.Sprintf("%s/order/%d/cancel", srv.URL, id), "application/json",
+		bytes.NewReader([]byte(`{"reason": "customer_request"}`)))
+	assert.Nil(err)
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal("{\"error\":\"INVALID_STATUS_TRANSITION\",\"current_status\":\"delivered\"}\n", string(respBody))
+}
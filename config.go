@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// redacted replaces secrets when a Config is dumped
+const redacted = "REDACTED"
+
+// Config is the effective configuration of the API.
+//
+// It is assembled from the following sources, each one overriding the previous:
+//  1. built-in defaults, see DefaultConfig
+//  2. an optional YAML or JSON file named by -config or ORDERS_CONFIG
+//  3. environment variables
+//  4. command line flags
+type Config struct {
+	ListenAddr string         `json:"listen_addr" yaml:"listen_addr"`
+	Store      string         `json:"store" yaml:"store"`
+	Postgres   PostgresConfig `json:"postgres" yaml:"postgres"`
+	Distance   DistanceConfig `json:"distance" yaml:"distance"`
+	Webhooks   WebhookConfig  `json:"webhooks" yaml:"webhooks"`
+	Couriers   CourierConfig  `json:"couriers" yaml:"couriers"`
+	Reaper     ReaperConfig   `json:"reaper" yaml:"reaper"`
+
+	Idempotency IdempotencyConfig `json:"idempotency" yaml:"idempotency"`
+
+	// AdminToken, sent in the X-Admin-Token header, lets operators act on orders assigned to any
+	// courier and guards courier management, webhooks and /admin/distance_cache.
+	// Admin requests are disabled when it is empty
+	AdminToken string `json:"admin_token" yaml:"admin_token"`
+
+	// MigrateOnStartup applies pending schema migrations before serving requests
+	MigrateOnStartup bool `json:"migrate_on_startup" yaml:"migrate_on_startup"`
+
+	// PrintConfig dumps the redacted effective configuration and exits
+	PrintConfig bool `json:"-" yaml:"-"`
+
+	// Args are the command line arguments left after flags, e.g. a subcommand
+	Args []string `json:"-" yaml:"-"`
+}
+
+// PostgresConfig describes how to connect to the Postgres order store
+type PostgresConfig struct {
+	Host        string `json:"host" yaml:"host"`
+	Port        int    `json:"port" yaml:"port"`
+	User        string `json:"user" yaml:"user"`
+	Password    string `json:"password" yaml:"password"`
+	DBName      string `json:"dbname" yaml:"dbname"`
+	SSLMode     string `json:"sslmode" yaml:"sslmode"`
+	SSLRootCert string `json:"sslrootcert" yaml:"sslrootcert"`
+}
+
+// DistanceConfig selects and configures the DistanceProvider
+type DistanceConfig struct {
+	Provider         string  `json:"provider" yaml:"provider"`
+	RoadFactor       float64 `json:"road_factor" yaml:"road_factor"`
+	GoogleMapsAPIKey string  `json:"google_maps_api_key" yaml:"google_maps_api_key"`
+
+	// Fallback estimates the distance when Google Maps fails, rather than failing the request.
+	// Requests are still refused while the circuit breaker is open
+	Fallback bool `json:"fallback" yaml:"fallback"`
+
+	// Timeout bounds a Google Maps lookup, retries included
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+
+	// MaxRetries is the number of times a lookup failing with a transient error is retried,
+	// RetryBackoff the delay before the first retry, which doubles with every retry
+	MaxRetries   int      `json:"max_retries" yaml:"max_retries"`
+	RetryBackoff Duration `json:"retry_backoff" yaml:"retry_backoff"`
+
+	Breaker BreakerConfig       `json:"breaker" yaml:"breaker"`
+	Cache   DistanceCacheConfig `json:"cache" yaml:"cache"`
+}
+
+// BreakerConfig configures the circuit breaker stopping Google Maps lookups while they fail
+type BreakerConfig struct {
+	// Threshold is the number of consecutive failed lookups which opens the breaker, 0 disables it
+	Threshold int `json:"threshold" yaml:"threshold"`
+
+	// Cooldown is how long the breaker stays open before a lookup is tried again
+	Cooldown Duration `json:"cooldown" yaml:"cooldown"`
+}
+
+// DistanceCacheConfig configures the cache of the distances computed by Google Maps
+type DistanceCacheConfig struct {
+	// Precision is the number of decimal places coordinates are rounded to in cache keys
+	Precision int `json:"precision" yaml:"precision"`
+
+	// Size is the number of distances kept in process, 0 keeps none
+	Size int `json:"size" yaml:"size"`
+
+	// TTL is how long a distance is cached, 0 disables the cache
+	TTL Duration `json:"ttl" yaml:"ttl"`
+
+	// Shared also caches distances in Postgres, for every replica to use
+	Shared bool `json:"shared" yaml:"shared"`
+}
+
+// WebhookConfig configures the delivery of order events to webhook subscriptions
+type WebhookConfig struct {
+	// MaxAttempts is the number of failed attempts after which a delivery is dead-lettered
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+
+	// RetryBackoff is the delay before the first retry, it doubles with every failed
+	// attempt up to MaxRetryBackoff
+	RetryBackoff    Duration `json:"retry_backoff" yaml:"retry_backoff"`
+	MaxRetryBackoff Duration `json:"max_retry_backoff" yaml:"max_retry_backoff"`
+
+	// Timeout bounds a single delivery attempt
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+
+	// PollInterval is how often the outbox is checked for due deliveries
+	PollInterval Duration `json:"poll_interval" yaml:"poll_interval"`
+}
+
+// CourierConfig configures the assignment of orders to couriers
+type CourierConfig struct {
+	// Capacity is the number of orders a courier may hold at once, unless the courier
+	// has its own capacity
+	Capacity int `json:"capacity" yaml:"capacity"`
+}
+
+// ReaperConfig configures the release of orders held in `taken` for too long
+type ReaperConfig struct {
+	// HoldTimeout is how long an order may stay `taken` without progress before it is
+	// released, 0 disables the reaper
+	HoldTimeout Duration `json:"hold_timeout" yaml:"hold_timeout"`
+
+	// Interval is how often stale orders are looked for
+	Interval Duration `json:"interval" yaml:"interval"`
+}
+
+// IdempotencyConfig configures the replay of responses to requests made with an Idempotency-Key
+type IdempotencyConfig struct {
+	// TTL is how long a response is replayed to retries under the same key
+	TTL Duration `json:"ttl" yaml:"ttl"`
+}
+
+// Duration is a time.Duration written as a string such as "10s" or "1h" in config files
+type Duration struct {
+	time.Duration
+}
+
+// Set parses a duration string such as "10s"
+func (d *Duration) Set(s string) (err error) {
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads the duration from a string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	return d.Set(s)
+}
+
+// MarshalYAML writes the duration as a string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// UnmarshalYAML reads the duration from a string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.Set(s)
+}
+
+// DefaultConfig returns the configuration used when no other source overrides it
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr: ":8080",
+		Store:      OrderStorePostgres,
+		Postgres: PostgresConfig{
+			Host:    "localhost",
+			Port:    5432,
+			User:    "postgres",
+			DBName:  "postgres",
+			SSLMode: "disable",
+		},
+		Distance: DistanceConfig{
+			Provider:     DistanceProviderGoogle,
+			RoadFactor:   DefaultRoadFactor,
+			Fallback:     true,
+			Timeout:      Duration{DefaultDistanceTimeout},
+			MaxRetries:   DefaultDistanceMaxRetries,
+			RetryBackoff: Duration{DefaultDistanceRetryBackoff},
+			Breaker: BreakerConfig{
+				Threshold: DefaultBreakerThreshold,
+				Cooldown:  Duration{DefaultBreakerCooldown},
+			},
+			Cache: DistanceCacheConfig{
+				Precision: DefaultDistanceCachePrecision,
+				Size:      DefaultDistanceCacheSize,
+				TTL:       Duration{DefaultDistanceCacheTTL},
+			},
+		},
+		Webhooks: WebhookConfig{
+			MaxAttempts:     8,
+			RetryBackoff:    Duration{10 * time.Second},
+			MaxRetryBackoff: Duration{time.Hour},
+			Timeout:         Duration{10 * time.Second},
+			PollInterval:    Duration{time.Second},
+		},
+		Couriers: CourierConfig{
+			Capacity: DefaultCourierCapacity,
+		},
+		Reaper: ReaperConfig{
+			HoldTimeout: Duration{time.Hour},
+			Interval:    Duration{time.Minute},
+		},
+		Idempotency: IdempotencyConfig{
+			TTL: Duration{DefaultIdempotencyTTL},
+		},
+	}
+}
+
+// configOption is a setting which can be overridden by an environment variable and a flag
+type configOption struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+// configOptions lists every setting which can be overridden from the environment
+// or the command line
+var configOptions = []configOption{
+	{"listen", "ORDERS_LISTEN_ADDR", "address the HTTP server listens on",
+		func(c *Config, v string) error { c.ListenAddr = v; return nil }},
+	{"store", "ORDERS_STORE", "order store: postgres or memory",
+		func(c *Config, v string) error { c.Store = v; return nil }},
+	{"migrate-on-startup", "ORDERS_MIGRATE_ON_STARTUP", "apply pending schema migrations at startup: true or false",
+		func(c *Config, v string) (err error) { c.MigrateOnStartup, err = strconv.ParseBool(v); return }},
+	{"admin-token", "ORDERS_ADMIN_TOKEN", "token granting admin privileges in the X-Admin-Token header",
+		func(c *Config, v string) error { c.AdminToken = v; return nil }},
+	{"postgres-host", "ORDERS_POSTGRES_HOST", "Postgres host",
+		func(c *Config, v string) error { c.Postgres.Host = v; return nil }},
+	{"postgres-port", "ORDERS_POSTGRES_PORT", "Postgres port",
+		func(c *Config, v string) (err error) { c.Postgres.Port, err = strconv.Atoi(v); return }},
+	{"postgres-user", "ORDERS_POSTGRES_USER", "Postgres user",
+		func(c *Config, v string) error { c.Postgres.User = v; return nil }},
+	{"postgres-password", "ORDERS_POSTGRES_PASSWORD", "Postgres password",
+		func(c *Config, v string) error { c.Postgres.Password = v; return nil }},
+	{"postgres-dbname", "ORDERS_POSTGRES_DBNAME", "Postgres database name",
+		func(c *Config, v string) error { c.Postgres.DBName = v; return nil }},
+	{"postgres-sslmode", "ORDERS_POSTGRES_SSLMODE", "Postgres sslmode e.g. disable, require, verify-full",
+		func(c *Config, v string) error { c.Postgres.SSLMode = v; return nil }},
+	{"postgres-sslrootcert", "ORDERS_POSTGRES_SSLROOTCERT", "path to the CA certificate for Postgres TLS",
+		func(c *Config, v string) error { c.Postgres.SSLRootCert = v; return nil }},
+	{"distance-provider", "ORDERS_DISTANCE_PROVIDER", "distance provider: google or greatcircle",
+		func(c *Config, v string) error { c.Distance.Provider = v; return nil }},
+	{"distance-road-factor", "ORDERS_DISTANCE_ROAD_FACTOR", "multiplier applied to great-circle distance estimates",
+		func(c *Config, v string) (err error) { c.Distance.RoadFactor, err = strconv.ParseFloat(v, 64); return }},
+	{"google-maps-api-key", "ORDERS_GOOGLE_MAPS_API_KEY", "Google Maps API key",
+		func(c *Config, v string) error { c.Distance.GoogleMapsAPIKey = v; return nil }},
+	{"distance-fallback", "ORDERS_DISTANCE_FALLBACK", "estimate distances when Google Maps fails: true or false",
+		func(c *Config, v string) (err error) { c.Distance.Fallback, err = strconv.ParseBool(v); return }},
+	{"distance-timeout", "ORDERS_DISTANCE_TIMEOUT", "deadline of a Google Maps lookup, retries included e.g. 5s",
+		func(c *Config, v string) error { return c.Distance.Timeout.Set(v) }},
+	{"distance-max-retries", "ORDERS_DISTANCE_MAX_RETRIES", "times a Google Maps lookup failing with a transient error is retried",
+		func(c *Config, v string) (err error) { c.Distance.MaxRetries, err = strconv.Atoi(v); return }},
+	{"distance-retry-backoff", "ORDERS_DISTANCE_RETRY_BACKOFF", "delay before the first Google Maps retry e.g. 100ms",
+		func(c *Config, v string) error { return c.Distance.RetryBackoff.Set(v) }},
+	{"distance-breaker-threshold", "ORDERS_DISTANCE_BREAKER_THRESHOLD", "consecutive failed Google Maps lookups which open the circuit breaker, 0 disables it",
+		func(c *Config, v string) (err error) { c.Distance.Breaker.Threshold, err = strconv.Atoi(v); return }},
+	{"distance-breaker-cooldown", "ORDERS_DISTANCE_BREAKER_COOLDOWN", "how long the circuit breaker stays open e.g. 30s",
+		func(c *Config, v string) error { return c.Distance.Breaker.Cooldown.Set(v) }},
+	{"distance-cache-precision", "ORDERS_DISTANCE_CACHE_PRECISION", "decimal places coordinates are rounded to in distance cache keys",
+		func(c *Config, v string) (err error) { c.Distance.Cache.Precision, err = strconv.Atoi(v); return }},
+	{"distance-cache-size", "ORDERS_DISTANCE_CACHE_SIZE", "number of distances cached in process, 0 keeps none",
+		func(c *Config, v string) (err error) { c.Distance.Cache.Size, err = strconv.Atoi(v); return }},
+	{"distance-cache-ttl", "ORDERS_DISTANCE_CACHE_TTL", "how long distances are cached e.g. 24h, 0 disables the cache",
+		func(c *Config, v string) error { return c.Distance.Cache.TTL.Set(v) }},
+	{"distance-cache-shared", "ORDERS_DISTANCE_CACHE_SHARED", "also cache distances in Postgres for every replica: true or false",
+		func(c *Config, v string) (err error) { c.Distance.Cache.Shared, err = strconv.ParseBool(v); return }},
+	{"courier-capacity", "ORDERS_COURIER_CAPACITY", "number of orders a courier may hold at once, unless set on the courier",
+		func(c *Config, v string) (err error) { c.Couriers.Capacity, err = strconv.Atoi(v); return }},
+	{"reaper-hold-timeout", "ORDERS_REAPER_HOLD_TIMEOUT", "time after which a taken order without progress is released e.g. 1h, 0 disables",
+		func(c *Config, v string) error { return c.Reaper.HoldTimeout.Set(v) }},
+	{"reaper-interval", "ORDERS_REAPER_INTERVAL", "how often taken orders are checked for release e.g. 1m",
+		func(c *Config, v string) error { return c.Reaper.Interval.Set(v) }},
+	{"idempotency-ttl", "ORDERS_IDEMPOTENCY_TTL", "how long responses are replayed to retries under the same Idempotency-Key e.g. 24h",
+		func(c *Config, v string) error { return c.Idempotency.TTL.Set(v) }},
+	{"webhook-max-attempts", "ORDERS_WEBHOOK_MAX_ATTEMPTS", "failed attempts after which a webhook delivery is dead-lettered",
+		func(c *Config, v string) (err error) { c.Webhooks.MaxAttempts, err = strconv.Atoi(v); return }},
+	{"webhook-retry-backoff", "ORDERS_WEBHOOK_RETRY_BACKOFF", "delay before the first webhook retry e.g. 10s",
+		func(c *Config, v string) error { return c.Webhooks.RetryBackoff.Set(v) }},
+	{"webhook-max-retry-backoff", "ORDERS_WEBHOOK_MAX_RETRY_BACKOFF", "upper bound of the delay between webhook retries e.g. 1h",
+		func(c *Config, v string) error { return c.Webhooks.MaxRetryBackoff.Set(v) }},
+	{"webhook-timeout", "ORDERS_WEBHOOK_TIMEOUT", "timeout of a single webhook delivery attempt e.g. 10s",
+		func(c *Config, v string) error { return c.Webhooks.Timeout.Set(v) }},
+	{"webhook-poll-interval", "ORDERS_WEBHOOK_POLL_INTERVAL", "how often due webhook deliveries are looked for e.g. 1s",
+		func(c *Config, v string) error { return c.Webhooks.PollInterval.Set(v) }},
+}
+
+// LoadConfig assembles the effective configuration from defaults, an optional config file,
+// the environment as seen through `getenv` and the command line `args`, then validates it
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("orderapi", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a YAML or JSON config file (env ORDERS_CONFIG)")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+
+	flagValues := make(map[string]*string, len(configOptions))
+	for _, opt := range configOptions {
+		flagValues[opt.flag] = fs.String(opt.flag, "", fmt.Sprintf("%s (env %s)", opt.usage, opt.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultConfig()
+	cfg.PrintConfig = *printConfig
+	cfg.Args = fs.Args()
+
+	path := *configFile
+	if path == "" {
+		path = getenv("ORDERS_CONFIG")
+	}
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(getenv); err != nil {
+		return nil, err
+	}
+
+	// only flags explicitly set on the command line override other sources
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range configOptions {
+			if opt.flag == f.Name && flagErr == nil {
+				if err := opt.set(cfg, *flagValues[opt.flag]); err != nil {
+					flagErr = fmt.Errorf("invalid value for -%s: %s", opt.flag, err)
+				}
+			}
+		}
+	})
+
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	// migrations only use the database, the rest need not be configured to run them
+	if len(cfg.Args) > 0 && cfg.Args[0] == "migrate" {
+		return cfg, cfg.ValidateDatabase()
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// loadFile overrides the configuration with the contents of a YAML or JSON file.
+// The format is chosen by the file extension
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %s", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// like UnmarshalStrict, misspelled keys are reported rather than ignored
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	default:
+		return fmt.Errorf("config file must be .json, .yaml or .yml: %s", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// loadEnv overrides the configuration with any environment variables that are set
+func (c *Config) loadEnv(getenv func(string) string) error {
+	for _, opt := range configOptions {
+		v := getenv(opt.env)
+		if v == "" {
+			continue
+		}
+
+		if err := opt.set(c, v); err != nil {
+			return fmt.Errorf("invalid value for %s: %s", opt.env, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate reports the first problem found in the configuration
+func (c *Config) Validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("listen address must not be empty")
+	}
+
+	if err := c.ValidateDatabase(); err != nil {
+		return err
+	}
+
+	switch c.Distance.Provider {
+	case DistanceProviderGreatCircle:
+	case DistanceProviderGoogle:
+		if c.Distance.GoogleMapsAPIKey == "" {
+			return errors.New("a Google Maps API key is required by the google distance provider")
+		}
+	default:
+		return fmt.Errorf("unknown distance provider: %s", c.Distance.Provider)
+	}
+
+	if c.Distance.RoadFactor < 1 {
+		return fmt.Errorf("road factor must be at least 1, got %v", c.Distance.RoadFactor)
+	}
+
+	if c.Distance.Timeout.Duration <= 0 {
+		return fmt.Errorf("distance timeout must be positive, got %s", c.Distance.Timeout)
+	}
+
+	if c.Distance.MaxRetries < 0 {
+		return fmt.Errorf("distance max retries must not be negative, got %d", c.Distance.MaxRetries)
+	}
+
+	if c.Distance.RetryBackoff.Duration < 0 {
+		return fmt.Errorf("distance retry backoff must not be negative, got %s", c.Distance.RetryBackoff)
+	}
+
+	if c.Distance.Breaker.Threshold < 0 {
+		return fmt.Errorf("distance breaker threshold must not be negative, got %d", c.Distance.Breaker.Threshold)
+	}
+
+	if c.Distance.Breaker.Cooldown.Duration <= 0 {
+		return fmt.Errorf("distance breaker cooldown must be positive, got %s", c.Distance.Breaker.Cooldown)
+	}
+
+	if p := c.Distance.Cache.Precision; p < 0 || p > MaxDistanceCachePrecision {
+		return fmt.Errorf("distance cache precision must be between 0 and %d, got %d", MaxDistanceCachePrecision, p)
+	}
+
+	if c.Distance.Cache.Size < 0 {
+		return fmt.Errorf("distance cache size must not be negative, got %d", c.Distance.Cache.Size)
+	}
+
+	if c.Distance.Cache.TTL.Duration < 0 {
+		return fmt.Errorf("distance cache ttl must not be negative, got %s", c.Distance.Cache.TTL)
+	}
+
+	if c.Distance.Cache.Shared && c.Store != OrderStorePostgres {
+		return errors.New("a shared distance cache requires the postgres store")
+	}
+
+	if c.Couriers.Capacity < 1 {
+		return fmt.Errorf("courier capacity must be at least 1, got %d", c.Couriers.Capacity)
+	}
+
+	if c.Reaper.HoldTimeout.Duration < 0 {
+		return fmt.Errorf("reaper hold timeout must not be negative, got %s", c.Reaper.HoldTimeout)
+	}
+
+	if c.Reaper.Interval.Duration <= 0 {
+		return fmt.Errorf("reaper interval must be positive, got %s", c.Reaper.Interval)
+	}
+
+	if c.Idempotency.TTL.Duration <= 0 {
+		return fmt.Errorf("idempotency ttl must be positive, got %s", c.Idempotency.TTL)
+	}
+
+	return c.Webhooks.Validate()
+}
+
+// ValidateDatabase reports the first problem found in the order store configuration
+func (c *Config) ValidateDatabase() error {
+	switch c.Store {
+	case OrderStoreMemory:
+		return nil
+	case OrderStorePostgres:
+		return c.Postgres.Validate()
+	default:
+		return fmt.Errorf("unknown order store: %s", c.Store)
+	}
+}
+
+// Validate reports the first problem found in the webhook configuration
+func (wc WebhookConfig) Validate() error {
+	if wc.MaxAttempts < 1 {
+		return fmt.Errorf("webhook max attempts must be at least 1, got %d", wc.MaxAttempts)
+	}
+
+	durations := []struct {
+		name  string
+		value Duration
+	}{
+		{"retry backoff", wc.RetryBackoff},
+		{"max retry backoff", wc.MaxRetryBackoff},
+		{"timeout", wc.Timeout},
+		{"poll interval", wc.PollInterval},
+	}
+
+	for _, d := range durations {
+		if d.value.Duration <= 0 {
+			return fmt.Errorf("webhook %s must be positive, got %s", d.name, d.value)
+		}
+	}
+
+	if wc.MaxRetryBackoff.Duration < wc.RetryBackoff.Duration {
+		return errors.New("webhook max retry backoff must not be less than the retry backoff")
+	}
+
+	return nil
+}
+
+// Validate reports the first problem found in the Postgres configuration
+func (pc PostgresConfig) Validate() error {
+	if pc.Host == "" {
+		return errors.New("postgres host must not be empty")
+	}
+
+	if pc.Port <= 0 || pc.Port > 65535 {
+		return fmt.Errorf("postgres port out of range: %d", pc.Port)
+	}
+
+	if pc.User == "" {
+		return errors.New("postgres user must not be empty")
+	}
+
+	if pc.DBName == "" {
+		return errors.New("postgres dbname must not be empty")
+	}
+
+	// https://www.postgresql.org/docs/9.6/static/libpq-ssl.html#LIBPQ-SSL-SSLMODE-STATEMENTS
+	switch pc.SSLMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("unsupported postgres sslmode: %s", pc.SSLMode)
+	}
+
+	return nil
+}
+
+// DSN returns the connection string understood by lib/pq
+func (pc PostgresConfig) DSN() string {
+	params := []struct{ key, value string }{
+		{"host", pc.Host},
+		{"port", strconv.Itoa(pc.Port)},
+		{"user", pc.User},
+		{"password", pc.Password},
+		{"dbname", pc.DBName},
+		{"sslmode", pc.SSLMode},
+		{"sslrootcert", pc.SSLRootCert},
+	}
+
+	// values are quoted so that they may contain spaces, quotes and backslashes
+	quoter := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+	parts := make([]string, 0, len(params))
+	for _, p := range params {
+		if p.value != "" {
+			parts = append(parts, fmt.Sprintf("%s='%s'", p.key, quoter.Replace(p.value)))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Redacted returns a copy of the configuration with secrets masked, safe to log
+func (c Config) Redacted() Config {
+	if c.Postgres.Password != "" {
+		c.Postgres.Password = redacted
+	}
+
+	if c.Distance.GoogleMapsAPIKey != "" {
+		c.Distance.GoogleMapsAPIKey = redacted
+	}
+
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+
+	return c
+}
+
+// String dumps the redacted configuration as JSON
+func (c Config) String() string {
+	data, err := json.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Sprintf("failed to dump config: %s", err)
+	}
+
+	return string(data)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// envMap returns a getenv function backed by a map
+func envMap(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+// writeConfigFile writes `contents` into a temporary file named `name`
+func writeConfigFile(t *testing.T, name, contents string) string {
+	dir, err := ioutil.TempDir("", "orderapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	// defaults alone are not valid, since there is no Google Maps API key
+	_, err := LoadConfig([]string{}, envMap(nil))
+	assert.NotNil(err)
+
+	cfg, err := LoadConfig([]string{}, envMap(map[string]string{
+		"ORDERS_GOOGLE_MAPS_API_KEY": "key",
+	}))
+	assert.Nil(err)
+	assert.Equal(":8080", cfg.ListenAddr)
+	assert.Equal(OrderStorePostgres, cfg.Store)
+	assert.Equal("localhost", cfg.Postgres.Host)
+	assert.Equal(DefaultRoadFactor, cfg.Distance.RoadFactor)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlPath := writeConfigFile(t, "config.yaml", `
+listen_addr: ":9000"
+store: memory
+postgres:
+  host: file-host
+  port: 6543
+distance:
+  provider: greatcircle
+  road_factor: 1.2
+webhooks:
+  retry_backoff: 30s
+`)
+	defer os.RemoveAll(filepath.Dir(yamlPath))
+
+	// file overrides defaults
+	cfg, err := LoadConfig([]string{"-config", yamlPath}, envMap(nil))
+	assert.Nil(err)
+	assert.Equal(":9000", cfg.ListenAddr)
+	assert.Equal(OrderStoreMemory, cfg.Store)
+	assert.Equal("file-host", cfg.Postgres.Host)
+	assert.Equal(6543, cfg.Postgres.Port)
+	assert.Equal("postgres", cfg.Postgres.User)
+	assert.Equal(1.2, cfg.Distance.RoadFactor)
+	assert.Equal(30*time.Second, cfg.Webhooks.RetryBackoff.Duration)
+	assert.Equal(time.Hour, cfg.Webhooks.MaxRetryBackoff.Duration)
+
+	// environment overrides file, ORDERS_CONFIG names the file
+	env := map[string]string{
+		"ORDERS_CONFIG":                yamlPath,
+		"ORDERS_LISTEN_ADDR":           ":9001",
+		"ORDERS_POSTGRES_HOST":         "env-host",
+		"ORDERS_WEBHOOK_RETRY_BACKOFF": "1m",
+	}
+	cfg, err = LoadConfig([]string{}, envMap(env))
+	assert.Nil(err)
+	assert.Equal(":9001", cfg.ListenAddr)
+	assert.Equal("env-host", cfg.Postgres.Host)
+	assert.Equal(6543, cfg.Postgres.Port)
+	assert.Equal(time.Minute, cfg.Webhooks.RetryBackoff.Duration)
+
+	// flags override environment
+	cfg, err = LoadConfig([]string{"-listen", ":9002", "-postgres-port", "7000"}, envMap(env))
+	assert.Nil(err)
+	assert.Equal(":9002", cfg.ListenAddr)
+	assert.Equal("env-host", cfg.Postgres.Host)
+	assert.Equal(7000, cfg.Postgres.Port)
+
+	jsonPath := writeConfigFile(t, "config.json", `{
+		"store": "memory",
+		"distance": {"provider": "greatcircle"},
+		"webhooks": {"timeout": "5s"}
+	}`)
+	defer os.RemoveAll(filepath.Dir(jsonPath))
+
+	cfg, err = LoadConfig([]string{"-config", jsonPath}, envMap(nil))
+	assert.Nil(err)
+	assert.Equal(OrderStoreMemory, cfg.Store)
+	assert.Equal(":8080", cfg.ListenAddr)
+	assert.Equal(5*time.Second, cfg.Webhooks.Timeout.Duration)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	badFile := writeConfigFile(t, "config.yaml", "bogus_key: 1\n")
+	defer os.RemoveAll(filepath.Dir(badFile))
+
+	badJSON := writeConfigFile(t, "config.json", `{"distance": {"road_factr": 1.2}}`)
+	defer os.RemoveAll(filepath.Dir(badJSON))
+
+	badExt := writeConfigFile(t, "config.toml", "")
+	defer os.RemoveAll(filepath.Dir(badExt))
+
+	valid := map[string]string{"ORDERS_GOOGLE_MAPS_API_KEY": "key"}
+
+	badArgs := [][]string{
+		{"-config", badFile},
+		{"-config", badJSON},
+		{"-config", badExt},
+		{"-config", "/does/not/exist.yaml"},
+		{"-store", "bogus"},
+		{"-distance-provider", "bogus"},
+		{"-distance-road-factor", "0.5"},
+		{"-distance-road-factor", "asd"},
+		{"-postgres-port", "asd"},
+		{"-postgres-port", "70000"},
+		{"-postgres-host", ""},
+		{"-postgres-sslmode", "bogus"},
+		{"-listen", ""},
+		{"-webhook-max-attempts", "0"},
+		{"-webhook-timeout", "10"},
+		{"-webhook-poll-interval", "-1s"},
+		{"-webhook-max-retry-backoff", "1s"},
+		{"-courier-capacity", "0"},
+		{"-reaper-hold-timeout", "-1m"},
+		{"-reaper-interval", "0s"},
+		{"-idempotency-ttl", "0s"},
+		{"-distance-timeout", "0s"},
+		{"-distance-max-retries", "-1"},
+		{"-distance-retry-backoff", "-1s"},
+		{"-distance-breaker-threshold", "-1"},
+		{"-distance-breaker-cooldown", "0s"},
+		{"-distance-fallback", "maybe"},
+		{"-distance-cache-precision", "8"},
+		{"-distance-cache-size", "-1"},
+		{"-distance-cache-ttl", "-1h"},
+		{"-store", "memory", "-distance-cache-shared", "true"},
+		{"-bogus-flag"},
+	}
+
+	for _, args := range badArgs {
+		_, err := LoadConfig(args, envMap(valid))
+		assert.NotNil(err, "%v", args)
+	}
+
+	_, err := LoadConfig([]string{}, envMap(map[string]string{
+		"ORDERS_GOOGLE_MAPS_API_KEY":  "key",
+		"ORDERS_DISTANCE_ROAD_FACTOR": "asd",
+	}))
+	assert.NotNil(err)
+}
+
+func TestLoadConfigMigrate(t *testing.T) {
+	assert := assert.New(t)
+
+	// migrate needs no distance settings, e.g. a Google Maps API key
+	cfg, err := LoadConfig([]string{"-store", "postgres", "-distance-provider", "google", "migrate", "up"}, envMap(nil))
+	assert.Nil(err)
+	assert.Equal([]string{"migrate", "up"}, cfg.Args)
+
+	_, err = LoadConfig([]string{"-store", "postgres", "-distance-provider", "google"}, envMap(nil))
+	assert.NotNil(err)
+
+	// but the database settings are still checked
+	_, err = LoadConfig([]string{"-store", "postgres", "-postgres-host", "", "migrate", "status"}, envMap(nil))
+	assert.NotNil(err)
+
+	_, err = LoadConfig([]string{"-store", "bogus", "migrate", "status"}, envMap(nil))
+	assert.NotNil(err)
+}
+
+func TestConfigRedacted(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := DefaultConfig()
+	cfg.Postgres.Password = "hunter2"
+	cfg.Distance.GoogleMapsAPIKey = "secret-key"
+	cfg.AdminToken = "admin-token"
+
+	dump := cfg.String()
+	assert.NotContains(dump, "hunter2")
+	assert.NotContains(dump, "secret-key")
+	assert.NotContains(dump, "admin-token")
+	assert.Contains(dump, redacted)
+
+	// the original config is untouched
+	assert.Equal("hunter2", cfg.Postgres.Password)
+	assert.Equal("secret-key", cfg.Distance.GoogleMapsAPIKey)
+}
+
+func TestPostgresDSN(t *testing.T) {
+	assert := assert.New(t)
+
+	pc := DefaultConfig().Postgres
+	pc.Password = `it's a \secret`
+	pc.SSLMode = "verify-full"
+	pc.SSLRootCert = "/etc/ssl/ca.pem"
+
+	dsn := pc.DSN()
+	assert.Contains(dsn, "host='localhost'")
+	assert.Contains(dsn, "port='5432'")
+	assert.Contains(dsn, `password='it\'s a \\secret'`)
+	assert.Contains(dsn, "sslmode='verify-full'")
+	assert.Contains(dsn, "sslrootcert='/etc/ssl/ca.pem'")
+
+	// empty values are left out
+	pc.SSLRootCert = ""
+	assert.False(strings.Contains(pc.DSN(), "sslrootcert"))
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	CourierRequiredError           = errors.New("COURIER_REQUIRED")
+	CourierTokenInvalidError       = errors.New("COURIER_TOKEN_INVALID")
+	CourierNotFoundError           = errors.New("COURIER_NOT_FOUND")
+	CourierInactiveError           = errors.New("COURIER_INACTIVE")
+	CourierAtCapacityError         = errors.New("COURIER_AT_CAPACITY")
+	OrderNotAssignedToCourierError = errors.New("ORDER_NOT_ASSIGNED_TO_COURIER")
+)
+
+const (
+	// CourierTokenHeader carries the token of the courier named by `courier_id` in an update
+	CourierTokenHeader = "X-Courier-Token"
+
+	// DefaultCourierCapacity is the number of orders a courier may hold at once by default
+	DefaultCourierCapacity = 3
+
+	// maxCourierNameLength matches the size of the `couriers.name` column, in characters
+	maxCourierNameLength = 255
+)
+
+// heldOrderStatuses are the statuses in which an order counts against the capacity of
+// the courier it is assigned to
+var heldOrderStatuses = []string{OrderStatusTaken, OrderStatusPickedUp, OrderStatusInTransit}
+
+// isHeldOrderStatus returns if an order in `status` counts against its courier's capacity
+func isHeldOrderStatus(status string) bool {
+	for _, s := range heldOrderStatuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Courier delivers orders. Deactivated couriers cannot take new orders,
+// but may finish the ones assigned to them
+type Courier struct {
+	Id            int        `json:"id"`
+	Name          string     `json:"name"`
+	Active        bool       `json:"active"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+
+	// Capacity is the maximum number of orders the courier may hold at once,
+	// 0 applies the store's default capacity
+	Capacity int `json:"capacity,omitempty"`
+
+	// Token authenticates the courier's requests. It is only returned when issued,
+	// the store keeps its TokenHash
+	Token     string `json:"token,omitempty"`
+	TokenHash string `json:"-"`
+}
+
+// hashCourierToken returns the TokenHash stored for a courier token
+func hashCourierToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueToken generates a new token for the courier
+func (c *Courier) issueToken() error {
+	token, err := newSecret()
+	if err != nil {
+		return err
+	}
+
+	c.Token, c.TokenHash = token, hashCourierToken(token)
+	return nil
+}
+
+// capacity returns the maximum number of orders the courier may hold at once
+func (c *Courier) capacity(defaultCapacity int) int {
+	if c.Capacity > 0 {
+		return c.Capacity
+	}
+
+	return defaultCapacity
+}
+
+// CourierStore persists couriers. It is implemented by the order stores, which check the
+// courier taking an order in the same transaction as the status update
+type CourierStore interface {
+	// InsertCourier persists a new active courier and returns it with its id
+	InsertCourier(c Courier) (Courier, error)
+
+	// SelectCourier returns a courier by id. sql.ErrNoRows is returned
+	// if no courier exists with the given id
+	SelectCourier(id int) (Courier, error)
+
+	// ListCouriers returns every courier, oldest first
+	ListCouriers() ([]Courier, error)
+
+	// DeactivateCourier deactivates a courier and returns it. Deactivating an inactive
+	// courier leaves it unchanged
+	DeactivateCourier(id int) (Courier, error)
+
+	// SetCourierTokenHash replaces the token of a courier and returns it
+	SetCourierTokenHash(id int, tokenHash string) (Courier, error)
+}
+
+// authenticateCourier checks that a request acting as courier `courierId` carries the
+// courier's token in CourierTokenHeader
+func authenticateCourier(r *http.Request, courierId int) error {
+	courier, err := defaultCourierStore.SelectCourier(courierId)
+	if err == sql.ErrNoRows {
+		return CourierNotFoundError
+	}
+
+	if err != nil {
+		return err
+	}
+
+	tokenHash := hashCourierToken(r.Header.Get(CourierTokenHeader))
+	if courier.TokenHash == "" || subtle.ConstantTimeCompare([]byte(tokenHash), []byte(courier.TokenHash)) != 1 {
+		return CourierTokenInvalidError
+	}
+
+	return nil
+}
+
+// authenticateUpdate returns if a request updating an order is made by an admin, and
+// otherwise checks the token of the courier `courierId` it acts as, if any
+func authenticateUpdate(r *http.Request, courierId int) (admin bool, err error) {
+	// admins may act on behalf of any courier
+	if isAdmin(r) {
+		return true, nil
+	}
+
+	if courierId != 0 {
+		err = authenticateCourier(r, courierId)
+	}
+
+	return false, err
+}
+
+// authorizeUpdate checks that the requester of `update` may move an order from status `from`
+// while it is assigned to courier `assignedCourierId`, 0 if it is not assigned.
+// update.CourierId must have been authenticated, see authenticateCourier
+//
+// Taking an order requires a courier. Once taken, only the assigned courier or an admin may
+// release, progress or cancel the order. Anyone may cancel an unassigned order, giving a reason
+func authorizeUpdate(from string, assignedCourierId int, update StatusUpdate) error {
+	switch {
+	case update.Status == OrderStatusTaken:
+		if update.CourierId == 0 {
+			return CourierRequiredError
+		}
+
+		return nil
+	case update.Status == OrderStatusCancelled && update.Reason == "":
+		return CancellationReasonRequiredError
+	case update.Admin:
+	case assignedCourierId != 0 && update.CourierId != assignedCourierId:
+		return OrderNotAssignedToCourierError
+	case assignedCourierId == 0 && from != OrderStatusUnassign:
+		// orders taken before couriers were introduced have no assignee
+		return OrderNotAssignedToCourierError
+	}
+
+	return nil
+}
+
+// assigneeAfter returns the courier an order is assigned to once `update` is applied,
+// given its current assignee
+func assigneeAfter(assignedCourierId int, update StatusUpdate) int {
+	switch update.Status {
+	case OrderStatusTaken:
+		return update.CourierId
+	case OrderStatusUnassign:
+		return 0
+	default:
+		return assignedCourierId
+	}
+}
+
+// courierRequest is the body of POST /courier
+type courierRequest struct {
+	Name     string `json:"name"`
+	Capacity int    `json:"capacity"`
+}
+
+// writeCourierError writes the error response for an error returned by
+// the CourierStore while operating on courier `id`
+func writeCourierError(w http.ResponseWriter, id int, err error) {
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No courier present with id %d", id))
+		return
+	}
+
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// createCourier registers a new active courier. The response is the only one to include
+// the courier's token, along with that of issueCourierToken
+func createCourier(w http.ResponseWriter, r *http.Request) {
+	var req courierRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxCourierNameLength {
+		writeError(w, http.StatusBadRequest,
+			fmt.Sprintf("name is required and must be at most %d characters", maxCourierNameLength))
+		return
+	}
+
+	if req.Capacity < 0 {
+		writeError(w, http.StatusBadRequest, "capacity must be positive, omit it to apply the default capacity")
+		return
+	}
+
+	courier := Courier{Name: name, Active: true, Capacity: req.Capacity}
+	if err := courier.issueToken(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	created, err := defaultCourierStore.InsertCourier(courier)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("new courier created: %d", created.Id)
+	created.Token = courier.Token
+	writeJSON(w, http.StatusOK, created)
+}
+
+// listCouriers lists every courier, oldest first
+func listCouriers(w http.ResponseWriter, r *http.Request) {
+	couriers, err := defaultCourierStore.ListCouriers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, couriers)
+}
+
+// getCourier returns a single courier by id
+func getCourier(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIdVar(w, r, "courier")
+	if !ok {
+		return
+	}
+
+	courier, err := defaultCourierStore.SelectCourier(id)
+	if err != nil {
+		writeCourierError(w, id, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, courier)
+}
+
+// deactivateCourier stops a courier from taking new orders
+func deactivateCourier(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIdVar(w, r, "courier")
+	if !ok {
+		return
+	}
+
+	courier, err := defaultCourierStore.DeactivateCourier(id)
+	if err != nil {
+		writeCourierError(w, id, err)
+		return
+	}
+
+	log.Printf("courier deactivated: %d", id)
+	writeJSON(w, http.StatusOK, courier)
+}
+
+// issueCourierToken replaces the token of a courier, e.g. when it was leaked or the courier
+// was registered before tokens existed. The previous token stops working at once
+func issueCourierToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIdVar(w, r, "courier")
+	if !ok {
+		return
+	}
+
+	var courier Courier
+	if err := courier.issueToken(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	updated, err := defaultCourierStore.SetCourierTokenHash(id, courier.TokenHash)
+	if err != nil {
+		writeCourierError(w, id, err)
+		return
+	}
+
+	log.Printf("courier token issued: %d", id)
+	updated.Token = courier.Token
+	writeJSON(w, http.StatusOK, updated)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCourierToken is the token of the couriers registered by newTestCourier
+const testCourierToken = "test-courier-token"
+
+// newTestCourier registers an active courier in the default store and returns its id
+func newTestCourier(t *testing.T) int {
+	c, err := defaultCourierStore.InsertCourier(Courier{
+		Name:      "test courier",
+		TokenHash: hashCourierToken(testCourierToken),
+	})
+	assert.Nil(t, err)
+	return c.Id
+}
+
+func TestAuthorizeUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(CourierRequiredError, authorizeUpdate(OrderStatusUnassign, 0, StatusUpdate{Status: OrderStatusTaken}))
+	assert.Equal(CourierRequiredError, authorizeUpdate(OrderStatusUnassign, 0,
+		StatusUpdate{Status: OrderStatusTaken, Admin: true}))
+	assert.Nil(authorizeUpdate(OrderStatusUnassign, 0, StatusUpdate{Status: OrderStatusTaken, CourierId: 1}))
+
+	// only the assignee or an admin moves a taken order
+	assert.Nil(authorizeUpdate(OrderStatusTaken, 1, StatusUpdate{Status: OrderStatusPickedUp, CourierId: 1}))
+	assert.Nil(authorizeUpdate(OrderStatusTaken, 1, StatusUpdate{Status: OrderStatusUnassign, Admin: true}))
+	assert.Equal(OrderNotAssignedToCourierError, authorizeUpdate(OrderStatusTaken, 1,
+		StatusUpdate{Status: OrderStatusUnassign, CourierId: 2}))
+	assert.Equal(OrderNotAssignedToCourierError, authorizeUpdate(OrderStatusTaken, 1,
+		StatusUpdate{Status: OrderStatusUnassign}))
+
+	// orders taken before couriers existed have no assignee
+	assert.Equal(OrderNotAssignedToCourierError, authorizeUpdate(OrderStatusTaken, 0,
+		StatusUpdate{Status: OrderStatusPickedUp, CourierId: 1}))
+	assert.Nil(authorizeUpdate(OrderStatusTaken, 0, StatusUpdate{Status: OrderStatusPickedUp, Admin: true}))
+
+	// anyone may cancel an unassigned order, only the assignee or an admin an assigned one
+	cancel := StatusUpdate{Status: OrderStatusCancelled, Reason: CancelReasonOther}
+	assert.Nil(authorizeUpdate(OrderStatusUnassign, 0, cancel))
+	assert.Equal(OrderNotAssignedToCourierError, authorizeUpdate(OrderStatusTaken, 1, cancel))
+	assert.Equal(OrderNotAssignedToCourierError, authorizeUpdate(OrderStatusTaken, 0, cancel))
+
+	cancel.CourierId = 2
+	assert.Equal(OrderNotAssignedToCourierError, authorizeUpdate(OrderStatusInTransit, 1, cancel))
+	cancel.CourierId = 1
+	assert.Nil(authorizeUpdate(OrderStatusInTransit, 1, cancel))
+	assert.Nil(authorizeUpdate(OrderStatusPickedUp, 2, StatusUpdate{
+		Status: OrderStatusCancelled, Reason: CancelReasonOther, Admin: true,
+	}))
+
+	assert.Equal(1, assigneeAfter(0, StatusUpdate{Status: OrderStatusTaken, CourierId: 1}))
+	assert.Equal(1, assigneeAfter(1, StatusUpdate{Status: OrderStatusPickedUp, CourierId: 1}))
+	assert.Equal(0, assigneeAfter(1, StatusUpdate{Status: OrderStatusUnassign, Admin: true}))
+}
+
+func TestCourierEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "let-me-in"
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+
+	send := func(method, endpoint, body, token string) *http.Response {
+		req, _ := http.NewRequest(method, endpoint, bytes.NewReader([]byte(body)))
+		if token != "" {
+			req.Header.Set(AdminTokenHeader, token)
+		}
+
+		resp, err := client.Do(req)
+		assert.Nil(err)
+		return resp
+	}
+
+	post := func(endpoint, body, token string) *http.Response {
+		return send(http.MethodPost, endpoint, body, token)
+	}
+
+	get := func(endpoint, token string) *http.Response {
+		return send(http.MethodGet, endpoint, "", token)
+	}
+
+	// couriers are managed by admins only
+	for _, token := range []string{"", "guess"} {
+		resp := post(srv.URL+"/courier", `{"name": "Ada"}`, token)
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+	}
+
+	for _, bad := range []string{
+		`{}`,
+		`{"name": "   "}`,
+		`{"name": "Ada", "capacity": -1}`,
+		`{"name": `,
+		fmt.Sprintf(`{"name": "%s"}`, strings.Repeat("é", maxCourierNameLength+1)),
+	} {
+		resp := post(srv.URL+"/courier", bad, adminToken)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, bad)
+	}
+
+	// names are bounded in characters, not bytes
+	resp := post(srv.URL+"/courier", fmt.Sprintf(`{"name": "%s"}`, strings.Repeat("é", maxCourierNameLength)), adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp = post(srv.URL+"/courier", `{"name": " Ada "}`, adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// the token is returned on creation only
+	var created Courier
+	json.NewDecoder(resp.Body).Decode(&created)
+	assert.Equal("Ada", created.Name)
+	assert.True(created.Active)
+	assert.NotNil(created.CreatedAt)
+	assert.Nil(created.DeactivatedAt)
+	assert.NotEmpty(created.Token)
+
+	courierEndpoint := fmt.Sprintf("%s/courier/%d", srv.URL, created.Id)
+
+	// so is reading the roster
+	for _, endpoint := range []string{courierEndpoint, srv.URL + "/couriers"} {
+		resp = get(endpoint, "")
+		assert.Equal(http.StatusForbidden, resp.StatusCode, endpoint)
+	}
+
+	resp = get(courierEndpoint, adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.NotContains(string(respBody), "token")
+
+	resp = get(srv.URL+"/couriers", adminToken)
+	var listed []Courier
+	json.NewDecoder(resp.Body).Decode(&listed)
+	assert.NotEmpty(listed)
+
+	stored, _ := defaultCourierStore.SelectCourier(created.Id)
+	assert.Equal(hashCourierToken(created.Token), stored.TokenHash)
+
+	// issuing a token replaces the previous one
+	resp = post(courierEndpoint+"/token", "", "")
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	resp = post(courierEndpoint+"/token", "", adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var reissued Courier
+	json.NewDecoder(resp.Body).Decode(&reissued)
+	assert.NotEmpty(reissued.Token)
+	assert.NotEqual(created.Token, reissued.Token)
+
+	stored, _ = defaultCourierStore.SelectCourier(created.Id)
+	assert.Equal(hashCourierToken(reissued.Token), stored.TokenHash)
+
+	resp = post(courierEndpoint+"/deactivate", "", "")
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// deactivation is idempotent
+	var deactivated Courier
+	for i := 0; i < 2; i++ {
+		resp = post(courierEndpoint+"/deactivate", "", adminToken)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		var c Courier
+		json.NewDecoder(resp.Body).Decode(&c)
+		assert.False(c.Active)
+		if assert.NotNil(c.DeactivatedAt) && deactivated.DeactivatedAt != nil {
+			assert.True(deactivated.DeactivatedAt.Equal(*c.DeactivatedAt))
+		}
+		deactivated = c
+	}
+
+	resp = get(srv.URL+"/courier/99999", adminToken)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	for _, path := range []string{"/deactivate", "/token"} {
+		resp = post(srv.URL+"/courier/99999"+path, "", adminToken)
+		assert.Equal(http.StatusNotFound, resp.StatusCode, path)
+	}
+
+	resp = get(srv.URL+"/courier/abc", adminToken)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestUpdateOrderCourier(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "let-me-in"
+
+	id, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+	owner, other := newTestCourier(t), newTestCourier(t)
+
+	inactive := newTestCourier(t)
+	_, err := defaultCourierStore.DeactivateCourier(inactive)
+	assert.Nil(err)
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+	orderEndpoint := fmt.Sprintf("%s/order/%d", srv.URL, id)
+
+	// put sends an update with an admin token and a courier token, when not empty
+	put := func(body, token, courierToken string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader([]byte(body)))
+		if token != "" {
+			req.Header.Set(AdminTokenHeader, token)
+		}
+
+		if courierToken != "" {
+			req.Header.Set(CourierTokenHeader, courierToken)
+		}
+
+		resp, err := client.Do(req)
+		if !assert.Nil(err) {
+			return 0, ""
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	code, body := put(`{"status": "taken"}`, "", "")
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Contains(body, "COURIER_REQUIRED")
+
+	code, body = put(`{"status": "taken", "courier_id": 99999}`, "", testCourierToken)
+	assert.Equal(http.StatusUnprocessableEntity, code)
+	assert.Contains(body, "COURIER_NOT_FOUND")
+
+	code, body = put(fmt.Sprintf(`{"status": "taken", "courier_id": %d}`, inactive), "", testCourierToken)
+	assert.Equal(http.StatusConflict, code)
+	assert.Contains(body, "COURIER_INACTIVE")
+
+	// a courier id is only taken with the courier's token
+	for _, courierToken := range []string{"", "guess"} {
+		code, body = put(fmt.Sprintf(`{"status": "taken", "courier_id": %d}`, owner), "", courierToken)
+		assert.Equal(http.StatusUnauthorized, code)
+		assert.Contains(body, "COURIER_TOKEN_INVALID")
+	}
+
+	untokened, err := defaultCourierStore.InsertCourier(Courier{Name: "registered before tokens"})
+	assert.Nil(err)
+	code, body = put(fmt.Sprintf(`{"status": "taken", "courier_id": %d}`, untokened.Id), "", "")
+	assert.Equal(http.StatusUnauthorized, code)
+	assert.Contains(body, "COURIER_TOKEN_INVALID")
+
+	code, _ = put(fmt.Sprintf(`{"status": "taken", "courier_id": %d}`, owner), "", testCourierToken)
+	assert.Equal(http.StatusOK, code)
+
+	order, _ := defaultOrderStore.SelectOrder(id)
+	assert.Equal(owner, order.AssignedCourierId)
+
+	// another courier, or a wrong admin token, cannot move the order
+	for _, attempt := range []struct{ body, token string }{
+		{fmt.Sprintf(`{"status": "UNASSIGN", "courier_id": %d}`, other), ""},
+		{fmt.Sprintf(`{"status": "picked_up", "courier_id": %d}`, other), ""},
+		{`{"status": "UNASSIGN"}`, "wrong"},
+	} {
+		code, body = put(attempt.body, attempt.token, testCourierToken)
+		assert.Equal(http.StatusForbidden, code, attempt.body)
+		assert.Contains(body, "ORDER_NOT_ASSIGNED_TO_COURIER")
+	}
+
+	code, _ = put(fmt.Sprintf(`{"status": "picked_up", "courier_id": %d}`, owner), "", testCourierToken)
+	assert.Equal(http.StatusOK, code)
+
+	// an admin may move an order assigned to anyone
+	code, _ = put(`{"status": "in_transit"}`, "let-me-in", "")
+	assert.Equal(http.StatusOK, code)
+
+	order, _ = defaultOrderStore.SelectOrder(id)
+	assert.Equal(OrderStatusInTransit, order.Status)
+	assert.Equal(owner, order.AssignedCourierId)
+}
+
+func TestUpdateOrderCourierCapacity(t *testing.T) {
+	assert := assert.New(t)
+
+	courier, err := defaultCourierStore.InsertCourier(Courier{
+		Name:      "Ada",
+		Capacity:  1,
+		TokenHash: hashCourierToken(testCourierToken),
+	})
+	assert.Nil(err)
+
+	first, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+	second, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+
+	take := func(orderId int) (int, string) {
+		body := fmt.Sprintf(`{"status": "taken", "courier_id": %d}`, courier.Id)
+		req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/order/%d", srv.URL, orderId),
+			bytes.NewReader([]byte(body)))
+		req.Header.Set(CourierTokenHeader, testCourierToken)
+
+		resp, err := client.Do(req)
+		if !assert.Nil(err) {
+			return 0, ""
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	code, _ := take(first)
+	assert.Equal(http.StatusOK, code)
+
+	code, body := take(second)
+	assert.Equal(http.StatusConflict, code)
+	assert.Equal("{\"error\":\"COURIER_AT_CAPACITY\"}\n", body)
+
+	order, _ := defaultOrderStore.SelectOrder(second)
+	assert.Equal(OrderStatusUnassign, order.Status)
+}
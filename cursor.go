@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned when decoding a cursor which was not produced by OrderCursor.Encode
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// OrderCursor is a position in the listing of orders ordered by creation time, then id.
+// Listing the orders after a cursor is stable: orders created in the meantime are listed
+// on later pages, and no order is listed twice or skipped
+type OrderCursor struct {
+	CreatedAt time.Time
+	Id        int
+}
+
+// Encode returns the cursor as an opaque string, safe to use in a URL
+func (c OrderCursor) Encode() string {
+	raw := fmt.Sprintf("%d:%d", c.CreatedAt.UnixNano(), c.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeOrderCursor parses a string returned by OrderCursor.Encode
+func DecodeOrderCursor(s string) (c OrderCursor, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 2 {
+		return c, ErrInvalidCursor
+	}
+
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	c.Id, err = strconv.Atoi(parts[1])
+	if err != nil || c.Id <= 0 {
+		return c, ErrInvalidCursor
+	}
+
+	// Postgres TIMESTAMP columns are read as UTC wall clock times, and compared as such
+	c.CreatedAt = time.Unix(0, createdAt).UTC()
+	return c, nil
+}
+
+// precedes returns if the cursor is positioned before `order`
+func (c OrderCursor) precedes(order ResolvedOrder) bool {
+	if order.CreatedAt.Equal(c.CreatedAt) {
+		return order.Id > c.Id
+	}
+
+	return order.CreatedAt.After(c.CreatedAt)
+}
+
+// cursorOf returns the cursor positioned at `order`
+func cursorOf(order ResolvedOrder) OrderCursor {
+	return OrderCursor{CreatedAt: *order.CreatedAt, Id: order.Id}
+}
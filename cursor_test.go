@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderCursor(t *testing.T) {
+	assert := assert.New(t)
+
+	c := OrderCursor{CreatedAt: time.Date(2018, 7, 1, 10, 0, 0, 123456000, time.UTC), Id: 42}
+	decoded, err := DecodeOrderCursor(c.Encode())
+	assert.Nil(err)
+	assert.Equal(c, decoded)
+
+	for _, bad := range []string{
+		"",
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("123")),
+		base64.RawURLEncoding.EncodeToString([]byte("abc:1")),
+		base64.RawURLEncoding.EncodeToString([]byte("123:0")),
+		base64.RawURLEncoding.EncodeToString([]byte("123:1:2")),
+	} {
+		_, err = DecodeOrderCursor(bad)
+		assert.Equal(ErrInvalidCursor, err, bad)
+	}
+}
@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"googlemaps.github.io/maps"
 )
 
 var (
@@ -18,61 +21,178 @@ var (
 )
 
 // OrderDatabase provides a wrapper around a database/sql connection
-// to interact and mutate the `orders` table in Postgres
-// Schema for the orders table can be found in release/db/SCHEMAS.sql
+// to interact and mutate the `orders` table in Postgres. It implements OrderStore
+// Schema for the orders table is defined by the migrations in migrations.go
 type OrderDatabase struct {
 	db *sql.DB
+
+	// CourierCapacity is the number of orders a courier may hold at once,
+	// unless the courier has its own capacity
+	CourierCapacity int
 }
 
 // NewOrderDatabase creates a new OrderDatabase
-func NewOrderDatabase(host string) (od *OrderDatabase, err error) {
-	connStr := fmt.Sprintf(
-		"host=%s user=postgres dbname=postgres password=password sslmode=disable",
-		host,
-	)
-	db, err := sql.Open("postgres", connStr)
+func NewOrderDatabase(pc PostgresConfig) (od *OrderDatabase, err error) {
+	db, err := sql.Open("postgres", pc.DSN())
 
 	if err != nil {
 		return
 	}
 
-	od = &OrderDatabase{db}
+	od = &OrderDatabase{db: db, CourierCapacity: DefaultCourierCapacity}
 	return
 }
 
 // SelectOrder selects an order from the database by id
-func (od *OrderDatabase) SelectOrder(orderId int) (status string, err error) {
-	err = od.db.QueryRow(`SELECT status FROM orders WHERE id = $1`, orderId).Scan(&status)
+func (od *OrderDatabase) SelectOrder(orderId int) (order ResolvedOrder, err error) {
+	var originLat, originLng, destLat, destLng string
+	var createdAt, updatedAt time.Time
+	var departureTime pq.NullTime
+
+	err = od.db.QueryRow(`SELECT id, origin_lat, origin_lng, dest_lat, dest_lng,
+			distance_m, status, created_at, updated_at, COALESCE(assigned_courier_id, 0), version,
+			COALESCE(duration_s, 0), COALESCE(duration_in_traffic_s, 0), departure_time, mode, avoid,
+			`+orderPlaceColumns+`
+		FROM orders WHERE id = $1`, orderId,
+	).Scan(
+		&order.Id, &originLat, &originLng, &destLat, &destLng,
+		&order.Distance, &order.Status, &createdAt, &updatedAt, &order.AssignedCourierId, &order.Version,
+		&order.DurationS, &order.DurationInTrafficS, &departureTime, &order.Mode, pq.Array(&order.Avoid),
+		&order.OriginAddress, &order.OriginPlaceId, &order.OriginFormattedAddress,
+		&order.DestinationAddress, &order.DestinationPlaceId, &order.DestinationFormattedAddress,
+	)
 	if err != nil {
 		return
 	}
 
-	log.Printf("retrieved order: %d, status: %s", orderId, status)
+	order.Origin = LatLng{originLat, originLng}
+	order.Destination = LatLng{destLat, destLng}
+	order.CreatedAt = &createdAt
+	order.UpdatedAt = &updatedAt
+	setDeparture(&order, departureTime)
+
+	log.Printf("retrieved order: %d, status: %s", orderId, order.Status)
 	return
 }
 
-// InsertOrder inserts an order into the database
-func (od *OrderDatabase) InsertOrder(
-	origin, destination, status string, distance int) (orderId int, err error) {
+// orderPlaceColumns are the addresses and place ids the endpoints of an order were given by,
+// empty for endpoints given by coordinates
+const orderPlaceColumns = `COALESCE(origin_address, ''), COALESCE(origin_place_id, ''),
+	COALESCE(origin_formatted_address, ''), COALESCE(dest_address, ''), COALESCE(dest_place_id, ''),
+	COALESCE(dest_formatted_address, '')`
+
+// setDeparture sets the departure time and ETA of an order read from the database,
+// orders without a departure time left when created
+func setDeparture(order *ResolvedOrder, departureTime pq.NullTime) {
+	departure := *order.CreatedAt
+	if departureTime.Valid {
+		departure = departureTime.Time
+		order.DepartureTime = &departure
+	}
+
+	order.setETA(departure)
+}
+
+// InsertOrder inserts an order into the database along with the event recording its creation
+func (od *OrderDatabase) InsertOrder(order ResolvedOrder) (orderId int, err error) {
+	tx, err := od.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	// coordinates are sent as text so Postgres parses them into NUMERIC without losing precision
+	// TIMESTAMP columns drop time zones, departures are stored in UTC
+	var departureTime pq.NullTime
+	if order.DepartureTime != nil {
+		departureTime = pq.NullTime{Time: order.DepartureTime.UTC(), Valid: true}
+	}
+
+	mode := order.Mode
+	if mode == "" {
+		mode = TravelModeDriving
+	}
 
-	err = od.db.QueryRow(`INSERT INTO orders(origin, destination, distance, status)
-		VALUES($1, $2, $3, $4) RETURNING id`,
-		origin, destination,
-		distance, status,
+	// durations are unknown rather than 0 seconds when missing
+	err = tx.QueryRow(`INSERT INTO orders(
+			origin_lat, origin_lng, dest_lat, dest_lng, distance_m, status,
+			duration_s, duration_in_traffic_s, departure_time, mode, avoid,
+			origin_address, origin_place_id, origin_formatted_address,
+			dest_address, dest_place_id, dest_formatted_address)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11,
+			NULLIF($12, ''), NULLIF($13, ''), NULLIF($14, ''), NULLIF($15, ''), NULLIF($16, ''), NULLIF($17, ''))
+		RETURNING id`,
+		order.Origin[0], order.Origin[1], order.Destination[0], order.Destination[1],
+		order.Distance, order.Status,
+		sql.NullInt64{Int64: int64(order.DurationS), Valid: order.DurationS > 0},
+		sql.NullInt64{Int64: int64(order.DurationInTrafficS), Valid: order.DurationInTrafficS > 0},
+		departureTime, mode, pq.StringArray(normalizeAvoid(order.Avoid)),
+		order.OriginAddress, order.OriginPlaceId, order.OriginFormattedAddress,
+		order.DestinationAddress, order.DestinationPlaceId, order.DestinationFormattedAddress,
 	).Scan(&orderId)
 
 	if err != nil {
 		return
 	}
 
+	err = recordOrderEvent(tx, OrderEvent{OrderId: orderId, To: order.Status})
+	if err != nil {
+		return
+	}
+
 	log.Printf("new order created: %d", orderId)
 	return
 }
 
+// orderEventsChannel is the Postgres NOTIFY channel on which new order events are announced
+const orderEventsChannel = "order_events"
+
+// recordOrderEvent writes an event to `order_events`, queues it in the webhook outbox for
+// every subscription wanting it and announces it on orderEventsChannel.
+// Postgres delivers the notification when, and only if, `tx` commits
+func recordOrderEvent(tx *sql.Tx, e OrderEvent) error {
+	err := tx.QueryRow(`INSERT INTO order_events(order_id, from_status, to_status, actor, request_id, reason, note)
+		VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		e.OrderId, e.From, e.To, e.Actor, e.RequestId, e.Reason, e.Note,
+	).Scan(&e.Id, &e.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	e.Type = orderEventType(e.From, e.To)
+
+	// an empty event_types subscribes to every event type, see WebhookSubscription.wants
+	_, err = tx.Exec(`INSERT INTO webhook_deliveries(subscription_id, event_id)
+		SELECT id, $1 FROM webhook_subscriptions
+		WHERE active AND (cardinality(event_types) = 0 OR $2 = ANY(event_types))`,
+		e.Id, e.Type,
+	)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, orderEventsChannel, string(payload))
+	return err
+}
+
 // timeout in milliseconds for the UpdateOrderStatus transaction
 const ctxTimeoutMs = 2000
 
-// UpdateOrderStatus updates an order's status from UNASSIGN -> taken, or vice versa
+// UpdateOrderStatus moves an order to a new status, following the lifecycle
+// state machine defined in lifecycle.go, and records the transition in `order_events`
 
 // It initiates a transaction and acquires a row-level lock for the order
 // being updated
@@ -80,7 +200,7 @@ const ctxTimeoutMs = 2000
 // A configurable timeout of 2 seconds is enforced via context.Context to ensure that
 // a transaction does not hold a lock for too long. If the context expires, the
 // transaction is rolled back
-func (od *OrderDatabase) UpdateOrderStatus(orderId int, newStatus string) (err error) {
+func (od *OrderDatabase) UpdateOrderStatus(orderId int, update StatusUpdate) (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeoutMs*time.Millisecond)
 	defer cancel()
 
@@ -102,26 +222,75 @@ func (od *OrderDatabase) UpdateOrderStatus(orderId int, newStatus string) (err e
 	// FOR UPDATE clause acquires a row-level lock
 	// https://www.postgresql.org/docs/9.6/static/explicit-locking.html#LOCKING-ROWS
 	var status string
-	err = tx.QueryRow(`SELECT status FROM orders where id=$1 FOR UPDATE`,
-		orderId).Scan(&status)
+	var assignedCourierId, version int
+	err = tx.QueryRow(`SELECT status, COALESCE(assigned_courier_id, 0), version FROM orders where id=$1 FOR UPDATE`,
+		orderId).Scan(&status, &assignedCourierId, &version)
+
+	if err != nil {
+		return err
+	}
+
+	err = checkVersion(version, update)
+	if err != nil {
+		return err
+	}
 
+	// the status read under the row lock is current, so a transition allowed here
+	// cannot be invalidated by a concurrent request, e.g. if we encounter a `taken`
+	// order, it must have been updated by an earlier transaction
+	err = validateTransition(status, update.Status)
 	if err != nil {
 		return err
 	}
 
-	// if we encounter a `taken` order, it must have been updated by an earlier transaction
-	if status == newStatus {
-		if newStatus == OrderStatusTaken {
-			return OrderAlreadyTakenError
-		} else if newStatus == OrderStatusUnassign {
-			return OrderAlreadyUnassignError
+	err = authorizeUpdate(status, assignedCourierId, update)
+	if err != nil {
+		return err
+	}
+
+	if update.Status == OrderStatusTaken {
+		// locking the courier serializes its takes, so that two concurrent takes cannot both
+		// see the courier under capacity. It also keeps the courier from being deactivated
+		// until the take commits
+		var active bool
+		var capacity int
+		err = tx.QueryRow(`SELECT active, COALESCE(capacity, $2) FROM couriers WHERE id = $1 FOR UPDATE`,
+			update.CourierId, od.CourierCapacity).Scan(&active, &capacity)
+
+		if err == sql.ErrNoRows {
+			return CourierNotFoundError
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !active {
+			return CourierInactiveError
+		}
+
+		var held int
+		err = tx.QueryRow(`SELECT count(*) FROM orders
+			WHERE assigned_courier_id = $1 AND status = ANY($2)`,
+			update.CourierId, pq.Array(heldOrderStatuses)).Scan(&held)
+
+		if err != nil {
+			return err
+		}
+
+		if held >= capacity {
+			return CourierAtCapacityError
 		}
 	}
 
-	// ensure that we only allow UNASSSIGN -> taken transition
+	// a zero assignee is stored as NULL
+	assignee := sql.NullInt64{Int64: int64(assigneeAfter(assignedCourierId, update))}
+	assignee.Valid = assignee.Int64 != 0
+
 	row := tx.QueryRow(
-		`UPDATE orders SET status = $1 WHERE id = $2 and status = $3 RETURNING id, status`,
-		newStatus, orderId, status,
+		`UPDATE orders SET status = $1, assigned_courier_id = $4, version = version + 1, updated_at = NOW()
+		WHERE id = $2 and status = $3 RETURNING id, status`,
+		update.Status, orderId, status, assignee,
 	)
 
 	var updatedStatus string
@@ -132,57 +301,780 @@ func (od *OrderDatabase) UpdateOrderStatus(orderId int, newStatus string) (err e
 		return err
 	}
 
-	return nil
+	// the event is written in the same transaction, so history never disagrees with the order
+	return recordOrderEvent(tx, OrderEvent{
+		OrderId:   orderId,
+		From:      status,
+		To:        update.Status,
+		Actor:     update.Actor,
+		RequestId: update.RequestId,
+		Reason:    update.Reason,
+		Note:      update.Note,
+	})
+}
+
+// ReleaseStaleOrders returns up to `limit` orders which have been `taken` for longer than
+// `holdTimeout` to UNASSIGN, in a single transaction
+//
+// Orders locked by a concurrent update or by the reaper of another replica are skipped
+// rather than waited for, so no order is released twice
+func (od *OrderDatabase) ReleaseStaleOrders(holdTimeout time.Duration, limit int) (released []int, err error) {
+	tx, err := od.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	// the hold is measured against the database clock, which every replica shares
+	rows, err := tx.Query(`SELECT id FROM orders
+		WHERE status = $1 AND updated_at < NOW() - $2::DOUBLE PRECISION * INTERVAL '1 millisecond'
+		ORDER BY updated_at LIMIT $3
+		FOR UPDATE SKIP LOCKED`,
+		OrderStatusTaken, int64(holdTimeout/time.Millisecond), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := pq.Int64Array{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE orders SET status = $1, assigned_courier_id = NULL, version = version + 1, updated_at = NOW()
+		WHERE id = ANY($2)`, OrderStatusUnassign, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		err = recordOrderEvent(tx, OrderEvent{
+			OrderId: int(id),
+			From:    OrderStatusTaken,
+			To:      OrderStatusUnassign,
+			Actor:   reaperActor,
+			Reason:  ReleaseReasonHoldTimeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		released = append(released, int(id))
+	}
+
+	return released, nil
+}
+
+// OrderHistory retrieves the creation and status transitions of an order, oldest first
+func (od *OrderDatabase) OrderHistory(orderId int) ([]OrderEvent, error) {
+	var exists int
+	err := od.db.QueryRow(`SELECT 1 FROM orders WHERE id = $1`, orderId).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	return od.queryOrderEvents(`SELECT id, order_id, from_status, to_status, actor, request_id, reason, note, created_at
+		FROM order_events WHERE order_id = $1 ORDER BY id`, orderId)
 }
 
-// countOrders counts the orders in the database
-func (od *OrderDatabase) countOrders() (int, error) {
+// EventsSince retrieves up to `limit` events with an id greater than `afterId`, oldest first
+func (od *OrderDatabase) EventsSince(afterId int64, limit int) ([]OrderEvent, error) {
+	return od.queryOrderEvents(`SELECT id, order_id, from_status, to_status, actor, request_id, reason, note, created_at
+		FROM order_events WHERE id > $1 ORDER BY id LIMIT $2`, afterId, limit)
+}
+
+// LastEventId returns the id of the latest order event, 0 if there are none
+func (od *OrderDatabase) LastEventId() (lastId int64, err error) {
+	err = od.db.QueryRow(`SELECT COALESCE(max(id), 0) FROM order_events`).Scan(&lastId)
+	return
+}
+
+// queryOrderEvents runs a query selecting the columns of `order_events` and collects the results
+func (od *OrderDatabase) queryOrderEvents(query string, args ...interface{}) ([]OrderEvent, error) {
+	rows, err := od.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OrderEvent{}
+	for rows.Next() {
+		var e OrderEvent
+
+		err = rows.Scan(&e.Id, &e.OrderId, &e.From, &e.To, &e.Actor, &e.RequestId, &e.Reason, &e.Note, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Type = orderEventType(e.From, e.To)
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// orderQueryWhere returns the WHERE clause selecting the orders of a query, or an empty string
+// if it selects every order. Values are bound as query arguments appended to `args`
+func orderQueryWhere(q OrderQuery, args *[]interface{}) string {
+	bind := func(v interface{}) string {
+		*args = append(*args, v)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+
+	conds := []string{}
+
+	if len(q.Statuses) > 0 {
+		conds = append(conds, "status = ANY("+bind(pq.StringArray(q.Statuses))+")")
+	}
+
+	if len(q.ExcludedStatuses) > 0 {
+		conds = append(conds, "status <> ALL("+bind(pq.StringArray(q.ExcludedStatuses))+")")
+	}
+
+	if q.MinDistance != nil {
+		conds = append(conds, "distance_m >= "+bind(*q.MinDistance))
+	}
+
+	if q.MaxDistance != nil {
+		conds = append(conds, "distance_m <= "+bind(*q.MaxDistance))
+	}
+
+	if q.CreatedSince != nil {
+		conds = append(conds, "created_at >= "+bind(*q.CreatedSince))
+	}
+
+	if q.CreatedBefore != nil {
+		conds = append(conds, "created_at < "+bind(*q.CreatedBefore))
+	}
+
+	if q.Origin != nil {
+		conds = append(conds, areaCondition(*q.Origin, "origin_lat", "origin_lng", bind))
+	}
+
+	if q.Destination != nil {
+		conds = append(conds, areaCondition(*q.Destination, "dest_lat", "dest_lng", bind))
+	}
+
+	if len(conds) == 0 {
+		return ""
+	}
+
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+// areaCondition returns the condition that the point in columns `lat`, `lng` lies in an area,
+// following BoundingBox.contains and Circle.contains
+func areaCondition(a Area, lat, lng string, bind func(interface{}) string) string {
+	if b := a.Box; b != nil {
+		cond := fmt.Sprintf("%s BETWEEN %s AND %s", lat, bind(b.MinLat), bind(b.MaxLat))
+
+		if b.MinLng > b.MaxLng {
+			return cond + fmt.Sprintf(" AND (%s >= %s OR %s <= %s)", lng, bind(b.MinLng), lng, bind(b.MaxLng))
+		}
+
+		return cond + fmt.Sprintf(" AND %s BETWEEN %s AND %s", lng, bind(b.MinLng), bind(b.MaxLng))
+	}
+
+	// the haversine formula, see haversine in distance.go
+	c := a.Circle
+	centerLat, centerLng := bind(c.Center.Lat), bind(c.Center.Lng)
+
+	return fmt.Sprintf(`2 * %s * asin(LEAST(1, sqrt(
+		power(sin(radians(%s::DOUBLE PRECISION - %s::DOUBLE PRECISION) / 2), 2) +
+		cos(radians(%s::DOUBLE PRECISION)) * cos(radians(%s::DOUBLE PRECISION)) *
+		power(sin(radians(%s::DOUBLE PRECISION - %s::DOUBLE PRECISION) / 2), 2)
+	))) <= %s`,
+		bind(earthRadiusMeters),
+		lat, centerLat,
+		centerLat, lat,
+		lng, centerLng,
+		bind(c.Radius),
+	)
+}
+
+// orderSortColumns maps the fields orders can be sorted on to their column
+var orderSortColumns = map[string]string{
+	OrderSortId:        "id",
+	OrderSortDistance:  "distance_m",
+	OrderSortCreatedAt: "created_at",
+}
+
+// orderBy returns the ORDER BY clause of a sort, ties are broken by id
+func orderBy(s OrderSort) string {
+	direction := "ASC"
+	if s.Desc {
+		direction = "DESC"
+	}
+
+	return fmt.Sprintf("ORDER BY %s %s, id %s", orderSortColumns[s.Field], direction, direction)
+}
+
+// countOrders counts the orders in the database selected by a query
+func (od *OrderDatabase) countOrders(q OrderQuery) (int, error) {
 	var count int
+	var args []interface{}
 
-	err := od.db.QueryRow(`SELECT COUNT(*) FROM orders`).Scan(&count)
+	err := od.db.QueryRow(`SELECT COUNT(*) FROM orders `+orderQueryWhere(q, &args), args...).Scan(&count)
 	return count, err
 }
 
-// RetrieveOrders retrieves a page of orders given a limit i.e. page size, and a page number
+// RetrieveOrders retrieves a page of the orders selected by a query given a limit i.e. page size,
+// and a page number, along with the total number of selected orders
 // It uses Postgres's LIMIT / OFFSET paging convention.
-func (od *OrderDatabase) RetrieveOrders(limit, page int) ([]ResolvedOrder, error) {
-	count, err := od.countOrders()
+func (od *OrderDatabase) RetrieveOrders(q OrderQuery, limit, page int) ([]ResolvedOrder, int, error) {
+	count, err := od.countOrders(q)
 	if err != nil {
-		return []ResolvedOrder{}, errors.New("failed to count orders")
+		return []ResolvedOrder{}, 0, errors.New("failed to count orders")
 	}
 
 	if count == 0 {
 		// if no orders are in the database, don't count it as a failure
 		// rather just return an empty result set to the client
-		return []ResolvedOrder{}, nil
+		return []ResolvedOrder{}, 0, nil
 	}
 
-	totalPages := int(math.Ceil(float64(count) / float64(limit)))
-	log.Printf("total pages: %d. count %d limit %d", totalPages, count, limit)
-	resolved := make([]ResolvedOrder, 0, count)
+	resolved := make([]ResolvedOrder, 0, limit)
 
 	pageOffset := limit * (page - 1)
 
-	rows, err := od.db.Query(`SELECT id, distance, status FROM orders LIMIT $1 OFFSET $2`,
-		limit, pageOffset)
-	defer rows.Close()
+	var args []interface{}
+	where := orderQueryWhere(q, &args)
+	args = append(args, limit, pageOffset)
+
+	rows, err := od.db.Query(fmt.Sprintf(`SELECT id, distance_m, status, version FROM orders %s
+		%s LIMIT $%d OFFSET $%d`, where, orderBy(q.sort()), len(args)-1, len(args)),
+		args...)
 
 	if err != nil {
-		return resolved, err
+		return resolved, count, err
 	}
+	defer rows.Close()
 
 	// add a ResolvedOrder for each row
 	for rows.Next() {
-		var id, distance int
+		var id, distance, version int
 		var status string
 
-		rows.Scan(&id, &distance, &status)
+		rows.Scan(&id, &distance, &status, &version)
 
 		resolved = append(
 			resolved,
-			ResolvedOrder{Id: id, Distance: distance, Status: status},
+			ResolvedOrder{Id: id, Distance: distance, Status: status, Version: version},
 		)
 	}
 
+	return resolved, count, rows.Err()
+}
+
+// RetrieveOrdersAfter retrieves up to `limit` orders selected by a query positioned after a cursor.
+// Unlike RetrieveOrders, it neither counts the orders nor skips over the previous pages:
+// the row comparison is answered from the (created_at, id) index
+func (od *OrderDatabase) RetrieveOrdersAfter(q OrderQuery, after *OrderCursor, limit int) ([]ResolvedOrder, error) {
+	var args []interface{}
+	where := orderQueryWhere(q, &args)
+
+	if after != nil {
+		if where == "" {
+			where = "WHERE "
+		} else {
+			where += " AND "
+		}
+
+		args = append(args, after.CreatedAt, after.Id)
+		where += fmt.Sprintf("(created_at, id) > ($%d, $%d)", len(args)-1, len(args))
+	}
+
+	args = append(args, limit)
+	rows, err := od.db.Query(fmt.Sprintf(`SELECT id, distance_m, status, created_at, version FROM orders %s
+		%s LIMIT $%d`, where, orderBy(DefaultOrderSort), len(args)),
+		args...)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resolved := []ResolvedOrder{}
+	for rows.Next() {
+		var order ResolvedOrder
+		var createdAt time.Time
+
+		err = rows.Scan(&order.Id, &order.Distance, &order.Status, &createdAt, &order.Version)
+		if err != nil {
+			return nil, err
+		}
+
+		order.CreatedAt = &createdAt
+		resolved = append(resolved, order)
+	}
+
 	return resolved, rows.Err()
 }
+
+// NearbyOrders retrieves up to `limit` UNASSIGN orders whose origin lies within `radius`
+// meters of `position`, nearest first
+//
+// The earth_box condition is answered from the GiST index on the origins of unassigned
+// orders. The box is slightly larger than the circle it bounds, hence the second condition
+func (od *OrderDatabase) NearbyOrders(position maps.LatLng, radius float64, limit int) ([]NearbyOrder, error) {
+	rows, err := od.db.Query(`SELECT id, origin_lat, origin_lng, dest_lat, dest_lng,
+			distance_m, status, created_at, updated_at, version, distance_to_origin,
+			COALESCE(duration_s, 0), COALESCE(duration_in_traffic_s, 0), departure_time, mode, avoid,
+			`+orderPlaceColumns+`
+		FROM (
+			SELECT *, earth_distance(ll_to_earth($1, $2),
+				ll_to_earth(origin_lat::DOUBLE PRECISION, origin_lng::DOUBLE PRECISION)) AS distance_to_origin
+			FROM orders
+			WHERE status = $3 AND earth_box(ll_to_earth($1, $2), $4) @>
+				ll_to_earth(origin_lat::DOUBLE PRECISION, origin_lng::DOUBLE PRECISION)
+		) AS candidates
+		WHERE distance_to_origin <= $4
+		ORDER BY distance_to_origin, id LIMIT $5`,
+		position.Lat, position.Lng, OrderStatusUnassign, radius, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nearby := []NearbyOrder{}
+	for rows.Next() {
+		var originLat, originLng, destLat, destLng string
+		var createdAt, updatedAt time.Time
+		var departureTime pq.NullTime
+		var distanceToOrigin float64
+		var order NearbyOrder
+
+		err = rows.Scan(
+			&order.Id, &originLat, &originLng, &destLat, &destLng,
+			&order.Distance, &order.Status, &createdAt, &updatedAt, &order.Version, &distanceToOrigin,
+			&order.DurationS, &order.DurationInTrafficS, &departureTime, &order.Mode, pq.Array(&order.Avoid),
+			&order.OriginAddress, &order.OriginPlaceId, &order.OriginFormattedAddress,
+			&order.DestinationAddress, &order.DestinationPlaceId, &order.DestinationFormattedAddress,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		order.Origin = LatLng{originLat, originLng}
+		order.Destination = LatLng{destLat, destLng}
+		order.CreatedAt = &createdAt
+		order.UpdatedAt = &updatedAt
+		setDeparture(&order.ResolvedOrder, departureTime)
+		order.DistanceToOrigin = int(math.Round(distanceToOrigin))
+		nearby = append(nearby, order)
+	}
+
+	return nearby, rows.Err()
+}
+
+// webhookColumns are the columns of `webhook_subscriptions` scanned by scanWebhook
+const webhookColumns = `id, url, secret, event_types, active, created_at, updated_at`
+
+// scanWebhook scans a row of webhookColumns
+func scanWebhook(row interface {
+	Scan(dest ...interface{}) error
+}) (sub WebhookSubscription, err error) {
+	var createdAt, updatedAt time.Time
+
+	err = row.Scan(&sub.Id, &sub.URL, &sub.Secret, pq.Array(&sub.EventTypes),
+		&sub.Active, &createdAt, &updatedAt)
+	if err != nil {
+		return
+	}
+
+	if sub.EventTypes == nil {
+		sub.EventTypes = []string{}
+	}
+	sub.CreatedAt = &createdAt
+	sub.UpdatedAt = &updatedAt
+	return
+}
+
+// eventTypesArray converts the event types of a subscription to a Postgres array.
+// A nil slice would be written as NULL rather than as an empty array
+func eventTypesArray(sub WebhookSubscription) pq.StringArray {
+	if sub.EventTypes == nil {
+		return pq.StringArray{}
+	}
+
+	return pq.StringArray(sub.EventTypes)
+}
+
+// InsertWebhook inserts a webhook subscription into the database
+func (od *OrderDatabase) InsertWebhook(sub WebhookSubscription) (WebhookSubscription, error) {
+	return scanWebhook(od.db.QueryRow(`INSERT INTO webhook_subscriptions(url, secret, event_types, active)
+		VALUES($1, $2, $3, $4) RETURNING `+webhookColumns,
+		sub.URL, sub.Secret, eventTypesArray(sub), sub.Active,
+	))
+}
+
+// SelectWebhook selects a webhook subscription from the database by id
+func (od *OrderDatabase) SelectWebhook(id int) (WebhookSubscription, error) {
+	return scanWebhook(od.db.QueryRow(`SELECT `+webhookColumns+`
+		FROM webhook_subscriptions WHERE id = $1`, id))
+}
+
+// ListWebhooks selects every webhook subscription, oldest first
+func (od *OrderDatabase) ListWebhooks() ([]WebhookSubscription, error) {
+	rows, err := od.db.Query(`SELECT ` + webhookColumns + ` FROM webhook_subscriptions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		sub, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return subs, rows.Err()
+}
+
+// UpdateWebhook replaces the url, secret, event types and active flag of a subscription
+func (od *OrderDatabase) UpdateWebhook(sub WebhookSubscription) (WebhookSubscription, error) {
+	return scanWebhook(od.db.QueryRow(`UPDATE webhook_subscriptions
+		SET url = $1, secret = $2, event_types = $3, active = $4, updated_at = NOW()
+		WHERE id = $5 RETURNING `+webhookColumns,
+		sub.URL, sub.Secret, eventTypesArray(sub), sub.Active, sub.Id,
+	))
+}
+
+// DeleteWebhook deletes a subscription, its deliveries and dead letters are deleted in cascade
+func (od *OrderDatabase) DeleteWebhook(id int) error {
+	var deleted int
+	return od.db.QueryRow(`DELETE FROM webhook_subscriptions WHERE id = $1 RETURNING id`, id).Scan(&deleted)
+}
+
+// ClaimDeliveries claims up to `limit` due deliveries of active subscriptions
+//
+// Deliveries locked by a concurrent claim are skipped rather than waited for, and claimed
+// deliveries are pushed `lease` into the future, so no two workers attempt a delivery at once
+func (od *OrderDatabase) ClaimDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	rows, err := od.db.Query(`WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET attempts = attempts + 1, next_attempt_at = NOW() + $2::DOUBLE PRECISION * INTERVAL '1 millisecond'
+			WHERE id IN (
+				SELECT d.id FROM webhook_deliveries d
+				JOIN webhook_subscriptions s ON s.id = d.subscription_id
+				WHERE s.active AND d.next_attempt_at <= NOW()
+				ORDER BY d.id LIMIT $1
+				FOR UPDATE OF d SKIP LOCKED
+			)
+			RETURNING id, subscription_id, event_id, attempts
+		)
+		SELECT c.id, c.attempts, s.id, s.url, s.secret,
+			e.id, e.order_id, e.from_status, e.to_status, e.actor, e.request_id, e.reason, e.note, e.created_at
+		FROM claimed c
+		JOIN webhook_subscriptions s ON s.id = c.subscription_id
+		JOIN order_events e ON e.id = c.event_id
+		ORDER BY c.id`,
+		limit, int64(lease/time.Millisecond),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		e := &d.Event
+
+		err = rows.Scan(&d.Id, &d.Attempts, &d.Subscription.Id, &d.Subscription.URL, &d.Subscription.Secret,
+			&e.Id, &e.OrderId, &e.From, &e.To, &e.Actor, &e.RequestId, &e.Reason, &e.Note, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Type = orderEventType(e.From, e.To)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// CompleteDelivery deletes a successful delivery from the outbox
+func (od *OrderDatabase) CompleteDelivery(id int) error {
+	_, err := od.db.Exec(`DELETE FROM webhook_deliveries WHERE id = $1`, id)
+	return err
+}
+
+// RetryDelivery records the failure of a delivery and schedules its next attempt
+func (od *OrderDatabase) RetryDelivery(id int, lastError string, at time.Time) error {
+	_, err := od.db.Exec(`UPDATE webhook_deliveries SET last_error = $1, next_attempt_at = $2
+		WHERE id = $3`, lastError, at, id)
+	return err
+}
+
+// DeadLetterDelivery moves a delivery from the outbox into `webhook_dead_letters`
+func (od *OrderDatabase) DeadLetterDelivery(id int, lastError string) error {
+	_, err := od.db.Exec(`WITH failed AS (
+			DELETE FROM webhook_deliveries WHERE id = $1
+			RETURNING subscription_id, event_id, attempts
+		)
+		INSERT INTO webhook_dead_letters(subscription_id, event_id, attempts, last_error)
+		SELECT subscription_id, event_id, attempts, $2 FROM failed`, id, lastError)
+	return err
+}
+
+// DeadLetters selects the dead letters of a subscription, oldest first
+func (od *OrderDatabase) DeadLetters(subscriptionId int) ([]WebhookDeadLetter, error) {
+	if _, err := od.SelectWebhook(subscriptionId); err != nil {
+		return nil, err
+	}
+
+	rows, err := od.db.Query(`SELECT l.id, l.subscription_id, l.attempts, l.last_error, l.failed_at,
+			e.id, e.order_id, e.from_status, e.to_status, e.actor, e.request_id, e.reason, e.note, e.created_at
+		FROM webhook_dead_letters l
+		JOIN order_events e ON e.id = l.event_id
+		WHERE l.subscription_id = $1 ORDER BY l.id`, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []WebhookDeadLetter{}
+	for rows.Next() {
+		var l WebhookDeadLetter
+		e := &l.Event
+
+		err = rows.Scan(&l.Id, &l.SubscriptionId, &l.Attempts, &l.LastError, &l.FailedAt,
+			&e.Id, &e.OrderId, &e.From, &e.To, &e.Actor, &e.RequestId, &e.Reason, &e.Note, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Type = orderEventType(e.From, e.To)
+		letters = append(letters, l)
+	}
+
+	return letters, rows.Err()
+}
+
+// ReplayDeadLetters moves dead letters of a subscription back into the outbox
+func (od *OrderDatabase) ReplayDeadLetters(subscriptionId int, ids []int) (int, error) {
+	if _, err := od.SelectWebhook(subscriptionId); err != nil {
+		return 0, err
+	}
+
+	// an empty array, rather than NULL, selects every dead letter
+	selected := pq.Int64Array{}
+	for _, id := range ids {
+		selected = append(selected, int64(id))
+	}
+
+	res, err := od.db.Exec(`WITH replayed AS (
+			DELETE FROM webhook_dead_letters
+			WHERE subscription_id = $1 AND (cardinality($2::INTEGER[]) = 0 OR id = ANY($2))
+			RETURNING subscription_id, event_id
+		)
+		INSERT INTO webhook_deliveries(subscription_id, event_id)
+		SELECT subscription_id, event_id FROM replayed`,
+		subscriptionId, selected,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed, err := res.RowsAffected()
+	return int(replayed), err
+}
+
+// scanCourier reads a row selecting the columns of `couriers`
+func scanCourier(row interface {
+	Scan(dest ...interface{}) error
+}) (c Courier, err error) {
+	var createdAt time.Time
+	var deactivatedAt pq.NullTime
+
+	err = row.Scan(&c.Id, &c.Name, &c.Active, &createdAt, &deactivatedAt, &c.Capacity, &c.TokenHash)
+	if err != nil {
+		return
+	}
+
+	c.CreatedAt = &createdAt
+	if deactivatedAt.Valid {
+		c.DeactivatedAt = &deactivatedAt.Time
+	}
+
+	return
+}
+
+// courierColumns are the columns read by scanCourier
+const courierColumns = `id, name, active, created_at, deactivated_at, COALESCE(capacity, 0),
+	COALESCE(token_hash, '')`
+
+// InsertCourier inserts a new active courier into the database
+func (od *OrderDatabase) InsertCourier(c Courier) (Courier, error) {
+	// a zero capacity is stored as NULL, applying the default capacity
+	capacity := sql.NullInt64{Int64: int64(c.Capacity), Valid: c.Capacity > 0}
+
+	tokenHash := sql.NullString{String: c.TokenHash, Valid: c.TokenHash != ""}
+
+	return scanCourier(od.db.QueryRow(`INSERT INTO couriers(name, capacity, token_hash)
+		VALUES($1, $2, $3) RETURNING `+courierColumns, c.Name, capacity, tokenHash))
+}
+
+// SelectCourier selects a courier from the database by id
+func (od *OrderDatabase) SelectCourier(id int) (Courier, error) {
+	return scanCourier(od.db.QueryRow(`SELECT `+courierColumns+` FROM couriers WHERE id = $1`, id))
+}
+
+// ListCouriers lists every courier, oldest first
+func (od *OrderDatabase) ListCouriers() ([]Courier, error) {
+	rows, err := od.db.Query(`SELECT ` + courierColumns + ` FROM couriers ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	couriers := []Courier{}
+	for rows.Next() {
+		c, err := scanCourier(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		couriers = append(couriers, c)
+	}
+
+	return couriers, rows.Err()
+}
+
+// DeactivateCourier deactivates a courier, keeping the time of its first deactivation
+func (od *OrderDatabase) DeactivateCourier(id int) (Courier, error) {
+	return scanCourier(od.db.QueryRow(`UPDATE couriers
+		SET active = FALSE, deactivated_at = COALESCE(deactivated_at, NOW())
+		WHERE id = $1 RETURNING `+courierColumns, id))
+}
+
+// SetCourierTokenHash replaces the token of a courier
+func (od *OrderDatabase) SetCourierTokenHash(id int, tokenHash string) (Courier, error) {
+	return scanCourier(od.db.QueryRow(`UPDATE couriers SET token_hash = $2
+		WHERE id = $1 RETURNING `+courierColumns, id, tokenHash))
+}
+
+// ReserveIdempotencyKey reserves a key unless it is reserved or has an unexpired stored response.
+// An expired key is taken over by the new request
+func (od *OrderDatabase) ReserveIdempotencyKey(
+	key, requestHash string, lease time.Duration) (record IdempotencyRecord, reserved bool, err error) {
+
+	var reservedKey string
+	err = od.db.QueryRow(`INSERT INTO idempotency_keys(key, request_hash, expires_at)
+		VALUES($1, $2, NOW() + $3::DOUBLE PRECISION * INTERVAL '1 millisecond')
+		ON CONFLICT (key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = 0, body = NULL,
+			created_at = NOW(), expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= NOW()
+		RETURNING key`,
+		key, requestHash, int64(lease/time.Millisecond),
+	).Scan(&reservedKey)
+
+	if err == nil {
+		return IdempotencyRecord{}, true, nil
+	}
+
+	if err != sql.ErrNoRows {
+		return record, false, err
+	}
+
+	// the key is held by another request, or has a stored response
+	record.Key = key
+	err = od.db.QueryRow(`SELECT request_hash, status, COALESCE(body, '') FROM idempotency_keys
+		WHERE key = $1`, key,
+	).Scan(&record.RequestHash, &record.Status, &record.Body)
+
+	return record, false, err
+}
+
+// SaveIdempotentResponse stores the response to the request holding a key
+func (od *OrderDatabase) SaveIdempotentResponse(key string, status int, body []byte, ttl time.Duration) error {
+	var saved string
+	return od.db.QueryRow(`UPDATE idempotency_keys
+		SET status = $2, body = $3, expires_at = NOW() + $4::DOUBLE PRECISION * INTERVAL '1 millisecond'
+		WHERE key = $1 RETURNING key`,
+		key, status, body, int64(ttl/time.Millisecond),
+	).Scan(&saved)
+}
+
+// ReleaseIdempotencyKey deletes a key whose response is not stored
+func (od *OrderDatabase) ReleaseIdempotencyKey(key string) error {
+	_, err := od.db.Exec(`DELETE FROM idempotency_keys WHERE key = $1 AND status = 0`, key)
+	return err
+}
+
+// SelectCachedDistance returns the route cached under a key unless it expired
+func (od *OrderDatabase) SelectCachedDistance(
+	key string) (route Route, ttl time.Duration, found bool, err error) {
+
+	var seconds float64
+	var durationS, durationInTrafficS int64
+	err = od.db.QueryRow(`SELECT meters, human_readable, duration_s, duration_in_traffic_s,
+			EXTRACT(EPOCH FROM expires_at - NOW())
+		FROM distance_cache WHERE key = $1 AND expires_at > NOW()`, key,
+	).Scan(&route.Distance.Meters, &route.Distance.HumanReadable, &durationS, &durationInTrafficS, &seconds)
+
+	if err == sql.ErrNoRows {
+		return route, 0, false, nil
+	}
+
+	if err != nil {
+		return route, 0, false, err
+	}
+
+	route.Duration = time.Duration(durationS) * time.Second
+	route.DurationInTraffic = time.Duration(durationInTrafficS) * time.Second
+	return route, time.Duration(seconds * float64(time.Second)), true, nil
+}
+
+// SaveCachedDistance caches a route under a key, replacing any cached one
+func (od *OrderDatabase) SaveCachedDistance(key string, route Route, ttl time.Duration) error {
+	_, err := od.db.Exec(`INSERT INTO distance_cache(
+			key, meters, human_readable, duration_s, duration_in_traffic_s, expires_at)
+		VALUES($1, $2, $3, $4, $5, NOW() + $6::DOUBLE PRECISION * INTERVAL '1 millisecond')
+		ON CONFLICT (key) DO UPDATE
+		SET meters = EXCLUDED.meters, human_readable = EXCLUDED.human_readable,
+			duration_s = EXCLUDED.duration_s, duration_in_traffic_s = EXCLUDED.duration_in_traffic_s,
+			expires_at = EXCLUDED.expires_at`,
+		key, route.Distance.Meters, route.Distance.HumanReadable,
+		int64(route.Duration/time.Second), int64(route.DurationInTraffic/time.Second),
+		int64(ttl/time.Millisecond),
+	)
+
+	return err
+}
+
+// PurgeCachedDistances deletes every cached distance
+func (od *OrderDatabase) PurgeCachedDistances() (int, error) {
+	res, err := od.db.Exec(`DELETE FROM distance_cache`)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := res.RowsAffected()
+	return int(purged), err
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+const (
+	DistanceProviderGoogle      = "google"
+	DistanceProviderGreatCircle = "greatcircle"
+
+	// DefaultRoadFactor is the ratio of road distance to great-circle distance
+	// assumed when estimating a route without a routing service
+	DefaultRoadFactor = 1.4
+
+	// DefaultDistanceTimeout bounds a Google Maps lookup, retries included, by default
+	DefaultDistanceTimeout = 5 * time.Second
+
+	// DefaultDistanceMaxRetries is the number of times a failed Google Maps lookup is retried by default
+	DefaultDistanceMaxRetries = 2
+
+	// DefaultDistanceRetryBackoff is the delay before the first retry by default
+	DefaultDistanceRetryBackoff = 100 * time.Millisecond
+
+	// mean radius of the earth in meters
+	earthRadiusMeters = 6371008.8
+)
+
+// RouteRequest describes a route to look up
+type RouteRequest struct {
+	// Origin and Destination are lat,lng strings such as "40.7484,-73.9857"
+	Origin, Destination string
+
+	// DepartureTime is when the trip starts, the zero time departs now
+	DepartureTime time.Time
+
+	// Mode is one of travelModes, driving if empty. Avoid lists the route features to avoid
+	Mode  string
+	Avoid []string
+}
+
+// travelMode returns how the route is travelled
+func (req RouteRequest) travelMode() travelMode {
+	if tm, ok := travelModes[req.Mode]; ok {
+		return tm
+	}
+
+	return travelModes[TravelModeDriving]
+}
+
+// Route is the distance and travel time of a route
+type Route struct {
+	Distance maps.Distance
+
+	// Duration is the travel time in usual conditions, DurationInTraffic the travel time in the
+	// traffic expected at the departure time. Either is 0 if unknown
+	Duration          time.Duration
+	DurationInTraffic time.Duration
+}
+
+// DistanceProvider looks up the route between two points.
+// Lookups give up once `ctx` is done
+type DistanceProvider interface {
+	Route(ctx context.Context, req RouteRequest) (Route, error)
+}
+
+// NewDistanceProvider creates the DistanceProvider selected by the configuration.
+// The Google provider falls back to a great-circle estimate scaled by the road factor
+// when the Distance Matrix API is unavailable, unless the fallback is disabled. Distances
+// computed by Google Maps are cached in `cache` unless it is nil, estimates are not
+func NewDistanceProvider(cfg DistanceConfig, client *maps.Client, cache *DistanceCache) (DistanceProvider, error) {
+	if cfg.RoadFactor < 1 {
+		return nil, fmt.Errorf("road factor must be at least 1, got %v", cfg.RoadFactor)
+	}
+
+	estimate := &GreatCircleDistanceProvider{RoadFactor: cfg.RoadFactor}
+
+	switch cfg.Provider {
+	case DistanceProviderGoogle, "":
+		google := &GoogleDistanceProvider{
+			Client:       client,
+			Timeout:      cfg.Timeout.Duration,
+			MaxRetries:   cfg.MaxRetries,
+			RetryBackoff: cfg.RetryBackoff.Duration,
+		}
+
+		if cfg.Breaker.Threshold > 0 {
+			google.Breaker = NewCircuitBreaker(cfg.Breaker.Threshold, cfg.Breaker.Cooldown.Duration)
+		}
+
+		var primary DistanceProvider = google
+
+		if cache != nil {
+			primary = &CachedDistanceProvider{Provider: primary, Cache: cache}
+		}
+
+		if !cfg.Fallback {
+			return primary, nil
+		}
+
+		return &FallbackDistanceProvider{Primary: primary, Fallback: estimate}, nil
+	case DistanceProviderGreatCircle:
+		return estimate, nil
+	default:
+		return nil, fmt.Errorf("unknown distance provider: %s", cfg.Provider)
+	}
+}
+
+// GoogleDistanceProvider uses the Google Maps Distance Matrix API to compute
+// a driving distance
+type GoogleDistanceProvider struct {
+	Client *maps.Client
+
+	// Timeout bounds a lookup, retries included, 0 leaves it to the caller's context
+	Timeout time.Duration
+
+	// MaxRetries is the number of times a lookup failing with a retryable error is retried,
+	// after a jittered delay starting at RetryBackoff and doubling with every retry
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// Breaker stops lookups while the Distance Matrix API keeps failing, nil never stops them
+	Breaker *CircuitBreaker
+}
+
+// isRetryableMapsError returns if a failed Google Maps request may succeed if retried:
+// network errors, malformed responses such as error pages, and the statuses reporting
+// a transient failure
+func isRetryableMapsError(err error) bool {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "maps: ") {
+		return true
+	}
+
+	return strings.HasPrefix(msg, "maps: OVER_QUERY_LIMIT") || strings.HasPrefix(msg, "maps: UNKNOWN_ERROR")
+}
+
+// retryDelay returns the delay before retry number `retry`, counting from 0: a random
+// duration between half and all of `backoff` doubled for every previous retry, so that
+// clients failing together do not retry together
+func retryDelay(retry int, backoff time.Duration) time.Duration {
+	d := backoff << uint(retry)
+	if d <= 1 {
+		return d
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// retryMaps makes a Google Maps request with `call`, retrying it while it fails with a
+// retryable error until `maxRetries` or the deadline of `ctx`. `lookup` names the request in logs
+func retryMaps(ctx context.Context, lookup string, maxRetries int, backoff time.Duration, call func() error) error {
+	for retry := 0; ; retry++ {
+		err := call()
+		if err == nil || retry >= maxRetries || ctx.Err() != nil || !isRetryableMapsError(err) {
+			return err
+		}
+
+		log.Printf("%s lookup failed, retrying: %s", lookup, err)
+
+		select {
+		case <-time.After(retryDelay(retry, backoff)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// distanceMatrix sends a Distance Matrix request, retrying it while it fails with a retryable
+// error until MaxRetries or the deadline of `ctx`
+func (gp *GoogleDistanceProvider) distanceMatrix(
+	ctx context.Context, r *maps.DistanceMatrixRequest) (resp *maps.DistanceMatrixResponse, err error) {
+
+	err = retryMaps(ctx, "distance", gp.MaxRetries, gp.RetryBackoff, func() (err error) {
+		resp, err = gp.Client.DistanceMatrix(ctx, r)
+		return
+	})
+
+	return
+}
+
+// Route returns the shortest route reported by the Distance Matrix API
+func (gp *GoogleDistanceProvider) Route(ctx context.Context, req RouteRequest) (Route, error) {
+	tm := req.travelMode()
+	avoid := normalizeAvoid(append(append([]string{}, tm.avoid...), req.Avoid...))
+
+	r := &maps.DistanceMatrixRequest{
+		Origins:       []string{req.Origin},
+		Destinations:  []string{req.Destination},
+		DepartureTime: `now`,
+		Units:         `UnitsMetric`,
+		Mode:          tm.matrixMode,
+		Avoid:         maps.Avoid(strings.Join(avoid, "|")),
+	}
+
+	if !req.DepartureTime.IsZero() {
+		r.DepartureTime = strconv.FormatInt(req.DepartureTime.Unix(), 10)
+	}
+
+	// degenerate value for distance. should be overwritten by the API response
+	shortest := Route{Distance: maps.Distance{
+		HumanReadable: "",
+		Meters:        math.MaxInt64,
+	}}
+
+	if gp.Breaker != nil {
+		if err := gp.Breaker.Allow(); err != nil {
+			return shortest, err
+		}
+	}
+
+	lookupCtx := ctx
+	if gp.Timeout > 0 {
+		var cancel context.CancelFunc
+		lookupCtx, cancel = context.WithTimeout(ctx, gp.Timeout)
+		defer cancel()
+	}
+
+	distance, err := gp.distanceMatrix(lookupCtx, r)
+	if gp.Breaker != nil {
+		switch {
+		case err == nil:
+			gp.Breaker.Success()
+		case ctx.Err() == nil:
+			// lookups abandoned by the caller tell nothing about Google Maps
+			gp.Breaker.Failure()
+		}
+	}
+
+	if err != nil {
+		log.Printf("failed to retrieve distance: %s", err)
+		return shortest, err
+	}
+
+	if len(distance.Rows) == 0 {
+		log.Printf("failed to retrieve distance: %s", err)
+		return shortest, errors.New("No routes found by Google Maps")
+	}
+
+	for _, row := range distance.Rows {
+		for _, elem := range row.Elements {
+			if elem.Distance.Meters < shortest.Distance.Meters {
+				shortest = Route{
+					Distance:          elem.Distance,
+					Duration:          elem.Duration,
+					DurationInTraffic: elem.DurationInTraffic,
+				}
+			}
+		}
+	}
+
+	return shortest, err
+}
+
+// GreatCircleDistanceProvider estimates route distance without any network access.
+// It computes the haversine distance between two points and scales it by RoadFactor
+// to account for roads not running in a straight line
+type GreatCircleDistanceProvider struct {
+	RoadFactor float64
+}
+
+// Route returns the estimated route, its travel time assumes a constant speed for the travel
+// mode and no traffic. Avoided features are ignored
+func (gc *GreatCircleDistanceProvider) Route(ctx context.Context, req RouteRequest) (Route, error) {
+	from, err := parseLatLng(req.Origin)
+	if err != nil {
+		return Route{}, err
+	}
+
+	to, err := parseLatLng(req.Destination)
+	if err != nil {
+		return Route{}, err
+	}
+
+	meters := int(math.Round(haversine(from, to) * gc.RoadFactor))
+	return Route{
+		Distance: maps.Distance{
+			HumanReadable: strconv.FormatFloat(float64(meters)/1000, 'f', 1, 64) + " km",
+			Meters:        meters,
+		},
+		Duration: time.Duration(float64(meters) / req.travelMode().speed * float64(time.Second)).Round(time.Second),
+	}, nil
+}
+
+// parseLatLng parses a lat,lng string such as "40.7484,-73.9857"
+func parseLatLng(s string) (maps.LatLng, error) {
+	l := LatLng(strings.Split(s, ","))
+	if !l.IsValid() {
+		return maps.LatLng{}, fmt.Errorf("invalid lat,lng: %s", s)
+	}
+
+	// IsValid guarantees that both parts are numeric
+	lat, _ := strconv.ParseFloat(l[0], 64)
+	lng, _ := strconv.ParseFloat(l[1], 64)
+	return maps.LatLng{Lat: lat, Lng: lng}, nil
+}
+
+// haversine returns the great-circle distance in meters between two points
+func haversine(from, to maps.LatLng) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	lat1, lat2 := toRadians(from.Lat), toRadians(to.Lat)
+	dLat := lat2 - lat1
+	dLng := toRadians(to.Lng - from.Lng)
+
+	h := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLng/2), 2)
+
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// FallbackDistanceProvider asks Primary for a distance and falls back to
+// Fallback if Primary fails, e.g. when Google Maps is unreachable.
+// A *CircuitOpenError is not a failure of Primary but a refusal to try it, so it is
+// returned to the caller, who is told when to retry
+type FallbackDistanceProvider struct {
+	Primary  DistanceProvider
+	Fallback DistanceProvider
+}
+
+// Route returns the route looked up by Primary, or by Fallback if Primary fails
+func (fp *FallbackDistanceProvider) Route(ctx context.Context, req RouteRequest) (Route, error) {
+	route, err := fp.Primary.Route(ctx, req)
+	if err == nil {
+		return route, nil
+	}
+
+	if _, ok := err.(*CircuitOpenError); ok {
+		return Route{}, err
+	}
+
+	log.Printf("primary distance provider failed, using estimate: %s", err)
+	return fp.Fallback.Route(ctx, req)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"googlemaps.github.io/maps"
+)
+
+// failingDistanceProvider simulates an unreachable routing service
+type failingDistanceProvider struct{}
+
+func (failingDistanceProvider) Route(ctx context.Context, req RouteRequest) (Route, error) {
+	return Route{}, errors.New("upstream unavailable")
+}
+
+// between requests the route from `origin` to `destination`, leaving now
+func between(origin, destination string) RouteRequest {
+	return RouteRequest{Origin: origin, Destination: destination}
+}
+
+func TestGreatCircleDistance(t *testing.T) {
+	assert := assert.New(t)
+
+	straight := &GreatCircleDistanceProvider{RoadFactor: 1}
+
+	// one degree of latitude is roughly 111.2km everywhere
+	d, err := straight.Route(context.Background(), between("0,0", "1,0"))
+	assert.Nil(err)
+	assert.InDelta(111195, d.Distance.Meters, 10)
+
+	d, err = straight.Route(context.Background(), between(OriginLatLng.String(), OriginLatLng.String()))
+	assert.Nil(err)
+	assert.Equal(0, d.Distance.Meters)
+
+	// the road factor scales the straight line distance
+	scaled := &GreatCircleDistanceProvider{RoadFactor: 2}
+	ds, _ := scaled.Route(context.Background(), between("0,0", "1,0"))
+	d, _ = straight.Route(context.Background(), between("0,0", "1,0"))
+	assert.InDelta(2*d.Distance.Meters, ds.Distance.Meters, 1)
+
+	// the travel time assumes city traffic, without knowing the actual one
+	assert.InDelta(3*time.Hour+42*time.Minute, d.Duration, float64(time.Minute))
+	assert.Equal(time.Duration(0), d.DurationInTraffic)
+
+	// walking is slower than driving
+	req := between("0,0", "1,0")
+	req.Mode = TravelModeWalking
+	walk, _ := straight.Route(context.Background(), req)
+	assert.Equal(d.Distance, walk.Distance)
+	assert.InDelta(6*d.Duration, walk.Duration, float64(5*time.Second))
+
+	for _, bad := range []string{"", "12.9734", "bogus,77.5910", "112.9734,77.5910"} {
+		_, err = straight.Route(context.Background(), between(bad, DestLatLng.String()))
+		assert.NotNil(err)
+	}
+}
+
+func TestFallbackDistance(t *testing.T) {
+	assert := assert.New(t)
+
+	estimate := &GreatCircleDistanceProvider{RoadFactor: DefaultRoadFactor}
+	fp := &FallbackDistanceProvider{Primary: failingDistanceProvider{}, Fallback: estimate}
+
+	d, err := fp.Route(context.Background(), between(OriginLatLng.String(), DestLatLng.String()))
+	assert.Nil(err)
+
+	expected, _ := estimate.Route(context.Background(), between(OriginLatLng.String(), DestLatLng.String()))
+	assert.Equal(expected, d)
+
+	// an open circuit breaker is reported rather than estimated around
+	fp.Primary = openDistanceProvider{}
+	_, err = fp.Route(context.Background(), between(OriginLatLng.String(), DestLatLng.String()))
+	assert.IsType(&CircuitOpenError{}, err)
+}
+
+func TestNewDistanceProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := DefaultConfig().Distance
+	cfg.Provider = DistanceProviderGreatCircle
+	dp, err := NewDistanceProvider(cfg, nil, nil)
+	assert.Nil(err)
+	assert.IsType(&GreatCircleDistanceProvider{}, dp)
+
+	cfg.Provider = DistanceProviderGoogle
+	dp, err = NewDistanceProvider(cfg, nil, nil)
+	assert.Nil(err)
+	assert.IsType(&FallbackDistanceProvider{}, dp)
+
+	// without the fallback, failures of Google Maps reach the caller
+	cfg.Fallback = false
+	dp, err = NewDistanceProvider(cfg, nil, nil)
+	assert.Nil(err)
+	assert.IsType(&GoogleDistanceProvider{}, dp)
+
+	cfg.Provider = "bogus"
+	_, err = NewDistanceProvider(cfg, nil, nil)
+	assert.NotNil(err)
+
+	cfg.Provider = DistanceProviderGreatCircle
+	cfg.RoadFactor = 0.5
+	_, err = NewDistanceProvider(cfg, nil, nil)
+	assert.NotNil(err)
+}
+
+// distanceMatrixServer answers Distance Matrix requests with the statuses in `statuses`,
+// one per request, then with OK
+type distanceMatrixServer struct {
+	mu       sync.Mutex
+	statuses []string
+	delay    time.Duration
+	requests int
+
+	// query is the query string of the last request
+	query url.Values
+}
+
+func (ds *distanceMatrixServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ds.mu.Lock()
+	status := "OK"
+	if ds.requests < len(ds.statuses) {
+		status = ds.statuses[ds.requests]
+	}
+	ds.requests++
+	ds.query = r.URL.Query()
+	delay := ds.delay
+	ds.mu.Unlock()
+
+	time.Sleep(delay)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status": %q, "rows": [{"elements": [
+		{"status": "OK", "distance": {"text": "1.5 km", "value": 1500}, "duration": {"text": "5 mins", "value": 300},
+			"duration_in_traffic": {"text": "7 mins", "value": 420}},
+		{"status": "OK", "distance": {"text": "2.1 km", "value": 2100}, "duration": {"text": "4 mins", "value": 240}}
+	]}]}`, status)
+}
+
+// reset answers the next requests with `statuses`, after `delay`
+func (ds *distanceMatrixServer) reset(statuses []string, delay time.Duration) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.statuses, ds.delay, ds.requests = statuses, delay, 0
+}
+
+// received returns the number of requests received since the last reset
+func (ds *distanceMatrixServer) received() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return ds.requests
+}
+
+// lastQuery returns the query string of the last request received
+func (ds *distanceMatrixServer) lastQuery() url.Values {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return ds.query
+}
+
+func newTestGoogleDistanceProvider(t *testing.T, ds *distanceMatrixServer) (*GoogleDistanceProvider, func()) {
+	srv := httptest.NewServer(ds)
+	client, err := maps.NewClient(maps.WithAPIKey("key"), maps.WithBaseURL(srv.URL))
+	assert.Nil(t, err)
+
+	return &GoogleDistanceProvider{
+		Client:       client,
+		Timeout:      time.Second,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+		Breaker:      NewCircuitBreaker(2, time.Minute),
+	}, srv.Close
+}
+
+func TestGoogleDistanceRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	// transient failures are retried
+	ds := &distanceMatrixServer{statuses: []string{"UNKNOWN_ERROR", "OVER_QUERY_LIMIT"}}
+	gp, closeServer := newTestGoogleDistanceProvider(t, ds)
+	defer closeServer()
+
+	d, err := gp.Route(context.Background(), between("0,0", "1,1"))
+	assert.Nil(err)
+	assert.Equal(1500, d.Distance.Meters)
+	assert.Equal(3, ds.received())
+
+	// up to MaxRetries times
+	ds.reset([]string{"UNKNOWN_ERROR", "UNKNOWN_ERROR", "UNKNOWN_ERROR"}, 0)
+	_, err = gp.Route(context.Background(), between("0,0", "1,1"))
+	assert.NotNil(err)
+	assert.Equal(3, ds.received())
+
+	// other failures are not
+	ds.reset([]string{"REQUEST_DENIED"}, 0)
+	_, err = gp.Route(context.Background(), between("0,0", "1,1"))
+	assert.NotNil(err)
+	assert.Equal(1, ds.received())
+
+	// after two failed lookups in a row, the breaker is open
+	ds.reset(nil, 0)
+	_, err = gp.Route(context.Background(), between("0,0", "1,1"))
+	if assert.IsType(&CircuitOpenError{}, err) {
+		assert.InDelta(time.Minute, err.(*CircuitOpenError).RetryAfter, float64(time.Second))
+	}
+	assert.Equal(0, ds.received())
+}
+
+func TestGoogleRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	ds := &distanceMatrixServer{}
+	gp, closeServer := newTestGoogleDistanceProvider(t, ds)
+	defer closeServer()
+
+	// the shortest route is kept along with its travel times
+	route, err := gp.Route(context.Background(), between("0,0", "1,1"))
+	assert.Nil(err)
+	assert.Equal(Route{
+		Distance:          maps.Distance{HumanReadable: "1.5 km", Meters: 1500},
+		Duration:          5 * time.Minute,
+		DurationInTraffic: 7 * time.Minute,
+	}, route)
+	assert.Equal("now", ds.lastQuery().Get("departure_time"))
+
+	departure := time.Now().Add(time.Hour)
+	req := between("0,0", "1,1")
+	req.DepartureTime = departure
+	_, err = gp.Route(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(strconv.FormatInt(departure.Unix(), 10), ds.lastQuery().Get("departure_time"))
+	assert.Equal("driving", ds.lastQuery().Get("mode"))
+	assert.Equal("", ds.lastQuery().Get("avoid"))
+
+	// the travel mode and avoided features are passed on
+	req = between("0,0", "1,1")
+	req.Mode = TravelModeBicycling
+	req.Avoid = []string{AvoidFerries}
+	_, err = gp.Route(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal("bicycling", ds.lastQuery().Get("mode"))
+	assert.Equal("ferries", ds.lastQuery().Get("avoid"))
+
+	// two-wheelers are routed as cars kept off highways
+	req.Mode = TravelModeTwoWheeler
+	req.Avoid = []string{AvoidTolls}
+	_, err = gp.Route(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal("driving", ds.lastQuery().Get("mode"))
+	assert.Equal("highways|tolls", ds.lastQuery().Get("avoid"))
+}
+
+func TestGoogleDistanceTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	ds := &distanceMatrixServer{delay: 50 * time.Millisecond}
+	gp, closeServer := newTestGoogleDistanceProvider(t, ds)
+	defer closeServer()
+	gp.Timeout = 10 * time.Millisecond
+
+	start := time.Now()
+	_, err := gp.Route(context.Background(), between("0,0", "1,1"))
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 50*time.Millisecond)
+
+	// a lookup abandoned by its caller does not count against Google Maps
+	gp.Timeout = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = gp.Route(ctx, between("0,0", "1,1"))
+	assert.NotNil(err)
+
+	ds.reset(nil, 0)
+	_, err = gp.Route(context.Background(), between("0,0", "1,1"))
+	assert.Nil(err)
+}
+
+// openDistanceProvider simulates a provider whose circuit breaker is open
+type openDistanceProvider struct{}
+
+func (openDistanceProvider) Route(ctx context.Context, req RouteRequest) (Route, error) {
+	return Route{}, &CircuitOpenError{RetryAfter: 1500 * time.Millisecond}
+}
+
+func TestCreateOrderCircuitOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(dp DistanceProvider) { defaultDistanceProvider = dp }(defaultDistanceProvider)
+	defaultDistanceProvider = openDistanceProvider{}
+
+	srv := httptest.NewServer(Router())
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL+"/order", "application/json", strings.NewReader(
+		`{"origin": ["12.9734", "77.5910"], "destination": ["12.9527", "77.5848"]}`,
+	))
+	assert.Nil(err)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal("2", resp.Header.Get("Retry-After"))
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal("{\"error\":\"DISTANCE_PROVIDER_UNAVAILABLE\"}\n", string(respBody))
+}
+
+func TestCreateOrderCircuitOpenDefaultConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	defer restoreConnectors()()
+
+	// the default configuration falls back to estimates, and breaks the circuit
+	cfg := DefaultConfig()
+	cfg.Store = OrderStoreMemory
+	cfg.Distance.GoogleMapsAPIKey = "key"
+	if !assert.Nil(setup(cfg)) {
+		return
+	}
+
+	fp, ok := defaultDistanceProvider.(*FallbackDistanceProvider)
+	if !assert.True(ok) {
+		return
+	}
+
+	cached, ok := fp.Primary.(*CachedDistanceProvider)
+	if !assert.True(ok) {
+		return
+	}
+
+	google, ok := cached.Provider.(*GoogleDistanceProvider)
+	if !assert.True(ok) || !assert.NotNil(google.Breaker) {
+		return
+	}
+
+	for i := 0; i < cfg.Distance.Breaker.Threshold; i++ {
+		google.Breaker.Failure()
+	}
+
+	srv := httptest.NewServer(Router())
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL+"/order", "application/json", strings.NewReader(
+		`{"origin": ["12.9734", "77.5910"], "destination": ["12.9527", "77.5848"]}`,
+	))
+	assert.Nil(err)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(strconv.Itoa(int(cfg.Distance.Breaker.Cooldown.Seconds())), resp.Header.Get("Retry-After"))
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal("{\"error\":\"DISTANCE_PROVIDER_UNAVAILABLE\"}\n", string(respBody))
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDistanceCachePrecision rounds coordinates to 4 decimal places, about 11 meters
+	DefaultDistanceCachePrecision = 4
+
+	// MaxDistanceCachePrecision rounds coordinates to 7 decimal places, about 1 centimeter
+	MaxDistanceCachePrecision = 7
+
+	// DefaultDistanceCacheSize is the number of distances kept in process by default
+	DefaultDistanceCacheSize = 10000
+
+	// DefaultDistanceCacheTTL is how long a distance is cached by default
+	DefaultDistanceCacheTTL = 24 * time.Hour
+
+	// departureWindow groups departure times sharing a cached duration in traffic, traffic
+	// barely changes within it
+	departureWindow = 15 * time.Minute
+)
+
+// DistanceCacheStore persists cached routes shared by every replica
+type DistanceCacheStore interface {
+	// SelectCachedDistance returns the route cached under `key` along with the time
+	// left until it expires, found is false if no route is cached or it expired
+	SelectCachedDistance(key string) (route Route, ttl time.Duration, found bool, err error)
+
+	// SaveCachedDistance caches a route under `key` for `ttl`, replacing any cached one
+	SaveCachedDistance(key string, route Route, ttl time.Duration) error
+
+	// PurgeCachedDistances removes every cached distance and returns how many were removed
+	PurgeCachedDistances() (int, error)
+}
+
+// DistanceCacheStats counts the lookups made in a DistanceCache since the process started
+type DistanceCacheStats struct {
+	// Hits were answered in process, SharedHits from the shared store
+	Hits       int64 `json:"hits"`
+	SharedHits int64 `json:"shared_hits"`
+	Misses     int64 `json:"misses"`
+
+	// Entries is the number of distances kept in process
+	Entries int `json:"entries"`
+}
+
+// DistanceCachePurge counts the distances removed by DistanceCache.Purge
+type DistanceCachePurge struct {
+	Entries       int `json:"entries"`
+	SharedEntries int `json:"shared_entries"`
+}
+
+// cachedDistance is an entry of the in-process LRU list
+type cachedDistance struct {
+	key       string
+	route     Route
+	expiresAt time.Time
+}
+
+// DistanceCache caches routes keyed by origin and destination rounded to Precision
+// decimal places and by travel mode, so that orders between the same places going the same way
+// share a lookup. Routes are kept in a least recently used list of up to Size entries,
+// and in Shared if it is set
+type DistanceCache struct {
+	Precision int
+	Size      int
+	TTL       time.Duration
+	Shared    DistanceCacheStore
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   DistanceCacheStats
+}
+
+// NewDistanceCache creates a DistanceCache, `shared` may be nil to cache in process only
+func NewDistanceCache(cfg DistanceCacheConfig, shared DistanceCacheStore) *DistanceCache {
+	return &DistanceCache{
+		Precision: cfg.Precision,
+		Size:      cfg.Size,
+		TTL:       cfg.TTL.Duration,
+		Shared:    shared,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// key identifies the route requested by `req` once rounded, whenever it departs
+func (dc *DistanceCache) key(req RouteRequest) (string, error) {
+	from, err := parseLatLng(req.Origin)
+	if err != nil {
+		return "", err
+	}
+
+	to, err := parseLatLng(req.Destination)
+	if err != nil {
+		return "", err
+	}
+
+	mode := req.Mode
+	if mode == "" {
+		mode = TravelModeDriving
+	}
+
+	scale := math.Pow(10, float64(dc.Precision))
+	round := func(v float64) string {
+		return strconv.FormatFloat(math.Round(v*scale)/scale, 'f', dc.Precision, 64)
+	}
+
+	return round(from.Lat) + "," + round(from.Lng) + ";" + round(to.Lat) + "," + round(to.Lng) +
+		"/" + mode + "/" + strings.Join(normalizeAvoid(req.Avoid), "|"), nil
+}
+
+// trafficKey identifies the duration in traffic of the route under `key` for departures in
+// the departureWindow of `req`, those leaving now included
+func trafficKey(key string, req RouteRequest) string {
+	departure := req.DepartureTime
+	if departure.IsZero() {
+		departure = time.Now()
+	}
+
+	return key + "@" + strconv.FormatInt(departure.Truncate(departureWindow).Unix(), 10)
+}
+
+// Get returns the route cached under `key`, looking in process first, then in Shared
+func (dc *DistanceCache) Get(key string) (Route, bool) {
+	route, ok := dc.get(key)
+	if !ok {
+		dc.mu.Lock()
+		dc.stats.Misses++
+		dc.mu.Unlock()
+	}
+
+	return route, ok
+}
+
+// get is Get counting hits only
+func (dc *DistanceCache) get(key string) (Route, bool) {
+	dc.mu.Lock()
+	if elem, ok := dc.entries[key]; ok {
+		entry := elem.Value.(*cachedDistance)
+		if time.Now().Before(entry.expiresAt) {
+			dc.lru.MoveToFront(elem)
+			dc.stats.Hits++
+			dc.mu.Unlock()
+			return entry.route, true
+		}
+
+		dc.remove(elem)
+	}
+	dc.mu.Unlock()
+
+	if dc.Shared != nil {
+		route, ttl, found, err := dc.Shared.SelectCachedDistance(key)
+		if err != nil {
+			log.Printf("failed to read shared distance cache: %s", err)
+		}
+
+		if found {
+			dc.mu.Lock()
+			dc.stats.SharedHits++
+			dc.put(key, route, ttl)
+			dc.mu.Unlock()
+			return route, true
+		}
+	}
+
+	return Route{}, false
+}
+
+// Put caches a route under `key` for TTL, in process and in Shared
+func (dc *DistanceCache) Put(key string, route Route) {
+	dc.PutFor(key, route, dc.TTL)
+}
+
+// PutFor caches a route under `key` for `ttl`, in process and in Shared
+func (dc *DistanceCache) PutFor(key string, route Route, ttl time.Duration) {
+	dc.mu.Lock()
+	dc.put(key, route, ttl)
+	dc.mu.Unlock()
+
+	if dc.Shared != nil {
+		if err := dc.Shared.SaveCachedDistance(key, route, ttl); err != nil {
+			log.Printf("failed to write shared distance cache: %s", err)
+		}
+	}
+}
+
+// put caches a route in process, evicting the least recently used entries beyond Size.
+// The caller must hold mu
+func (dc *DistanceCache) put(key string, route Route, ttl time.Duration) {
+	if dc.Size <= 0 {
+		return
+	}
+
+	entry := &cachedDistance{key: key, route: route, expiresAt: time.Now().Add(ttl)}
+	if elem, ok := dc.entries[key]; ok {
+		elem.Value = entry
+		dc.lru.MoveToFront(elem)
+		return
+	}
+
+	dc.entries[key] = dc.lru.PushFront(entry)
+	for dc.lru.Len() > dc.Size {
+		dc.remove(dc.lru.Back())
+	}
+}
+
+// remove drops an entry from the in-process cache. The caller must hold mu
+func (dc *DistanceCache) remove(elem *list.Element) {
+	dc.lru.Remove(elem)
+	delete(dc.entries, elem.Value.(*cachedDistance).key)
+}
+
+// Stats returns the lookup counters and the number of distances kept in process
+func (dc *DistanceCache) Stats() DistanceCacheStats {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	stats := dc.stats
+	stats.Entries = dc.lru.Len()
+	return stats
+}
+
+// Purge removes every cached distance, in process and in Shared
+func (dc *DistanceCache) Purge() (purged DistanceCachePurge, err error) {
+	dc.mu.Lock()
+	purged.Entries = dc.lru.Len()
+	dc.lru.Init()
+	dc.entries = make(map[string]*list.Element)
+	dc.mu.Unlock()
+
+	if dc.Shared != nil {
+		purged.SharedEntries, err = dc.Shared.PurgeCachedDistances()
+	}
+
+	return
+}
+
+// CachedDistanceProvider answers from Cache the routes it looked up with Provider before.
+// Failed lookups are not cached
+type CachedDistanceProvider struct {
+	Provider DistanceProvider
+	Cache    *DistanceCache
+}
+
+// Route returns the cached route requested by `req`, or the one looked up by Provider.
+//
+// The distance and duration of a route are cached for the cache's TTL, whenever the route
+// departs. Its duration in traffic only holds around the time it was looked up for, so it
+// is cached separately for departures in the same departureWindow: a cached route departing
+// at another time is returned without one
+func (cp *CachedDistanceProvider) Route(ctx context.Context, req RouteRequest) (Route, error) {
+	key, err := cp.Cache.key(req)
+	if err != nil {
+		return cp.Provider.Route(ctx, req)
+	}
+
+	inTraffic := trafficKey(key, req)
+	if route, ok := cp.Cache.get(inTraffic); ok {
+		return route, nil
+	}
+
+	if route, ok := cp.Cache.Get(key); ok {
+		return route, nil
+	}
+
+	route, err := cp.Provider.Route(ctx, req)
+	if err != nil {
+		return route, err
+	}
+
+	if route.DurationInTraffic > 0 {
+		ttl := departureWindow
+		if cp.Cache.TTL < ttl {
+			ttl = cp.Cache.TTL
+		}
+		cp.Cache.PutFor(inTraffic, route, ttl)
+	}
+
+	typical := route
+	typical.DurationInTraffic = 0
+	cp.Cache.Put(key, typical)
+
+	return route, nil
+}
+
+// distanceCacheStats reports the hits and misses of the distance cache
+func distanceCacheStats(w http.ResponseWriter, r *http.Request) {
+	if defaultDistanceCache == nil {
+		writeError(w, http.StatusNotFound, "distance cache is disabled")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, defaultDistanceCache.Stats())
+}
+
+// purgeDistanceCache empties the distance cache of this replica and the shared one
+func purgeDistanceCache(w http.ResponseWriter, r *http.Request) {
+	if defaultDistanceCache == nil {
+		writeError(w, http.StatusNotFound, "distance cache is disabled")
+		return
+	}
+
+	purged, err := defaultDistanceCache.Purge()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("distance cache purged: %d entries, %d shared entries", purged.Entries, purged.SharedEntries)
+	writeJSON(w, http.StatusOK, purged)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDistanceProvider estimates distances and counts the lookups made.
+// Routes take `traffic` in traffic, if set
+type countingDistanceProvider struct {
+	calls   int
+	fail    bool
+	traffic time.Duration
+}
+
+func (cp *countingDistanceProvider) Route(ctx context.Context, req RouteRequest) (Route, error) {
+	cp.calls++
+	if cp.fail {
+		return failingDistanceProvider{}.Route(ctx, req)
+	}
+
+	route, err := (&GreatCircleDistanceProvider{RoadFactor: 1}).Route(ctx, req)
+	route.DurationInTraffic = cp.traffic
+	return route, err
+}
+
+// mapDistanceCacheStore is a DistanceCacheStore shared by several caches in tests
+type mapDistanceCacheStore map[string]Route
+
+func (ms mapDistanceCacheStore) SelectCachedDistance(key string) (Route, time.Duration, bool, error) {
+	route, ok := ms[key]
+	return route, time.Minute, ok, nil
+}
+
+func (ms mapDistanceCacheStore) SaveCachedDistance(key string, route Route, ttl time.Duration) error {
+	ms[key] = route
+	return nil
+}
+
+func (ms mapDistanceCacheStore) PurgeCachedDistances() (int, error) {
+	purged := len(ms)
+	for key := range ms {
+		delete(ms, key)
+	}
+
+	return purged, nil
+}
+
+func newTestDistanceCache(size int, ttl time.Duration, shared DistanceCacheStore) *DistanceCache {
+	return NewDistanceCache(DistanceCacheConfig{
+		Precision: 3,
+		Size:      size,
+		TTL:       Duration{ttl},
+	}, shared)
+}
+
+func TestCachedDistance(t *testing.T) {
+	assert := assert.New(t)
+
+	counting := &countingDistanceProvider{}
+	cache := newTestDistanceCache(2, time.Minute, nil)
+	cp := &CachedDistanceProvider{Provider: counting, Cache: cache}
+
+	d, err := cp.Route(context.Background(), between("12.9734,77.5910", "12.9527,77.5848"))
+	assert.Nil(err)
+	assert.Equal(1, counting.calls)
+
+	// coordinates rounding to the same key share the cached distance
+	cached, err := cp.Route(context.Background(), between("12.97341,77.59104", "12.95268,77.5848"))
+	assert.Nil(err)
+	assert.Equal(d, cached)
+	assert.Equal(1, counting.calls)
+
+	_, err = cp.Route(context.Background(), between("12.9734,77.5910", "12.9600,77.5848"))
+	assert.Nil(err)
+	assert.Equal(2, counting.calls)
+
+	// the least recently used distance is evicted beyond the cache size
+	_, err = cp.Route(context.Background(), between("12.9734,77.5910", "12.9700,77.5848"))
+	assert.Nil(err)
+	_, err = cp.Route(context.Background(), between("12.9734,77.5910", "12.9527,77.5848"))
+	assert.Nil(err)
+	assert.Equal(4, counting.calls)
+
+	assert.Equal(DistanceCacheStats{Hits: 1, Misses: 4, Entries: 2}, cache.Stats())
+
+	// failed lookups are not cached
+	counting.fail = true
+	_, err = cp.Route(context.Background(), between("0,0", "1,1"))
+	assert.NotNil(err)
+	_, err = cp.Route(context.Background(), between("0,0", "1,1"))
+	assert.NotNil(err)
+	assert.Equal(6, counting.calls)
+
+	purged, err := cache.Purge()
+	assert.Nil(err)
+	assert.Equal(DistanceCachePurge{Entries: 2}, purged)
+	assert.Equal(0, cache.Stats().Entries)
+}
+
+func TestCachedDistanceExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	counting := &countingDistanceProvider{}
+	cp := &CachedDistanceProvider{Provider: counting, Cache: newTestDistanceCache(10, time.Millisecond, nil)}
+
+	cp.Route(context.Background(), between("0,0", "1,1"))
+	cp.Route(context.Background(), between("0,0", "1,1"))
+	assert.Equal(1, counting.calls)
+
+	time.Sleep(5 * time.Millisecond)
+	cp.Route(context.Background(), between("0,0", "1,1"))
+	assert.Equal(2, counting.calls)
+}
+
+func TestCachedRouteDeparture(t *testing.T) {
+	assert := assert.New(t)
+
+	counting := &countingDistanceProvider{traffic: 7 * time.Minute}
+	cache := newTestDistanceCache(10, time.Hour, nil)
+	cp := &CachedDistanceProvider{Provider: counting, Cache: cache}
+
+	// departures within the same window share the duration in traffic, leaving now included
+	window := time.Now().Truncate(departureWindow)
+	for _, departure := range []time.Time{{}, window, window.Add(departureWindow - time.Second)} {
+		req := between("0,0", "1,1")
+		req.DepartureTime = departure
+		route, err := cp.Route(context.Background(), req)
+		assert.Nil(err)
+		assert.Equal(7*time.Minute, route.DurationInTraffic)
+	}
+	assert.Equal(1, counting.calls)
+
+	// other departures share the distance and duration, but not the traffic
+	req := between("0,0", "1,1")
+	req.DepartureTime = window.Add(6 * time.Hour)
+	route, err := cp.Route(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(1, counting.calls)
+	assert.True(route.Distance.Meters > 0 && route.Duration > 0)
+	assert.Equal(time.Duration(0), route.DurationInTraffic)
+	assert.Equal(DistanceCacheStats{Hits: 3, Misses: 1, Entries: 2}, cache.Stats())
+
+	// so do equal travel modes and avoided features
+	counting.traffic = 0
+	req = between("0,0", "1,1")
+	req.Mode = TravelModeBicycling
+	req.Avoid = []string{AvoidTolls, AvoidFerries}
+	cp.Route(context.Background(), req)
+	req.Avoid = []string{AvoidFerries, AvoidTolls}
+	cp.Route(context.Background(), req)
+	assert.Equal(2, counting.calls)
+
+	req.Mode = TravelModeWalking
+	cp.Route(context.Background(), req)
+	assert.Equal(3, counting.calls)
+}
+
+func TestSharedDistanceCache(t *testing.T) {
+	assert := assert.New(t)
+
+	shared := mapDistanceCacheStore{}
+	counting := &countingDistanceProvider{}
+	replica1 := &CachedDistanceProvider{Provider: counting, Cache: newTestDistanceCache(10, time.Minute, shared)}
+	replica2 := &CachedDistanceProvider{Provider: counting, Cache: newTestDistanceCache(0, time.Minute, shared)}
+
+	d, err := replica1.Route(context.Background(), between("0,0", "1,1"))
+	assert.Nil(err)
+	assert.Len(shared, 1)
+
+	// a distance computed by one replica is found by the others
+	cached, err := replica2.Route(context.Background(), between("0,0", "1,1"))
+	assert.Nil(err)
+	assert.Equal(d, cached)
+	assert.Equal(1, counting.calls)
+	assert.Equal(DistanceCacheStats{SharedHits: 1}, replica2.Cache.Stats())
+
+	purged, err := replica1.Cache.Purge()
+	assert.Nil(err)
+	assert.Equal(DistanceCachePurge{Entries: 1, SharedEntries: 1}, purged)
+	assert.Len(shared, 0)
+}
+
+func TestDistanceCacheEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "let-me-in"
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+	cacheEndpoint := fmt.Sprintf("%s/admin/distance_cache", srv.URL)
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		req, _ := http.NewRequest(method, cacheEndpoint, nil)
+		resp, err := client.Do(req)
+		assert.Nil(err)
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, cacheEndpoint, nil)
+	req.Header.Set(AdminTokenHeader, adminToken)
+	resp, err := client.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var stats DistanceCacheStats
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&stats))
+
+	req, _ = http.NewRequest(http.MethodDelete, cacheEndpoint, nil)
+	req.Header.Set(AdminTokenHeader, adminToken)
+	resp, err = client.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+}
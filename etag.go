@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// VersionMismatchError is returned when an update is conditioned on versions of an order
+// other than its current one
+type VersionMismatchError struct {
+	Current int
+}
+
+func (e *VersionMismatchError) Error() string {
+	return "ORDER_VERSION_MISMATCH"
+}
+
+// checkVersion returns a *VersionMismatchError unless the current version of an order
+// satisfies the precondition of `update`
+func checkVersion(current int, update StatusUpdate) error {
+	if update.IfVersions == nil {
+		return nil
+	}
+
+	for _, v := range update.IfVersions {
+		if v == current {
+			return nil
+		}
+	}
+
+	return &VersionMismatchError{Current: current}
+}
+
+// orderETag is the entity tag of an order at `version`
+func orderETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// parseIfMatch reads the versions listed by the If-Match header of a request. It returns nil
+// if the header is absent or `*`, i.e. the request is not conditioned on a version.
+// Weak and malformed tags match no version, so a header made of them only fails every update
+func parseIfMatch(r *http.Request) []int {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+
+	versions := []int{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil
+		}
+
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+
+		if v, err := strconv.Atoi(tag[1 : len(tag)-1]); err == nil {
+			versions = append(versions, v)
+		}
+	}
+
+	return versions
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIfMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	ifMatch := func(header string) []int {
+		r := httptest.NewRequest(http.MethodPut, "/order/1", nil)
+		if header != "" {
+			r.Header.Set("If-Match", header)
+		}
+
+		return parseIfMatch(r)
+	}
+
+	assert.Nil(ifMatch(""))
+	assert.Nil(ifMatch("*"))
+	assert.Equal([]int{3}, ifMatch(`"3"`))
+	assert.Equal([]int{3, 4}, ifMatch(`"3", "4"`))
+
+	// weak and malformed tags never match
+	assert.Equal([]int{}, ifMatch(`W/"3"`))
+	assert.Equal([]int{}, ifMatch(`3`))
+	assert.Equal([]int{}, ifMatch(`"three"`))
+
+	assert.Nil(checkVersion(3, StatusUpdate{}))
+	assert.Nil(checkVersion(3, StatusUpdate{IfVersions: []int{2, 3}}))
+	assert.Equal(&VersionMismatchError{Current: 3}, checkVersion(3, StatusUpdate{IfVersions: []int{}}))
+}
+
+func TestUpdateOrderIfMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	id, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+	orderEndpoint := fmt.Sprintf("%s/%s/%d", srv.URL, "order", id)
+	courierId := newTestCourier(t)
+
+	resp, err := client.Get(orderEndpoint)
+	assert.Nil(err)
+	etag := resp.Header.Get("ETag")
+	assert.Equal(`"1"`, etag)
+
+	var order ResolvedOrder
+	json.NewDecoder(resp.Body).Decode(&order)
+	assert.Equal(1, order.Version)
+
+	put := func(status, ifMatch string) *http.Response {
+		putData := []byte(fmt.Sprintf(`{"status": "%s", "courier_id": %d}`, status, courierId))
+		req, _ := http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader(putData))
+		req.Header.Set(CourierTokenHeader, testCourierToken)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+
+		resp, err := client.Do(req)
+		assert.Nil(err)
+		return resp
+	}
+
+	resp = put(OrderStatusTaken, etag)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// the take changed the order since its ETag was read
+	resp = put(OrderStatusUnassign, etag)
+	assert.Equal(http.StatusPreconditionFailed, resp.StatusCode)
+	assert.Equal(`"2"`, resp.Header.Get("ETag"))
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal("{\"error\":\"ORDER_VERSION_MISMATCH\",\"current_version\":2}\n", string(respBody))
+
+	order, err = defaultOrderStore.SelectOrder(id)
+	assert.Nil(err)
+	assert.Equal(OrderStatusTaken, order.Status)
+
+	resp = put(OrderStatusPickedUp, `"2"`)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// the precondition is checked before the transition
+	resp = put(OrderStatusDelivered, `"2"`)
+	assert.Equal(http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp = put(OrderStatusInTransit, "*")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// listings include the version of every order
+	resp, err = client.Get(fmt.Sprintf("%s/orders?status=%s&sort=-id", srv.URL, OrderStatusInTransit))
+	assert.Nil(err)
+
+	var page orderListPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	if assert.NotEmpty(page.Data) {
+		assert.Equal(id, page.Data[0].Id)
+		assert.Equal(4, page.Data[0].Version)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+const (
+	OrderSortId        = "id"
+	OrderSortDistance  = "distance"
+	OrderSortCreatedAt = "created_at"
+)
+
+// OrderSort orders a listing of orders by a field, ties are broken by id
+type OrderSort struct {
+	Field string
+	Desc  bool
+}
+
+// DefaultOrderSort lists orders by creation time, the order followed by cursors
+var DefaultOrderSort = OrderSort{Field: OrderSortCreatedAt}
+
+// BoundingBox is the area between two latitudes and two longitudes. A box whose MinLng is
+// greater than its MaxLng crosses the antimeridian
+type BoundingBox struct {
+	MinLat, MinLng, MaxLat, MaxLng float64
+}
+
+// contains returns if the point lies in the box, edges included
+func (b *BoundingBox) contains(p maps.LatLng) bool {
+	if p.Lat < b.MinLat || p.Lat > b.MaxLat {
+		return false
+	}
+
+	if b.MinLng > b.MaxLng {
+		return p.Lng >= b.MinLng || p.Lng <= b.MaxLng
+	}
+
+	return p.Lng >= b.MinLng && p.Lng <= b.MaxLng
+}
+
+// Circle is the area within Radius meters of a point, as the crow flies
+type Circle struct {
+	Center maps.LatLng
+	Radius float64
+}
+
+// contains returns if the point lies in the circle, edge included
+func (c *Circle) contains(p maps.LatLng) bool {
+	return haversine(c.Center, p) <= c.Radius
+}
+
+// Area is a region that an order's origin or destination must lie in,
+// exactly one of Box and Circle is set
+type Area struct {
+	Box    *BoundingBox
+	Circle *Circle
+}
+
+// contains returns if the point lies in the area
+func (a *Area) contains(p maps.LatLng) bool {
+	if a.Box != nil {
+		return a.Box.contains(p)
+	}
+
+	return a.Circle.contains(p)
+}
+
+// OrderQuery selects and sorts the orders of a listing. The zero value lists every order
+// in the DefaultOrderSort
+type OrderQuery struct {
+	// Statuses lists the statuses of the orders to list, empty lists any status
+	Statuses []string
+
+	// ExcludedStatuses lists the statuses of the orders left out of the listing
+	ExcludedStatuses []string
+
+	// MinDistance and MaxDistance bound the distance of the orders, in meters, bounds included
+	MinDistance, MaxDistance *int
+
+	// CreatedSince and CreatedBefore bound the creation time of the orders,
+	// CreatedSince included and CreatedBefore excluded
+	CreatedSince, CreatedBefore *time.Time
+
+	Origin, Destination *Area
+
+	Sort OrderSort
+}
+
+// sort returns the sort of the listing, DefaultOrderSort if none is set
+func (q OrderQuery) sort() OrderSort {
+	if q.Sort.Field == "" {
+		return DefaultOrderSort
+	}
+
+	return q.Sort
+}
+
+// matches returns if an order is selected by the query
+func (q OrderQuery) matches(order ResolvedOrder) bool {
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, s := range q.Statuses {
+			found = found || s == order.Status
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	for _, s := range q.ExcludedStatuses {
+		if s == order.Status {
+			return false
+		}
+	}
+
+	if q.MinDistance != nil && order.Distance < *q.MinDistance {
+		return false
+	}
+
+	if q.MaxDistance != nil && order.Distance > *q.MaxDistance {
+		return false
+	}
+
+	if q.CreatedSince != nil && order.CreatedAt.Before(*q.CreatedSince) {
+		return false
+	}
+
+	if q.CreatedBefore != nil && !order.CreatedAt.Before(*q.CreatedBefore) {
+		return false
+	}
+
+	areas := []struct {
+		area  *Area
+		point LatLng
+	}{
+		{q.Origin, order.Origin},
+		{q.Destination, order.Destination},
+	}
+
+	for _, a := range areas {
+		if a.area == nil {
+			continue
+		}
+
+		p, err := parseLatLng(a.point.String())
+		if err != nil || !a.area.contains(p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// less returns if order `a` is listed before order `b` in the sort
+func (s OrderSort) less(a, b ResolvedOrder) bool {
+	var cmp int
+
+	switch s.Field {
+	case OrderSortDistance:
+		cmp = a.Distance - b.Distance
+	case OrderSortCreatedAt:
+		switch {
+		case a.CreatedAt.Before(*b.CreatedAt):
+			cmp = -1
+		case a.CreatedAt.After(*b.CreatedAt):
+			cmp = 1
+		}
+	}
+
+	if cmp == 0 {
+		cmp = a.Id - b.Id
+	}
+
+	if s.Desc {
+		return cmp > 0
+	}
+
+	return cmp < 0
+}
+
+// parseOrderQuery reads the filters and sort of GET /orders from the query parameters:
+//   - status: statuses, repeated or comma separated. Cancelled orders are left out unless
+//     they are asked for
+//   - min_distance, max_distance: distances in meters
+//   - created_since, created_before: RFC 3339 timestamps
+//   - origin_bbox, destination_bbox: min_lat,min_lng,max_lat,max_lng
+//   - origin_near, destination_near: lat,lng,radius in meters
+//   - sort: id, distance or created_at, prefixed with - to sort in descending order
+func parseOrderQuery(params url.Values) (q OrderQuery, err error) {
+	for _, param := range params["status"] {
+		for _, s := range strings.Split(param, ",") {
+			if !IsValidOrderStatus(s) {
+				return q, fmt.Errorf("Unknown status: %s", s)
+			}
+
+			q.Statuses = append(q.Statuses, s)
+		}
+	}
+
+	if len(q.Statuses) == 0 {
+		q.ExcludedStatuses = []string{OrderStatusCancelled}
+	}
+
+	if q.MinDistance, err = parseDistanceParam(params, "min_distance"); err != nil {
+		return
+	}
+
+	if q.MaxDistance, err = parseDistanceParam(params, "max_distance"); err != nil {
+		return
+	}
+
+	if q.MinDistance != nil && q.MaxDistance != nil && *q.MinDistance > *q.MaxDistance {
+		return q, fmt.Errorf("min_distance must not be greater than max_distance")
+	}
+
+	if q.CreatedSince, err = parseTimeParam(params, "created_since"); err != nil {
+		return
+	}
+
+	if q.CreatedBefore, err = parseTimeParam(params, "created_before"); err != nil {
+		return
+	}
+
+	if q.Origin, err = parseAreaParams(params, "origin"); err != nil {
+		return
+	}
+
+	if q.Destination, err = parseAreaParams(params, "destination"); err != nil {
+		return
+	}
+
+	if sort := params.Get("sort"); sort != "" {
+		q.Sort.Desc = strings.HasPrefix(sort, "-")
+		q.Sort.Field = strings.TrimPrefix(sort, "-")
+
+		switch q.Sort.Field {
+		case OrderSortId, OrderSortDistance, OrderSortCreatedAt:
+		default:
+			return q, fmt.Errorf("sort must be one of id, distance or created_at, optionally prefixed with -")
+		}
+	}
+
+	return q, nil
+}
+
+// parseDistanceParam reads an optional non-negative distance in meters
+func parseDistanceParam(params url.Values, name string) (*int, error) {
+	param := params.Get(name)
+	if param == "" {
+		return nil, nil
+	}
+
+	d, err := strconv.Atoi(param)
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative integer number of meters", name)
+	}
+
+	return &d, nil
+}
+
+// parseTimeParam reads an optional RFC 3339 timestamp
+func parseTimeParam(params url.Values, name string) (*time.Time, error) {
+	param := params.Get(name)
+	if param == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 timestamp e.g. 2018-07-01T10:00:00Z", name)
+	}
+
+	// creation times are kept in UTC
+	t = t.UTC()
+	return &t, nil
+}
+
+// parseFloats parses a comma separated list of exactly `n` numbers
+func parseFloats(param string, n int) ([]float64, bool) {
+	parts := strings.Split(param, ",")
+	if len(parts) != n {
+		return nil, false
+	}
+
+	values := make([]float64, n)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, false
+		}
+
+		values[i] = v
+	}
+
+	return values, true
+}
+
+// isValidPoint returns if a latitude and longitude lie within sane bounds
+func isValidPoint(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// parseAreaParams reads the optional area of an order endpoint, e.g. `origin`, given by either
+// the `<endpoint>_bbox` or the `<endpoint>_near` parameter
+func parseAreaParams(params url.Values, endpoint string) (*Area, error) {
+	bboxParam, nearParam := params.Get(endpoint+"_bbox"), params.Get(endpoint+"_near")
+
+	switch {
+	case bboxParam != "" && nearParam != "":
+		return nil, fmt.Errorf("%s_bbox and %s_near cannot be combined", endpoint, endpoint)
+	case bboxParam != "":
+		v, ok := parseFloats(bboxParam, 4)
+		if !ok || !isValidPoint(v[0], v[1]) || !isValidPoint(v[2], v[3]) || v[0] > v[2] {
+			return nil, fmt.Errorf("%s_bbox must be min_lat,min_lng,max_lat,max_lng", endpoint)
+		}
+
+		return &Area{Box: &BoundingBox{MinLat: v[0], MinLng: v[1], MaxLat: v[2], MaxLng: v[3]}}, nil
+	case nearParam != "":
+		v, ok := parseFloats(nearParam, 3)
+		if !ok || !isValidPoint(v[0], v[1]) || v[2] < 0 {
+			return nil, fmt.Errorf("%s_near must be lat,lng,radius with the radius in meters", endpoint)
+		}
+
+		return &Area{Circle: &Circle{Center: maps.LatLng{Lat: v[0], Lng: v[1]}, Radius: v[2]}}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"googlemaps.github.io/maps"
+)
+
+func TestParseOrderQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	// cancelled orders are left out by default
+	q, err := parseOrderQuery(url.Values{})
+	assert.Nil(err)
+	assert.Equal(OrderQuery{ExcludedStatuses: []string{OrderStatusCancelled}}, q)
+	assert.Equal(DefaultOrderSort, q.sort())
+
+	q, err = parseOrderQuery(url.Values{
+		"status":           {"taken,picked_up", "UNASSIGN"},
+		"min_distance":     {"100"},
+		"max_distance":     {"5000"},
+		"created_since":    {"2018-07-01T10:00:00+02:00"},
+		"created_before":   {"2018-07-02T00:00:00Z"},
+		"origin_bbox":      {"12.9,77.5,13.0,77.6"},
+		"destination_near": {"12.95,77.58,1000"},
+		"sort":             {"-distance"},
+	})
+	assert.Nil(err)
+	assert.Equal([]string{OrderStatusTaken, OrderStatusPickedUp, OrderStatusUnassign}, q.Statuses)
+	assert.Empty(q.ExcludedStatuses)
+	assert.Equal(100, *q.MinDistance)
+	assert.Equal(5000, *q.MaxDistance)
+	assert.Equal(time.Date(2018, 7, 1, 8, 0, 0, 0, time.UTC), *q.CreatedSince)
+	assert.Equal(time.Date(2018, 7, 2, 0, 0, 0, 0, time.UTC), *q.CreatedBefore)
+	assert.Equal(&BoundingBox{MinLat: 12.9, MinLng: 77.5, MaxLat: 13.0, MaxLng: 77.6}, q.Origin.Box)
+	assert.Equal(&Circle{Center: maps.LatLng{Lat: 12.95, Lng: 77.58}, Radius: 1000}, q.Destination.Circle)
+	assert.Equal(OrderSort{Field: OrderSortDistance, Desc: true}, q.Sort)
+
+	badParams := []url.Values{
+		{"status": {"shipped"}},
+		{"status": {"taken,"}},
+		{"min_distance": {"-1"}},
+		{"max_distance": {"far"}},
+		{"min_distance": {"10"}, "max_distance": {"5"}},
+		{"created_since": {"yesterday"}},
+		{"created_before": {"2018-07-02"}},
+		{"origin_bbox": {"12.9,77.5,13.0"}},
+		{"origin_bbox": {"13.0,77.5,12.9,77.6"}},
+		{"origin_bbox": {"12.9,77.5,95,77.6"}},
+		{"destination_near": {"12.95,77.58"}},
+		{"destination_near": {"12.95,77.58,-5"}},
+		{"destination_near": {"NaN,77.58,5"}},
+		{"origin_bbox": {"12.9,77.5,13.0,77.6"}, "origin_near": {"12.95,77.58,1000"}},
+		{"sort": {"status"}},
+		{"sort": {"+id"}},
+	}
+
+	for _, params := range badParams {
+		_, err = parseOrderQuery(params)
+		assert.NotNil(err, "%v", params)
+	}
+}
+
+func TestOrderQueryMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	createdAt := time.Date(2018, 7, 1, 10, 0, 0, 0, time.UTC)
+	order := ResolvedOrder{
+		Id: 1, Distance: 1450, Status: OrderStatusTaken,
+		Origin: OriginLatLng, Destination: DestLatLng, CreatedAt: &createdAt,
+	}
+
+	near, far := 1000, 2000
+	before, after := createdAt.Add(-time.Hour), createdAt.Add(time.Hour)
+
+	matching := []OrderQuery{
+		{},
+		{Statuses: []string{OrderStatusUnassign, OrderStatusTaken}},
+		{ExcludedStatuses: []string{OrderStatusCancelled}},
+		{MinDistance: &near, MaxDistance: &far},
+		{CreatedSince: &createdAt, CreatedBefore: &after},
+		{Origin: &Area{Box: &BoundingBox{MinLat: 12.9, MinLng: 77.5, MaxLat: 13.0, MaxLng: 77.6}}},
+		{Destination: &Area{Circle: &Circle{Center: maps.LatLng{Lat: 12.9527, Lng: 77.5858}, Radius: 200}}},
+	}
+
+	for _, q := range matching {
+		assert.True(q.matches(order), "%+v", q)
+	}
+
+	nonMatching := []OrderQuery{
+		{Statuses: []string{OrderStatusUnassign}},
+		{ExcludedStatuses: []string{OrderStatusTaken}},
+		{MinDistance: &far},
+		{MaxDistance: &near},
+		{CreatedSince: &after},
+		{CreatedBefore: &createdAt},
+		{CreatedSince: &before, CreatedBefore: &before},
+		{Origin: &Area{Box: &BoundingBox{MinLat: 13, MinLng: 77.5, MaxLat: 14, MaxLng: 77.6}}},
+		{Destination: &Area{Circle: &Circle{Center: maps.LatLng{Lat: 12.9527, Lng: 77.5858}, Radius: 50}}},
+	}
+
+	for _, q := range nonMatching {
+		assert.False(q.matches(order), "%+v", q)
+	}
+}
+
+func TestBoundingBoxAntimeridian(t *testing.T) {
+	assert := assert.New(t)
+
+	fiji := BoundingBox{MinLat: -21, MinLng: 176, MaxLat: -12, MaxLng: -178}
+	assert.True(fiji.contains(maps.LatLng{Lat: -17, Lng: 178}))
+	assert.True(fiji.contains(maps.LatLng{Lat: -17, Lng: -179}))
+	assert.False(fiji.contains(maps.LatLng{Lat: -17, Lng: 0}))
+}
+
+func TestOrderSortLess(t *testing.T) {
+	assert := assert.New(t)
+
+	early, late := time.Now(), time.Now().Add(time.Minute)
+	a := ResolvedOrder{Id: 1, Distance: 200, CreatedAt: &late}
+	b := ResolvedOrder{Id: 2, Distance: 100, CreatedAt: &early}
+	c := ResolvedOrder{Id: 3, Distance: 100, CreatedAt: &early}
+
+	assert.True(OrderSort{Field: OrderSortId}.less(a, b))
+	assert.True(OrderSort{Field: OrderSortId, Desc: true}.less(b, a))
+	assert.True(OrderSort{Field: OrderSortDistance}.less(b, a))
+	assert.True(OrderSort{Field: OrderSortDistance, Desc: true}.less(a, b))
+	assert.True(OrderSort{Field: OrderSortCreatedAt}.less(b, a))
+
+	// ties are broken by id
+	assert.True(OrderSort{Field: OrderSortDistance}.less(b, c))
+	assert.True(OrderSort{Field: OrderSortDistance, Desc: true}.less(c, b))
+}
+
+func TestOrderQueryWhere(t *testing.T) {
+	assert := assert.New(t)
+
+	var args []interface{}
+	assert.Equal("", orderQueryWhere(OrderQuery{}, &args))
+	assert.Empty(args)
+
+	near := 1000
+	where := orderQueryWhere(OrderQuery{
+		Statuses:    []string{OrderStatusTaken},
+		MinDistance: &near,
+		Origin:      &Area{Box: &BoundingBox{MinLat: -21, MinLng: 176, MaxLat: -12, MaxLng: -178}},
+		Destination: &Area{Circle: &Circle{Center: maps.LatLng{Lat: 12.95, Lng: 77.58}, Radius: 500}},
+	}, &args)
+
+	assert.True(strings.HasPrefix(where, "WHERE status = ANY($1) AND distance_m >= $2 AND "+
+		"origin_lat BETWEEN $3 AND $4 AND (origin_lng >= $5 OR origin_lng <= $6) AND 2 * $9 * asin("))
+	assert.True(strings.HasSuffix(where, "<= $10"))
+	assert.Len(args, 10)
+
+	args = nil
+	where = orderQueryWhere(OrderQuery{ExcludedStatuses: []string{OrderStatusCancelled}}, &args)
+	assert.Equal("WHERE status <> ALL($1)", where)
+	assert.Len(args, 1)
+
+	assert.Equal("ORDER BY distance_m DESC, id DESC", orderBy(OrderSort{Field: OrderSortDistance, Desc: true}))
+	assert.Equal("ORDER BY created_at ASC, id ASC", orderBy(DefaultOrderSort))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+// Place is a location found by a Geocoder
+type Place struct {
+	PlaceId          string `json:"place_id"`
+	FormattedAddress string `json:"formatted_address"`
+	Location         LatLng `json:"location"`
+}
+
+// GeocodeError is returned when an address or place id does not resolve to a single place
+type GeocodeError struct {
+	// Code is one of the Geocode* error codes
+	Code string
+
+	// Endpoint is the order endpoint, origin or destination, which could not be geocoded
+	Endpoint string
+
+	// Candidates are the places matching an ambiguous address
+	Candidates []Place
+}
+
+func (e *GeocodeError) Error() string {
+	return e.Code
+}
+
+// GeocodingDisabledError is returned for orders located by address or place id when no
+// Google Maps API key is configured
+var GeocodingDisabledError = errors.New("GEOCODING_DISABLED")
+
+const (
+	GeocodeAddressNotFound = "ADDRESS_NOT_FOUND"
+	GeocodeAmbiguous       = "AMBIGUOUS_ADDRESS"
+	GeocodePlaceNotFound   = "PLACE_NOT_FOUND"
+)
+
+// Geocoder resolves addresses and place ids into coordinates.
+// Lookups give up once `ctx` is done
+type Geocoder interface {
+	// Geocode returns the place an address refers to, or a *GeocodeError listing the
+	// candidates if it may refer to several
+	Geocode(ctx context.Context, address string) (Place, error)
+
+	// LookupPlace returns the place with the given id, or a *GeocodeError if none exists
+	LookupPlace(ctx context.Context, placeId string) (Place, error)
+}
+
+// NewGeocoder creates a Geocoder using the Google Maps Geocoding API with the timeouts,
+// retries and circuit breaker configured for distances. It returns nil without a client
+func NewGeocoder(cfg DistanceConfig, client *maps.Client) Geocoder {
+	if client == nil {
+		return nil
+	}
+
+	g := &GoogleGeocoder{
+		Client:       client,
+		Timeout:      cfg.Timeout.Duration,
+		MaxRetries:   cfg.MaxRetries,
+		RetryBackoff: cfg.RetryBackoff.Duration,
+	}
+
+	if cfg.Breaker.Threshold > 0 {
+		g.Breaker = NewCircuitBreaker(cfg.Breaker.Threshold, cfg.Breaker.Cooldown.Duration)
+	}
+
+	return g
+}
+
+// GoogleGeocoder uses the Google Maps Geocoding API to resolve places
+type GoogleGeocoder struct {
+	Client *maps.Client
+
+	// Timeout bounds a lookup, retries included, 0 leaves it to the caller's context
+	Timeout time.Duration
+
+	// MaxRetries and RetryBackoff retry lookups as GoogleDistanceProvider does
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// Breaker stops lookups while the Geocoding API keeps failing, nil never stops them
+	Breaker *CircuitBreaker
+}
+
+// geocodeCall sends a Geocoding request
+type geocodeCall func(ctx context.Context) ([]maps.GeocodingResult, error)
+
+// geocode sends a Geocoding request with `call`, bounded by Timeout and guarded by Breaker
+func (g *GoogleGeocoder) geocode(ctx context.Context, call geocodeCall) (results []maps.GeocodingResult, err error) {
+	if g.Breaker != nil {
+		if err := g.Breaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	lookupCtx := ctx
+	if g.Timeout > 0 {
+		var cancel context.CancelFunc
+		lookupCtx, cancel = context.WithTimeout(ctx, g.Timeout)
+		defer cancel()
+	}
+
+	err = retryMaps(lookupCtx, "geocoding", g.MaxRetries, g.RetryBackoff, func() (err error) {
+		results, err = call(lookupCtx)
+		return
+	})
+
+	if g.Breaker != nil {
+		switch {
+		case err == nil || !isRetryableMapsError(err):
+			// the Geocoding API answered, even if it refused the request
+			g.Breaker.Success()
+		case ctx.Err() == nil:
+			g.Breaker.Failure()
+		}
+	}
+
+	if err != nil {
+		log.Printf("failed to geocode: %s", err)
+	}
+
+	return
+}
+
+// Geocode returns the only place matching `address`. Several matches, or a single partial
+// match i.e. a guess at a misspelled or incomplete address, are ambiguous
+func (g *GoogleGeocoder) Geocode(ctx context.Context, address string) (Place, error) {
+	results, err := g.geocode(ctx, func(ctx context.Context) ([]maps.GeocodingResult, error) {
+		return g.Client.Geocode(ctx, &maps.GeocodingRequest{Address: address})
+	})
+	if err != nil {
+		return Place{}, err
+	}
+
+	if len(results) == 0 {
+		return Place{}, &GeocodeError{Code: GeocodeAddressNotFound}
+	}
+
+	if len(results) > 1 || results[0].PartialMatch {
+		candidates := make([]Place, 0, len(results))
+		for _, result := range results {
+			candidates = append(candidates, newPlace(result))
+		}
+
+		return Place{}, &GeocodeError{Code: GeocodeAmbiguous, Candidates: candidates}
+	}
+
+	return newPlace(results[0]), nil
+}
+
+// LookupPlace returns the place with id `placeId`
+func (g *GoogleGeocoder) LookupPlace(ctx context.Context, placeId string) (Place, error) {
+	results, err := g.geocode(ctx, func(ctx context.Context) ([]maps.GeocodingResult, error) {
+		return g.Client.ReverseGeocode(ctx, &maps.GeocodingRequest{PlaceID: placeId})
+	})
+
+	// unknown and malformed place ids are reported with these statuses
+	if err != nil && (strings.HasPrefix(err.Error(), "maps: ZERO_RESULTS") ||
+		strings.HasPrefix(err.Error(), "maps: NOT_FOUND") ||
+		strings.HasPrefix(err.Error(), "maps: INVALID_REQUEST")) {
+		return Place{}, &GeocodeError{Code: GeocodePlaceNotFound}
+	}
+
+	if err != nil {
+		return Place{}, err
+	}
+
+	if len(results) == 0 {
+		return Place{}, &GeocodeError{Code: GeocodePlaceNotFound}
+	}
+
+	return newPlace(results[0]), nil
+}
+
+// newPlace converts a Geocoding API result into a Place
+func newPlace(result maps.GeocodingResult) Place {
+	location := result.Geometry.Location
+	return Place{
+		PlaceId:          result.PlaceID,
+		FormattedAddress: result.FormattedAddress,
+		Location: LatLng{
+			strconv.FormatFloat(location.Lat, 'f', -1, 64),
+			strconv.FormatFloat(location.Lng, 'f', -1, 64),
+		},
+	}
+}
+
+// validateEndpoints checks that the origin and the destination of an order are each given
+// either by valid coordinates, an address or a place id
+func (o *Order) validateEndpoints() error {
+	endpoints := []struct {
+		name             string
+		coords           LatLng
+		address, placeId string
+	}{
+		{"origin", o.Origin, o.OriginAddress, o.OriginPlaceId},
+		{"destination", o.Destination, o.DestinationAddress, o.DestinationPlaceId},
+	}
+
+	for _, e := range endpoints {
+		if e.address == "" && e.placeId == "" {
+			if !e.coords.IsValid() {
+				return errors.New("origin and destination must be valid lat, lng pairs")
+			}
+
+			continue
+		}
+
+		if e.coords != nil || (e.address != "" && e.placeId != "") {
+			return fmt.Errorf("%s must be given by only one of lat, lng, address or place id", e.name)
+		}
+
+		if defaultGeocoder == nil {
+			return GeocodingDisabledError
+		}
+	}
+
+	return nil
+}
+
+// locate returns the coordinates of the order endpoint `name`, given by `coords`, `address` or
+// `placeId`, along with the formatted address the geocoder resolved it to
+func locate(ctx context.Context, name string, coords LatLng, address, placeId string) (LatLng, string, error) {
+	if address == "" && placeId == "" {
+		return coords, "", nil
+	}
+
+	if defaultGeocoder == nil {
+		return nil, "", GeocodingDisabledError
+	}
+
+	var place Place
+	var err error
+	if address != "" {
+		place, err = defaultGeocoder.Geocode(ctx, address)
+	} else {
+		place, err = defaultGeocoder.LookupPlace(ctx, placeId)
+	}
+
+	if gerr, ok := err.(*GeocodeError); ok {
+		gerr.Endpoint = name
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	log.Printf("order %s %q located at %s", name, place.FormattedAddress, place.Location)
+	return place.Location, place.FormattedAddress, nil
+}
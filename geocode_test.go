@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"googlemaps.github.io/maps"
+)
+
+// geocodingResults are canned Geocoding API results, keyed by address or place id
+var geocodingResults = map[string]string{
+	"1 MG Road, Bangalore": `{"place_id": "mg-road", "formatted_address": "1, MG Road, Bengaluru, 560001, India",
+		"geometry": {"location": {"lat": 12.9757, "lng": 77.6011}}}`,
+	"forum-mall": `{"place_id": "forum-mall", "formatted_address": "Forum Mall, Koramangala, Bengaluru, India",
+		"geometry": {"location": {"lat": 12.9346, "lng": 77.6113}}}`,
+	"Church Street": `{"place_id": "church-st-blr", "formatted_address": "Church Street, Bengaluru, India",
+		"geometry": {"location": {"lat": 12.9752, "lng": 77.6046}}},
+		{"place_id": "church-st-mys", "formatted_address": "Church Street, Mysuru, India",
+		"geometry": {"location": {"lat": 12.3051, "lng": 76.6551}}}`,
+	"1 MG Rd, Bangalor": `{"place_id": "mg-road", "formatted_address": "1, MG Road, Bengaluru, 560001, India",
+		"geometry": {"location": {"lat": 12.9757, "lng": 77.6011}}, "partial_match": true}`,
+}
+
+// geocodingServer answers Geocoding requests with geocodingResults
+func geocodingServer(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	results, ok := geocodingResults[query.Get("address")+query.Get("place_id")]
+
+	status := "OK"
+	switch {
+	case !ok && query.Get("place_id") != "":
+		status = "INVALID_REQUEST"
+	case !ok:
+		status = "ZERO_RESULTS"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status": %q, "results": [%s]}`, status, results)
+}
+
+func newTestGeocoder(t *testing.T) (*GoogleGeocoder, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(geocodingServer))
+	client, err := maps.NewClient(maps.WithAPIKey("key"), maps.WithBaseURL(srv.URL))
+	assert.Nil(t, err)
+
+	return &GoogleGeocoder{Client: client, Timeout: time.Second}, srv.Close
+}
+
+func TestGoogleGeocoder(t *testing.T) {
+	assert := assert.New(t)
+
+	g, closeServer := newTestGeocoder(t)
+	defer closeServer()
+	ctx := context.Background()
+
+	place, err := g.Geocode(ctx, "1 MG Road, Bangalore")
+	assert.Nil(err)
+	assert.Equal(Place{
+		PlaceId:          "mg-road",
+		FormattedAddress: "1, MG Road, Bengaluru, 560001, India",
+		Location:         LatLng{"12.9757", "77.6011"},
+	}, place)
+
+	place, err = g.LookupPlace(ctx, "forum-mall")
+	assert.Nil(err)
+	assert.Equal("Forum Mall, Koramangala, Bengaluru, India", place.FormattedAddress)
+	assert.Equal(LatLng{"12.9346", "77.6113"}, place.Location)
+
+	// several matches and guesses are ambiguous
+	_, err = g.Geocode(ctx, "Church Street")
+	if assert.IsType(&GeocodeError{}, err) {
+		assert.Equal(GeocodeAmbiguous, err.Error())
+		assert.Len(err.(*GeocodeError).Candidates, 2)
+	}
+
+	_, err = g.Geocode(ctx, "1 MG Rd, Bangalor")
+	if assert.IsType(&GeocodeError{}, err) {
+		assert.Equal(GeocodeAmbiguous, err.Error())
+		assert.Len(err.(*GeocodeError).Candidates, 1)
+	}
+
+	_, err = g.Geocode(ctx, "Nowhere Lane")
+	assert.Equal(&GeocodeError{Code: GeocodeAddressNotFound}, err)
+
+	_, err = g.LookupPlace(ctx, "bogus")
+	assert.Equal(&GeocodeError{Code: GeocodePlaceNotFound}, err)
+}
+
+func TestCreateOrderAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	g, closeServer := newTestGeocoder(t)
+	defer closeServer()
+
+	defer func(g Geocoder) { defaultGeocoder = g }(defaultGeocoder)
+	defaultGeocoder = g
+
+	srv := httptest.NewServer(Router())
+	defer srv.Close()
+	orderEndpoint := fmt.Sprintf("%s/%s", srv.URL, "order")
+
+	post := func(body string) (*http.Response, errorResponse) {
+		resp, err := srv.Client().Post(orderEndpoint, "application/json", strings.NewReader(body))
+		assert.Nil(err)
+
+		var errored errorResponse
+		if resp.StatusCode != http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&errored)
+		}
+
+		return resp, errored
+	}
+
+	resp, err := srv.Client().Post(orderEndpoint, "application/json", strings.NewReader(
+		`{"origin_address": "1 MG Road, Bangalore", "destination_place_id": "forum-mall"}`,
+	))
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var resolved ResolvedOrder
+	json.NewDecoder(resp.Body).Decode(&resolved)
+	assert.Equal(LatLng{"12.9757", "77.6011"}, resolved.Origin)
+	assert.Equal(LatLng{"12.9346", "77.6113"}, resolved.Destination)
+	assert.InDelta(6000, resolved.Distance, 1000)
+
+	// the inputs are stored along with the addresses they resolved to
+	order, err := defaultOrderStore.SelectOrder(resolved.Id)
+	assert.Nil(err)
+	assert.Equal("1 MG Road, Bangalore", order.OriginAddress)
+	assert.Equal("1, MG Road, Bengaluru, 560001, India", order.OriginFormattedAddress)
+	assert.Equal("", order.OriginPlaceId)
+	assert.Equal("forum-mall", order.DestinationPlaceId)
+	assert.Equal("Forum Mall, Koramangala, Bengaluru, India", order.DestinationFormattedAddress)
+
+	// coordinates and addresses mix
+	resp, _ = post(`{"origin": ["12.9734", "77.5910"], "destination_address": "1 MG Road, Bangalore"}`)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, errored := post(`{"origin": ["12.9734", "77.5910"], "destination_address": "Church Street"}`)
+	assert.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(GeocodeAmbiguous, errored.Error)
+	assert.Equal("destination", errored.Endpoint)
+	if assert.Len(errored.Candidates, 2) {
+		assert.Equal("church-st-blr", errored.Candidates[0].PlaceId)
+		assert.Equal("Church Street, Mysuru, India", errored.Candidates[1].FormattedAddress)
+	}
+
+	resp, errored = post(`{"origin_place_id": "bogus", "destination_place_id": "forum-mall"}`)
+	assert.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(errorResponse{Error: GeocodePlaceNotFound, Endpoint: "origin"}, errored)
+
+	resp, errored = post(`{"origin": ["12.9734", "77.5910"], "origin_address": "1 MG Road, Bangalore",
+		"destination": ["12.9527", "77.5848"]}`)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal("origin must be given by only one of lat, lng, address or place id", errored.Error)
+
+	// addresses are not resolved without a Google Maps API key
+	defaultGeocoder = nil
+	resp, errored = post(`{"origin_address": "1 MG Road, Bangalore", "destination_place_id": "forum-mall"}`)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(GeocodingDisabledError.Error(), errored.Error)
+}
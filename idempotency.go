@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader carries a client chosen key identifying a request across its retries
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader is set on a response replayed from a stored one
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultIdempotencyTTL is how long a stored response is replayed by default
+	DefaultIdempotencyTTL = 24 * time.Hour
+
+	// idempotencyLease bounds how long a key is held by a request which has not responded yet,
+	// so that a key reserved by a crashed replica becomes usable again
+	idempotencyLease = time.Minute
+
+	// idempotencySweepInterval is how often MemoryOrderStore drops expired keys. In between,
+	// an expired key is only replaced when reused
+	idempotencySweepInterval = time.Minute
+
+	// maxIdempotencyKeyLength matches the size of the `idempotency_keys.key` column
+	maxIdempotencyKeyLength = 255
+
+	// maxIdempotentBodySize bounds the body of a request made with an idempotency key,
+	// which is read into memory to be hashed
+	maxIdempotentBodySize = 1 << 20
+)
+
+// idempotencyTTL is how long a stored response is replayed to retries under the same key
+var idempotencyTTL = DefaultIdempotencyTTL
+
+// IdempotencyRecord is the stored outcome of the first request made with an idempotency key
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+
+	// Status and Body are the response to the first request. Status is 0 while it is in progress
+	Status int
+	Body   []byte
+}
+
+// IdempotencyStore persists the responses to requests made with an idempotency key
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey reserves `key` for a request with hash `requestHash` for `lease`,
+	// and returns true. If the key is already reserved or has a stored response which has not
+	// expired, it returns false along with the stored record
+	ReserveIdempotencyKey(key, requestHash string, lease time.Duration) (IdempotencyRecord, bool, error)
+
+	// SaveIdempotentResponse stores the response to the request holding `key`, to be replayed
+	// for `ttl`
+	SaveIdempotentResponse(key string, status int, body []byte, ttl time.Duration) error
+
+	// ReleaseIdempotencyKey frees a key reserved by a request whose response is not stored
+	ReleaseIdempotencyKey(key string) error
+}
+
+// hashRequest identifies the method, path and body of a request
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// withIdempotency makes a handler safe to retry with an Idempotency-Key header.
+//
+// The response to the first request made with a key is stored along with a hash of the request,
+// and replayed to retries for idempotencyTTL. A retry with a different request is rejected with
+// a 422, and a retry while the first request is in progress with a 409. Server errors are not
+// stored, so the request may be retried under the same key
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest,
+				fmt.Sprintf("%s must be at most %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body must be at most %d bytes", maxIdempotentBodySize))
+			return
+		}
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		hash := hashRequest(r, body)
+		record, reserved, err := defaultIdempotencyStore.ReserveIdempotencyKey(key, hash, idempotencyLease)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if !reserved {
+			switch {
+			case record.RequestHash != hash:
+				writeError(w, http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED")
+			case record.Status == 0:
+				writeError(w, http.StatusConflict, "IDEMPOTENT_REQUEST_IN_PROGRESS")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(record.Status)
+				w.Write(record.Body)
+			}
+
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			err = defaultIdempotencyStore.ReleaseIdempotencyKey(key)
+		} else {
+			err = defaultIdempotencyStore.SaveIdempotentResponse(key, rec.status, rec.body.Bytes(), idempotencyTTL)
+		}
+
+		// the client already has its response, retries are refused until the lease expires
+		if err != nil {
+			log.Printf("failed to record the response for idempotency key %q: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateOrderIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+	orderEndpoint := fmt.Sprintf("%s/%s", srv.URL, "order")
+
+	post := func(key, body string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("POST", orderEndpoint, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, key)
+
+		resp, err := client.Do(req)
+		assert.Nil(err)
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp, respBody
+	}
+
+	key := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	body := `{"origin": ["12.9734", "77.5910"], "destination": ["12.9527", "77.5848"]}`
+
+	resp, first := post(key, body)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Empty(resp.Header.Get(IdempotentReplayedHeader))
+
+	// a retry gets the stored response instead of creating another order
+	resp, retried := post(key, body)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("true", resp.Header.Get(IdempotentReplayedHeader))
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(string(first), string(retried))
+
+	// another body under the same key is rejected
+	resp, respBody := post(key, `{"origin": ["12.9734", "77.5910"], "destination": ["13.0000", "77.6000"]}`)
+	assert.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Contains(string(respBody), "IDEMPOTENCY_KEY_REUSED")
+
+	// client errors are stored like any other response
+	badKey := key + "-bad"
+	resp, _ = post(badKey, `{"origin": ["91", "0"], "destination": ["0", "0"]}`)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = post(badKey, `{"origin": ["91", "0"], "destination": ["0", "0"]}`)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal("true", resp.Header.Get(IdempotentReplayedHeader))
+
+	resp, _ = post(strings.Repeat("k", maxIdempotencyKeyLength+1), body)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// the body is hashed in memory, so it is bounded
+	resp, respBody = post(key+"-large", `{"origin": "`+strings.Repeat("x", maxIdempotentBodySize)+`"}`)
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Contains(string(respBody), "request body must be at most")
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+
+	_, reserved, err := ms.ReserveIdempotencyKey("key", "hash", time.Minute)
+	assert.Nil(err)
+	assert.True(reserved)
+
+	// the key is held while the first request is in progress
+	record, reserved, err := ms.ReserveIdempotencyKey("key", "hash", time.Minute)
+	assert.Nil(err)
+	assert.False(reserved)
+	assert.Equal(0, record.Status)
+
+	// a released key may be reserved again
+	assert.Nil(ms.ReleaseIdempotencyKey("key"))
+	_, reserved, err = ms.ReserveIdempotencyKey("key", "hash", time.Minute)
+	assert.Nil(err)
+	assert.True(reserved)
+
+	assert.Nil(ms.SaveIdempotentResponse("key", http.StatusOK, []byte(`{"id":1}`), time.Millisecond))
+
+	// a stored response is not released
+	assert.Nil(ms.ReleaseIdempotencyKey("key"))
+	record, reserved, err = ms.ReserveIdempotencyKey("key", "other", time.Minute)
+	assert.Nil(err)
+	assert.False(reserved)
+	assert.Equal("hash", record.RequestHash)
+	assert.Equal(http.StatusOK, record.Status)
+	assert.Equal([]byte(`{"id":1}`), record.Body)
+
+	// once expired, the key is reserved for the new request
+	time.Sleep(5 * time.Millisecond)
+	_, reserved, err = ms.ReserveIdempotencyKey("key", "other", time.Minute)
+	assert.Nil(err)
+	assert.True(reserved)
+
+	// expired keys which are not reused are dropped by the next sweep
+	_, reserved, err = ms.ReserveIdempotencyKey("abandoned", "hash", time.Millisecond)
+	assert.Nil(err)
+	assert.True(reserved)
+	time.Sleep(5 * time.Millisecond)
+
+	ms.mu.Lock()
+	ms.sweepIdempotencyKeys(time.Now())
+	_, kept := ms.idempotencyKeys["abandoned"]
+	assert.False(kept)
+	assert.Len(ms.idempotencyKeys, 1)
+	ms.mu.Unlock()
+
+	assert.NotNil(ms.SaveIdempotentResponse("missing", http.StatusOK, nil, time.Minute))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	OrderStatusUnassign  = "UNASSIGN"
+	OrderStatusTaken     = "taken"
+	OrderStatusPickedUp  = "picked_up"
+	OrderStatusInTransit = "in_transit"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusFailed    = "failed"
+)
+
+// orderTransitions is the order lifecycle state machine. It maps every status
+// to the statuses an order may move to from it. Statuses without outgoing
+// transitions are terminal
+//
+//	UNASSIGN -> taken -> picked_up -> in_transit -> delivered
+//
+// a taken order may be released back to UNASSIGN, any order that has not been
+// delivered may be cancelled and an order that has been taken may fail
+var orderTransitions = map[string][]string{
+	OrderStatusUnassign:  {OrderStatusTaken, OrderStatusCancelled},
+	OrderStatusTaken:     {OrderStatusUnassign, OrderStatusPickedUp, OrderStatusCancelled, OrderStatusFailed},
+	OrderStatusPickedUp:  {OrderStatusInTransit, OrderStatusCancelled, OrderStatusFailed},
+	OrderStatusInTransit: {OrderStatusDelivered, OrderStatusCancelled, OrderStatusFailed},
+	OrderStatusDelivered: {},
+	OrderStatusCancelled: {},
+	OrderStatusFailed:    {},
+}
+
+// TransitionError is returned when an order cannot move from its current status to the requested one
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return "INVALID_STATUS_TRANSITION"
+}
+
+// IsValidOrderStatus returns if `status` is a known order status
+func IsValidOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// IsTerminalOrderStatus returns if no transition leads out of `status`
+func IsTerminalOrderStatus(status string) bool {
+	return IsValidOrderStatus(status) && len(orderTransitions[status]) == 0
+}
+
+// validateTransition checks an order's move from status `from` to status `to`
+// against the lifecycle state machine
+func validateTransition(from, to string) error {
+	if !IsValidOrderStatus(to) {
+		return fmt.Errorf("Unknown status: %s", to)
+	}
+
+	// keep reporting the historical errors for repeated takes and releases
+	if from == to {
+		switch to {
+		case OrderStatusTaken:
+			return OrderAlreadyTakenError
+		case OrderStatusUnassign:
+			return OrderAlreadyUnassignError
+		}
+	}
+
+	for _, allowed := range orderTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+
+	return &TransitionError{From: from, To: to}
+}
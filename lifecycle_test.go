@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTransition(t *testing.T) {
+	assert := assert.New(t)
+
+	allowed := [][2]string{
+		{OrderStatusUnassign, OrderStatusTaken},
+		{OrderStatusTaken, OrderStatusUnassign},
+		{OrderStatusTaken, OrderStatusPickedUp},
+		{OrderStatusPickedUp, OrderStatusInTransit},
+		{OrderStatusInTransit, OrderStatusDelivered},
+		{OrderStatusUnassign, OrderStatusCancelled},
+		{OrderStatusInTransit, OrderStatusCancelled},
+		{OrderStatusTaken, OrderStatusFailed},
+		{OrderStatusInTransit, OrderStatusFailed},
+	}
+
+	for _, tr := range allowed {
+		assert.Nil(validateTransition(tr[0], tr[1]), "%s -> %s", tr[0], tr[1])
+	}
+
+	refused := [][2]string{
+		{OrderStatusUnassign, OrderStatusPickedUp},
+		{OrderStatusUnassign, OrderStatusDelivered},
+		{OrderStatusUnassign, OrderStatusFailed},
+		{OrderStatusTaken, OrderStatusDelivered},
+		{OrderStatusPickedUp, OrderStatusUnassign},
+		{OrderStatusDelivered, OrderStatusCancelled},
+		{OrderStatusCancelled, OrderStatusUnassign},
+		{OrderStatusFailed, OrderStatusTaken},
+		{OrderStatusDelivered, OrderStatusDelivered},
+	}
+
+	for _, tr := range refused {
+		err := validateTransition(tr[0], tr[1])
+		assert.Equal(&TransitionError{From: tr[0], To: tr[1]}, err, "%s -> %s", tr[0], tr[1])
+	}
+
+	assert.Equal(OrderAlreadyTakenError, validateTransition(OrderStatusTaken, OrderStatusTaken))
+	assert.Equal(OrderAlreadyUnassignError, validateTransition(OrderStatusUnassign, OrderStatusUnassign))
+	assert.NotNil(validateTransition(OrderStatusUnassign, "bogus"))
+}
+
+func TestTerminalOrderStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, status := range []string{OrderStatusDelivered, OrderStatusCancelled, OrderStatusFailed} {
+		assert.True(IsTerminalOrderStatus(status))
+	}
+
+	for _, status := range []string{OrderStatusUnassign, OrderStatusTaken, OrderStatusInTransit, "bogus"} {
+		assert.False(IsTerminalOrderStatus(status))
+	}
+
+	// every status reachable in the state machine is itself part of it
+	for _, next := range orderTransitions {
+		for _, status := range next {
+			assert.True(IsValidOrderStatus(status))
+		}
+	}
+}
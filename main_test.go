@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var OriginLatLng = LatLng{"12.9734", "77.5910"}
@@ -18,9 +22,20 @@ var DestLatLng = LatLng{"12.9527", "77.5848"}
 // expected distance from Google Maps API between above two points
 var expectedDistance = 3527
 
-// tolerate a delta of this value when asserting route distance returned by Google Maps API
+// tolerate a delta of this value when asserting route distance returned by Google Maps API,
+// or estimated by the great-circle provider
 const DistanceToleranceThreshold = 500
 
+// testOrder is an unassigned order between the above two points, ready to insert
+func testOrder(distance int) ResolvedOrder {
+	return ResolvedOrder{
+		Origin:      OriginLatLng,
+		Destination: DestLatLng,
+		Status:      OrderStatusUnassign,
+		Distance:    distance,
+	}
+}
+
 func TestLatLngToString(t *testing.T) {
 	assert := assert.New(t)
 
@@ -57,40 +72,35 @@ func TestComputeDistance(t *testing.T) {
 	// freedom tower NYC
 	dest := DestLatLng.String()
 
-	d, err := computeDistance(origin, dest)
+	d, err := defaultDistanceProvider.Route(context.Background(), between(origin, dest))
 	assert.Nil(err)
 
 	assert.NotNil(d)
 	t.Logf("Distance %v", d)
 
 	// should be roughly expectedDistance meters with an allowance of DistanceToleranceThreshold
-	assert.InDelta(expectedDistance, d.Meters, DistanceToleranceThreshold)
+	assert.InDelta(expectedDistance, d.Distance.Meters, DistanceToleranceThreshold)
 }
 
 func TestOrderResolve(t *testing.T) {
 	assert := assert.New(t)
 
 	// first resolve an order
-	o := Order{OriginLatLng, DestLatLng}
-	resolved, err := o.Resolve()
+	o := Order{Origin: OriginLatLng, Destination: DestLatLng}
+	resolved, err := o.Resolve(context.Background())
 
 	assert.Nil(err)
 	assert.NotNil(resolved, err)
 
-	// retreive the same order from the database
-	row := defaultOrderDatabase.db.QueryRow(
-		`SELECT origin, destination, distance, status from orders where id=$1`,
-		resolved.Id)
-
-	var origin, destination, status string
-	var distance int
-	row.Scan(&origin, &destination, &distance, &status)
+	// retreive the same order from the store
+	order, err := defaultOrderStore.SelectOrder(resolved.Id)
+	assert.Nil(err)
 
 	// ensure that order details match
-	assert.Equal(OriginLatLng.String(), origin)
-	assert.Equal(DestLatLng.String(), destination)
-	assert.InDelta(expectedDistance, distance, DistanceToleranceThreshold)
-	assert.Equal(OrderStatusUnassign, status)
+	assert.Equal(OriginLatLng.String(), order.Origin.String())
+	assert.Equal(DestLatLng.String(), order.Destination.String())
+	assert.InDelta(expectedDistance, order.Distance, DistanceToleranceThreshold)
+	assert.Equal(OrderStatusUnassign, order.Status)
 }
 
 func TestCreateOrderValidInput(t *testing.T) {
@@ -123,6 +133,87 @@ func TestCreateOrderValidInput(t *testing.T) {
 	assert.Equal(OrderStatusUnassign, resolved.Status)
 }
 
+func TestCreateOrderDepartureTime(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(Router())
+	defer srv.Close()
+	orderEndpoint := fmt.Sprintf("%s/%s", srv.URL, "order")
+
+	departure := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	body := fmt.Sprintf(`{
+		"origin": ["12.9734", "77.5910"],
+		"destination": ["12.9527", "77.5848"],
+		"departure_time": %q
+	}`, departure.Format(time.RFC3339))
+
+	resp, err := srv.Client().Post(orderEndpoint, "application/json", strings.NewReader(body))
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var resolved ResolvedOrder
+	json.NewDecoder(resp.Body).Decode(&resolved)
+
+	// the great-circle estimate knows the usual travel time only
+	assert.True(resolved.DurationS > 0)
+	assert.Equal(0, resolved.DurationInTrafficS)
+	if assert.NotNil(resolved.DepartureTime) && assert.NotNil(resolved.ETA) {
+		assert.True(departure.Equal(*resolved.DepartureTime))
+		assert.Equal(time.Duration(resolved.DurationS)*time.Second, resolved.ETA.Sub(departure))
+	}
+
+	order, err := defaultOrderStore.SelectOrder(resolved.Id)
+	assert.Nil(err)
+	assert.Equal(resolved.DurationS, order.DurationS)
+	assert.Equal(resolved.ETA, order.ETA)
+
+	// orders leaving now are expected after their travel time from creation
+	o := Order{Origin: OriginLatLng, Destination: DestLatLng}
+	resolved, err = o.Resolve(context.Background())
+	assert.Nil(err)
+	assert.Nil(resolved.DepartureTime)
+
+	order, err = defaultOrderStore.SelectOrder(resolved.Id)
+	assert.Nil(err)
+	if assert.NotNil(order.ETA) {
+		assert.Equal(time.Duration(order.DurationS)*time.Second, order.ETA.Sub(*order.CreatedAt))
+	}
+}
+
+func TestCreateOrderTravelMode(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(Router())
+	defer srv.Close()
+	orderEndpoint := fmt.Sprintf("%s/%s", srv.URL, "order")
+
+	create := func(body string) ResolvedOrder {
+		resp, err := srv.Client().Post(orderEndpoint, "application/json", strings.NewReader(body))
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		var resolved ResolvedOrder
+		json.NewDecoder(resp.Body).Decode(&resolved)
+		return resolved
+	}
+
+	// orders are driven unless told otherwise
+	driven := create(`{"origin": ["12.9734", "77.5910"], "destination": ["12.9527", "77.5848"]}`)
+	assert.Equal(TravelModeDriving, driven.Mode)
+	assert.Empty(driven.Avoid)
+
+	cycled := create(`{"origin": ["12.9734", "77.5910"], "destination": ["12.9527", "77.5848"],
+		"mode": "bicycling", "avoid": ["tolls", "ferries", "tolls"]}`)
+	assert.Equal(TravelModeBicycling, cycled.Mode)
+	assert.Equal([]string{AvoidFerries, AvoidTolls}, cycled.Avoid)
+	assert.True(cycled.DurationS > driven.DurationS)
+
+	order, err := defaultOrderStore.SelectOrder(cycled.Id)
+	assert.Nil(err)
+	assert.Equal(TravelModeBicycling, order.Mode)
+	assert.Equal([]string{AvoidFerries, AvoidTolls}, order.Avoid)
+}
+
 func TestCreateOrderInvalidInput(t *testing.T) {
 	assert := assert.New(t)
 
@@ -173,6 +264,33 @@ func TestCreateOrderInvalidInput(t *testing.T) {
 		}`),
 			"json: cannot unmarshal",
 		},
+
+		testCase{
+			[]byte(`{
+			"origin": ["12.9734", "77.5910"],
+			"destination": ["12.9527", "77.5848"],
+			"departure_time": "2001-01-01T00:00:00Z"
+		}`),
+			"departure_time must not be in the past",
+		},
+
+		testCase{
+			[]byte(`{
+			"origin": ["12.9734", "77.5910"],
+			"destination": ["12.9527", "77.5848"],
+			"mode": "flying"
+		}`),
+			"Unknown travel mode: flying",
+		},
+
+		testCase{
+			[]byte(`{
+			"origin": ["12.9734", "77.5910"],
+			"destination": ["12.9527", "77.5848"],
+			"avoid": ["tolls", "potholes"]
+		}`),
+			"Unknown avoid option: potholes",
+		},
 	}
 
 	orderEndpoint := fmt.Sprintf("%s/%s", srv.URL, "order")
@@ -197,19 +315,19 @@ func TestUpdateOrderValidInput(t *testing.T) {
 	assert := assert.New(t)
 
 	// first insert an order
-	id, _ := defaultOrderDatabase.InsertOrder(
-		OriginLatLng.String(), DestLatLng.String(), OrderStatusUnassign, 1000,
-	)
+	id, _ := defaultOrderStore.InsertOrder(testOrder(1000))
 
 	// take the order
 	r := Router()
 	srv := httptest.NewServer(r)
 	client := srv.Client()
 	orderEndpoint := fmt.Sprintf("%s/%s/%d", srv.URL, "order", id)
+	courierId := newTestCourier(t)
 
 	// UNASSIGNing it should cause a conflict
-	putData := []byte(`{"status": "UNASSIGN"}`)
+	putData := []byte(fmt.Sprintf(`{"status": "UNASSIGN", "courier_id": %d}`, courierId))
 	req, _ := http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader(putData))
+	req.Header.Set(CourierTokenHeader, testCourierToken)
 
 	resp, _ := client.Do(req)
 	assert.Equal(http.StatusConflict, resp.StatusCode)
@@ -218,8 +336,9 @@ func TestUpdateOrderValidInput(t *testing.T) {
 	assert.Equal("{\"error\":\"ORDER_ALREADY_UNASSIGN\"}\n", string(respBody))
 
 	// take the order
-	putData = []byte(`{"status": "taken"}`)
+	putData = []byte(fmt.Sprintf(`{"status": "taken", "courier_id": %d}`, courierId))
 	req, _ = http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader(putData))
+	req.Header.Set(CourierTokenHeader, testCourierToken)
 
 	resp, _ = client.Do(req)
 	assert.Equal(http.StatusOK, resp.StatusCode)
@@ -229,6 +348,7 @@ func TestUpdateOrderValidInput(t *testing.T) {
 
 	// taking it again should cause a 409 Conflict response
 	req, _ = http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader(putData))
+	req.Header.Set(CourierTokenHeader, testCourierToken)
 	resp, _ = client.Do(req)
 	assert.Equal(http.StatusConflict, resp.StatusCode)
 	assert.Equal("application/json", resp.Header.Get("Content-Type"))
@@ -236,8 +356,9 @@ func TestUpdateOrderValidInput(t *testing.T) {
 	assert.Equal("{\"error\":\"ORDER_ALREADY_BEEN_TAKEN\"}\n", string(respBody))
 
 	// unassign the order
-	putData = []byte(`{"status": "UNASSIGN"}`)
+	putData = []byte(fmt.Sprintf(`{"status": "UNASSIGN", "courier_id": %d}`, courierId))
 	req, _ = http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader(putData))
+	req.Header.Set(CourierTokenHeader, testCourierToken)
 	resp, _ = client.Do(req)
 	assert.Equal(http.StatusOK, resp.StatusCode)
 	assert.Equal("application/json", resp.Header.Get("Content-Type"))
@@ -246,6 +367,7 @@ func TestUpdateOrderValidInput(t *testing.T) {
 
 	// second UNASSIGN should cause a conflict
 	req, _ = http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader(putData))
+	req.Header.Set(CourierTokenHeader, testCourierToken)
 	resp, _ = client.Do(req)
 	assert.Equal(http.StatusConflict, resp.StatusCode)
 	assert.Equal("application/json", resp.Header.Get("Content-Type"))
@@ -253,6 +375,179 @@ func TestUpdateOrderValidInput(t *testing.T) {
 	assert.Equal("{\"error\":\"ORDER_ALREADY_UNASSIGN\"}\n", string(respBody))
 }
 
+func TestUpdateOrderLifecycle(t *testing.T) {
+	assert := assert.New(t)
+
+	id, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	client := srv.Client()
+	orderEndpoint := fmt.Sprintf("%s/%s/%d", srv.URL, "order", id)
+	courierId := newTestCourier(t)
+
+	put := func(status string) (int, string) {
+		putData := []byte(fmt.Sprintf(`{"status": "%s", "courier_id": %d}`, status, courierId))
+		req, _ := http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader(putData))
+		req.Header.Set(CourierTokenHeader, testCourierToken)
+		resp, _ := client.Do(req)
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(respBody)
+	}
+
+	// an unassigned order cannot skip ahead in its lifecycle
+	code, body := put(OrderStatusDelivered)
+	assert.Equal(http.StatusConflict, code)
+	assert.Equal("{\"error\":\"INVALID_STATUS_TRANSITION\",\"current_status\":\"UNASSIGN\"}\n", body)
+
+	for _, status := range []string{
+		OrderStatusTaken, OrderStatusPickedUp, OrderStatusInTransit, OrderStatusDelivered,
+	} {
+		code, body = put(status)
+		assert.Equal(http.StatusOK, code)
+		assert.Equal("{\"status\":\"SUCCESS\"}\n", body)
+	}
+
+	// delivered is terminal
+	code, body = put(OrderStatusUnassign)
+	assert.Equal(http.StatusConflict, code)
+	assert.Contains(body, "\"current_status\":\"delivered\"")
+
+	order, _ := defaultOrderStore.SelectOrder(id)
+	assert.Equal(OrderStatusDelivered, order.Status)
+}
+
+func TestOrderHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	id, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	client := srv.Client()
+	orderEndpoint := fmt.Sprintf("%s/%s/%d", srv.URL, "order", id)
+	historyEndpoint := fmt.Sprintf("%s/history", orderEndpoint)
+
+	// a new order's history records its creation
+	resp, err := client.Get(historyEndpoint)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	var events []OrderEvent
+	json.Unmarshal(respBody, &events)
+	if assert.Len(events, 1) {
+		assert.Equal(OrderEventCreated, events[0].Type)
+		assert.Equal("", events[0].From)
+		assert.Equal(OrderStatusUnassign, events[0].To)
+	}
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "let-me-in"
+
+	// take the order with a request id, then release it as an admin without one
+	courierId := newTestCourier(t)
+	take := fmt.Sprintf(`{"status": "taken", "courier_id": %d}`, courierId)
+	release := fmt.Sprintf(`{"status": "UNASSIGN", "courier_id": %d}`, courierId)
+
+	req, _ := http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader([]byte(take)))
+	req.Header.Set(CourierTokenHeader, testCourierToken)
+	req.Header.Set(ActorHeader, "courier-7")
+	req.Header.Set(RequestIdHeader, "req-take")
+	resp, _ = client.Do(req)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("req-take", resp.Header.Get(RequestIdHeader))
+
+	req, _ = http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader([]byte(release)))
+	req.Header.Set(AdminTokenHeader, adminToken)
+	req.Header.Set(ActorHeader, "dispatch")
+	resp, _ = client.Do(req)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	generatedId := resp.Header.Get(RequestIdHeader)
+	assert.NotEmpty(generatedId)
+
+	// refused transitions are not recorded
+	req, _ = http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader([]byte(release)))
+	req.Header.Set(CourierTokenHeader, testCourierToken)
+	resp, _ = client.Do(req)
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+
+	resp, _ = client.Get(historyEndpoint)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	respBody, _ = ioutil.ReadAll(resp.Body)
+
+	events = nil
+	json.Unmarshal(respBody, &events)
+	if assert.Len(events, 3) {
+		assert.Equal(OrderEvent{
+			Id: events[1].Id, Type: OrderStatusTaken,
+			OrderId: id, From: OrderStatusUnassign, To: OrderStatusTaken,
+			Actor: fmt.Sprintf("courier:%d/courier-7", courierId), RequestId: "req-take", CreatedAt: events[1].CreatedAt,
+		}, events[1])
+		assert.Equal(OrderEvent{
+			Id: events[2].Id, Type: OrderEventReleased,
+			OrderId: id, From: OrderStatusTaken, To: OrderStatusUnassign,
+			Actor: "admin/dispatch", RequestId: generatedId, CreatedAt: events[2].CreatedAt,
+		}, events[2])
+		assert.True(events[0].Id < events[1].Id && events[1].Id < events[2].Id)
+	}
+
+	resp, _ = client.Get(fmt.Sprintf("%s/%s/%d/history", srv.URL, "order", 99999))
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// overlong request ids and actor labels are refused before anything is recorded
+	for header, length := range map[string]int{RequestIdHeader: maxRequestIdLength, ActorHeader: maxActorLength} {
+		req, _ = http.NewRequest(http.MethodPut, orderEndpoint, bytes.NewReader([]byte(take)))
+		req.Header.Set(CourierTokenHeader, testCourierToken)
+		req.Header.Set(header, strings.Repeat("a", length+1))
+		resp, _ = client.Do(req)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, header)
+	}
+
+	resp, _ = client.Get(historyEndpoint)
+	respBody, _ = ioutil.ReadAll(resp.Body)
+	events = nil
+	json.Unmarshal(respBody, &events)
+	assert.Len(events, 3)
+}
+
+func TestGetOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	id, _ := defaultOrderStore.InsertOrder(testOrder(1000))
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	client := srv.Client()
+
+	resp, err := client.Get(fmt.Sprintf("%s/%s/%d", srv.URL, "order", id))
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	var order ResolvedOrder
+	json.Unmarshal(respBody, &order)
+
+	assert.Equal(id, order.Id)
+	assert.Equal(OriginLatLng, order.Origin)
+	assert.Equal(DestLatLng, order.Destination)
+	assert.Equal(1000, order.Distance)
+	assert.Equal(OrderStatusUnassign, order.Status)
+	assert.NotNil(order.CreatedAt)
+	assert.NotNil(order.UpdatedAt)
+
+	for _, missing := range []string{"99999", "-999", "0"} {
+		resp, _ = client.Get(fmt.Sprintf("%s/%s/%s", srv.URL, "order", missing))
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+		respBody, _ = ioutil.ReadAll(resp.Body)
+		assert.Contains(string(respBody), "No order present with id")
+	}
+
+	resp, _ = client.Get(fmt.Sprintf("%s/%s/%s", srv.URL, "order", "43.5466"))
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
 func TestUpdateOrderInvalidInput(t *testing.T) {
 	assert := assert.New(t)
 
@@ -343,6 +638,164 @@ func TestListOrdersInvalidInput(t *testing.T) {
 	}
 }
 
+func TestListOrdersEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 3; i++ {
+		_, err := defaultOrderStore.InsertOrder(testOrder(i))
+		assert.Nil(err)
+	}
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	client := srv.Client()
+
+	resp, err := client.Get(fmt.Sprintf("%s/orders?page=2&limit=1", srv.URL))
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Contains(resp.Header.Get("Link"), `</orders?limit=1&page=3>; rel="next"`)
+	assert.Contains(resp.Header.Get("Link"), `</orders?limit=1&page=1>; rel="prev"`)
+
+	var page orderListPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	assert.Len(page.Data, 1)
+	assert.Equal(2, page.Page)
+	assert.Equal(1, page.Limit)
+	assert.True(page.Total >= 3)
+	assert.Equal(page.Total, page.TotalPages)
+	assert.Equal("/orders?limit=1&page=1", page.Links.First)
+	assert.Equal(fmt.Sprintf("/orders?limit=1&page=%d", page.TotalPages), page.Links.Last)
+
+	// the last page has no next page
+	resp, err = client.Get(srv.URL + page.Links.Last)
+	assert.Nil(err)
+	assert.NotContains(resp.Header.Get("Link"), `rel="next"`)
+
+	// old clients can still ask for a bare array
+	resp, err = client.Get(fmt.Sprintf("%s/orders?page=2&limit=1&envelope=false", srv.URL))
+	assert.Nil(err)
+	var orders []ResolvedOrder
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&orders))
+	assert.Len(orders, 1)
+	assert.Equal(page.Data[0].Id, orders[0].Id)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/orders?page=2&limit=1", srv.URL), nil)
+	req.Header.Set("Accept", OrdersV1MediaType)
+	resp, err = client.Do(req)
+	assert.Nil(err)
+	orders = nil
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&orders))
+	assert.Len(orders, 1)
+
+	resp, err = client.Get(fmt.Sprintf("%s/orders?envelope=maybe", srv.URL))
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestListOrdersFilters(t *testing.T) {
+	assert := assert.New(t)
+
+	id, err := defaultOrderStore.InsertOrder(testOrder(987654))
+	assert.Nil(err)
+	taken := StatusUpdate{Status: OrderStatusTaken, CourierId: newTestCourier(t)}
+	assert.Nil(defaultOrderStore.UpdateOrderStatus(id, taken))
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	client := srv.Client()
+
+	for _, mode := range []string{"page=1", "cursor="} {
+		resp, err := client.Get(fmt.Sprintf("%s/orders?%s&status=taken,picked_up&min_distance=987654"+
+			"&origin_near=12.9734,77.5910,10", srv.URL, mode))
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		var page orderListPage
+		json.NewDecoder(resp.Body).Decode(&page)
+		if assert.Len(page.Data, 1, mode) {
+			assert.Equal(id, page.Data[0].Id)
+		}
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s/orders?sort=-distance&limit=1&page=1", srv.URL))
+	assert.Nil(err)
+	var page orderListPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	if assert.Len(page.Data, 1) {
+		assert.Equal(id, page.Data[0].Id)
+	}
+
+	for _, bad := range []string{
+		"status=shipped",
+		"min_distance=-1",
+		"created_since=yesterday",
+		"origin_bbox=1,2,3",
+		"sort=status",
+		"cursor=&sort=distance",
+	} {
+		resp, err := client.Get(fmt.Sprintf("%s/orders?%s", srv.URL, bad))
+		assert.Nil(err)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, bad)
+	}
+}
+
+func TestListOrdersByCursor(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 5; i++ {
+		_, err := defaultOrderStore.InsertOrder(testOrder(i))
+		assert.Nil(err)
+	}
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	client := srv.Client()
+
+	// walking through every page lists each order once, in creation order
+	seen := make(map[int]bool)
+	lastId := 0
+	cursor := ""
+	for pages := 0; pages < 1000; pages++ {
+		ordersEndpoint := fmt.Sprintf("%s/orders?limit=2&cursor=%s", srv.URL, cursor)
+		resp, err := client.Get(ordersEndpoint)
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		var page orderCursorPage
+		json.NewDecoder(resp.Body).Decode(&page)
+		assert.True(len(page.Data) <= 2)
+
+		for _, order := range page.Data {
+			assert.False(seen[order.Id])
+			assert.True(order.Id > lastId)
+			assert.NotNil(order.CreatedAt)
+
+			seen[order.Id] = true
+			lastId = order.Id
+		}
+
+		if page.NextCursor == "" {
+			assert.Empty(resp.Header.Get("Link"))
+			break
+		}
+
+		assert.Equal(fmt.Sprintf(`<%s>; rel="next"`, page.Links.Next), resp.Header.Get("Link"))
+		cursor = page.NextCursor
+	}
+
+	// the listing leaves out cancelled orders
+	listed := OrderQuery{ExcludedStatuses: []string{OrderStatusCancelled}}
+	orders, err := defaultOrderStore.RetrieveOrdersAfter(listed, nil, len(seen)+1)
+	assert.Nil(err)
+	assert.Len(orders, len(seen))
+
+	for _, bad := range []string{"cursor=bogus", "cursor=&limit=0", "cursor=&limit=asd"} {
+		resp, err := client.Get(fmt.Sprintf("%s/orders?%s", srv.URL, bad))
+		assert.Nil(err)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, bad)
+	}
+}
+
 func TestRouting(t *testing.T) {
 	assert := assert.New(t)
 
@@ -378,9 +831,41 @@ func TestRouting(t *testing.T) {
 	assert.Equal(http.StatusNotFound, resp.StatusCode)
 }
 
+// restoreConnectors returns a function restoring the package level connectors initialized
+// by setup, for tests which call setup with their own configuration
+func restoreConnectors() func() {
+	orders, webhooks, couriers, idempotency := defaultOrderStore, defaultWebhookStore, defaultCourierStore,
+		defaultIdempotencyStore
+	client, cache, provider, geocoder := mapsClient, defaultDistanceCache, defaultDistanceProvider, defaultGeocoder
+	ttl, token := idempotencyTTL, adminToken
+
+	return func() {
+		defaultOrderStore, defaultWebhookStore, defaultCourierStore, defaultIdempotencyStore =
+			orders, webhooks, couriers, idempotency
+		mapsClient, defaultDistanceCache, defaultDistanceProvider, defaultGeocoder = client, cache, provider, geocoder
+		idempotencyTTL, adminToken = ttl, token
+	}
+}
+
 func TestMain(m *testing.M) {
-	// override database for testing
-	defaultOrderDatabase, _ = NewOrderDatabase("localhost")
+	// tests run offline against the in-memory store unless the environment selects
+	// e.g. ORDERS_STORE=postgres or ORDERS_DISTANCE_PROVIDER=google
+	cfg := DefaultConfig()
+	cfg.Store = OrderStoreMemory
+	cfg.Distance.Provider = DistanceProviderGreatCircle
+	cfg.MigrateOnStartup = true
+
+	if err := cfg.loadEnv(os.Getenv); err != nil {
+		log.Fatalf("invalid test configuration: %s", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid test configuration: %s", err)
+	}
+
+	if err := setup(cfg); err != nil {
+		log.Fatal(err)
+	}
 
 	os.Exit(m.Run())
 }
@@ -0,0 +1,923 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+// memoryOrder is the in-memory equivalent of a row in the `orders` table
+type memoryOrder struct {
+	id          int
+	origin      LatLng
+	destination LatLng
+	distance    int
+	status      string
+	courierId   int
+	version     int
+	createdAt   time.Time
+	updatedAt   time.Time
+
+	durationS          int
+	durationInTrafficS int
+	departureTime      time.Time
+
+	mode  string
+	avoid []string
+
+	originAddress               string
+	originPlaceId               string
+	originFormattedAddress      string
+	destinationAddress          string
+	destinationPlaceId          string
+	destinationFormattedAddress string
+}
+
+// resolve converts a memoryOrder into a ResolvedOrder
+func (o *memoryOrder) resolve() ResolvedOrder {
+	createdAt, updatedAt := o.createdAt, o.updatedAt
+
+	resolved := ResolvedOrder{
+		Id:          o.id,
+		Distance:    o.distance,
+		Status:      o.status,
+		Origin:      o.origin,
+		Destination: o.destination,
+		CreatedAt:   &createdAt,
+		UpdatedAt:   &updatedAt,
+
+		AssignedCourierId: o.courierId,
+		Version:           o.version,
+
+		DurationS:          o.durationS,
+		DurationInTrafficS: o.durationInTrafficS,
+
+		Mode:  o.mode,
+		Avoid: o.avoid,
+
+		OriginAddress:               o.originAddress,
+		OriginPlaceId:               o.originPlaceId,
+		OriginFormattedAddress:      o.originFormattedAddress,
+		DestinationAddress:          o.destinationAddress,
+		DestinationPlaceId:          o.destinationPlaceId,
+		DestinationFormattedAddress: o.destinationFormattedAddress,
+	}
+
+	departure := createdAt
+	if !o.departureTime.IsZero() {
+		departure = o.departureTime
+		resolved.DepartureTime = &departure
+	}
+
+	resolved.setETA(departure)
+	return resolved
+}
+
+// MemoryOrderStore is an OrderStore which keeps orders in process memory.
+// It requires no external services, which makes it suitable for local development
+// and tests. Orders are lost when the process exits
+type MemoryOrderStore struct {
+	mu sync.Mutex
+
+	// orders are kept in insertion order, the order with id N lives at index N-1
+	orders []*memoryOrder
+
+	// events are kept in insertion order, the event with id N lives at index N-1
+	events []OrderEvent
+
+	// Publish, if set, is called with every new event
+	Publish func(OrderEvent)
+
+	// webhooks are kept in insertion order, the subscription with id N lives at index N-1.
+	// Deleted subscriptions are nil
+	webhooks []*WebhookSubscription
+
+	// deliveries is the webhook outbox, in id order
+	deliveries     []*memoryDelivery
+	lastDeliveryId int
+
+	deadLetters      []WebhookDeadLetter
+	lastDeadLetterId int
+
+	// couriers are kept in insertion order, the courier with id N lives at index N-1
+	couriers []*Courier
+
+	// CourierCapacity is the number of orders a courier may hold at once,
+	// unless the courier has its own capacity
+	CourierCapacity int
+
+	idempotencyKeys map[string]*memoryIdempotencyKey
+
+	// idempotencySweptAt is when expired idempotency keys were last dropped
+	idempotencySweptAt time.Time
+}
+
+// memoryIdempotencyKey is the in-memory equivalent of a row in the `idempotency_keys` table
+type memoryIdempotencyKey struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// memoryDelivery is the in-memory equivalent of a row in the `webhook_deliveries` table
+type memoryDelivery struct {
+	id             int
+	subscriptionId int
+	eventId        int64
+	attempts       int
+	nextAttemptAt  time.Time
+	lastError      string
+}
+
+// NewMemoryOrderStore creates an empty MemoryOrderStore
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{
+		CourierCapacity: DefaultCourierCapacity,
+		idempotencyKeys: make(map[string]*memoryIdempotencyKey),
+	}
+}
+
+// lookup returns the order with the given id. The caller must hold ms.mu
+func (ms *MemoryOrderStore) lookup(orderId int) (*memoryOrder, error) {
+	if orderId <= 0 || orderId > len(ms.orders) {
+		return nil, sql.ErrNoRows
+	}
+
+	return ms.orders[orderId-1], nil
+}
+
+// SelectOrder selects an order by id
+func (ms *MemoryOrderStore) SelectOrder(orderId int) (order ResolvedOrder, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	o, err := ms.lookup(orderId)
+	if err != nil {
+		return
+	}
+
+	order = o.resolve()
+	log.Printf("retrieved order: %d, status: %s", orderId, order.Status)
+	return
+}
+
+// InsertOrder inserts an order, assigning it the next sequential id
+func (ms *MemoryOrderStore) InsertOrder(order ResolvedOrder) (orderId int, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	orderId = len(ms.orders) + 1
+	o := &memoryOrder{
+		id:          orderId,
+		origin:      order.Origin,
+		destination: order.Destination,
+		distance:    order.Distance,
+		status:      order.Status,
+		version:     1,
+		createdAt:   now,
+		updatedAt:   now,
+
+		durationS:          order.DurationS,
+		durationInTrafficS: order.DurationInTrafficS,
+
+		mode:  order.Mode,
+		avoid: normalizeAvoid(order.Avoid),
+
+		originAddress:               order.OriginAddress,
+		originPlaceId:               order.OriginPlaceId,
+		originFormattedAddress:      order.OriginFormattedAddress,
+		destinationAddress:          order.DestinationAddress,
+		destinationPlaceId:          order.DestinationPlaceId,
+		destinationFormattedAddress: order.DestinationFormattedAddress,
+	}
+	if o.mode == "" {
+		o.mode = TravelModeDriving
+	}
+	if order.DepartureTime != nil {
+		o.departureTime = *order.DepartureTime
+	}
+
+	ms.orders = append(ms.orders, o)
+	ms.record(OrderEvent{OrderId: orderId, To: order.Status, CreatedAt: now})
+
+	log.Printf("new order created: %d", orderId)
+	return
+}
+
+// UpdateOrderStatus moves an order to a new status, following the lifecycle
+// state machine defined in lifecycle.go, and records the transition in the order's history
+//
+// The store-wide mutex plays the role of the row-level lock taken by OrderDatabase:
+// if two requests try to update the same order, first one to acquire the lock wins
+func (ms *MemoryOrderStore) UpdateOrderStatus(orderId int, update StatusUpdate) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	o, err := ms.lookup(orderId)
+	if err != nil {
+		return err
+	}
+
+	if err := checkVersion(o.version, update); err != nil {
+		return err
+	}
+
+	if err := validateTransition(o.status, update.Status); err != nil {
+		return err
+	}
+
+	if err := authorizeUpdate(o.status, o.courierId, update); err != nil {
+		return err
+	}
+
+	if update.Status == OrderStatusTaken {
+		c, err := ms.lookupCourier(update.CourierId)
+		if err == sql.ErrNoRows {
+			return CourierNotFoundError
+		}
+
+		if !c.Active {
+			return CourierInactiveError
+		}
+
+		if ms.heldOrders(c.Id) >= c.capacity(ms.CourierCapacity) {
+			return CourierAtCapacityError
+		}
+	}
+
+	now := time.Now()
+	ms.record(OrderEvent{
+		OrderId:   orderId,
+		From:      o.status,
+		To:        update.Status,
+		Actor:     update.Actor,
+		RequestId: update.RequestId,
+		Reason:    update.Reason,
+		Note:      update.Note,
+		CreatedAt: now,
+	})
+
+	o.status = update.Status
+	o.courierId = assigneeAfter(o.courierId, update)
+	o.version++
+	o.updatedAt = now
+	return nil
+}
+
+// ReleaseStaleOrders returns up to `limit` orders which have been `taken` for longer than
+// `holdTimeout` to UNASSIGN, longest held first
+func (ms *MemoryOrderStore) ReleaseStaleOrders(holdTimeout time.Duration, limit int) ([]int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	stale := []*memoryOrder{}
+	for _, o := range ms.orders {
+		if o.status == OrderStatusTaken && now.Sub(o.updatedAt) > holdTimeout {
+			stale = append(stale, o)
+		}
+	}
+
+	sort.Slice(stale, func(i, j int) bool { return stale[i].updatedAt.Before(stale[j].updatedAt) })
+	if len(stale) > limit {
+		stale = stale[:limit]
+	}
+
+	released := []int{}
+	for _, o := range stale {
+		ms.record(OrderEvent{
+			OrderId:   o.id,
+			From:      o.status,
+			To:        OrderStatusUnassign,
+			Actor:     reaperActor,
+			Reason:    ReleaseReasonHoldTimeout,
+			CreatedAt: now,
+		})
+
+		o.status = OrderStatusUnassign
+		o.courierId = 0
+		o.version++
+		o.updatedAt = now
+		released = append(released, o.id)
+	}
+
+	return released, nil
+}
+
+// record assigns an event the next sequential id, stores it, queues it for the webhook
+// subscriptions wanting it and publishes it. The caller must hold ms.mu
+func (ms *MemoryOrderStore) record(e OrderEvent) {
+	e.Id = int64(len(ms.events) + 1)
+	e.Type = orderEventType(e.From, e.To)
+	ms.events = append(ms.events, e)
+
+	for _, sub := range ms.webhooks {
+		if sub != nil && sub.wants(e.Type) {
+			ms.enqueue(sub.Id, e.Id)
+		}
+	}
+
+	if ms.Publish != nil {
+		ms.Publish(e)
+	}
+}
+
+// OrderHistory retrieves the creation and status transitions of an order, oldest first
+func (ms *MemoryOrderStore) OrderHistory(orderId int) ([]OrderEvent, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, err := ms.lookup(orderId); err != nil {
+		return nil, err
+	}
+
+	events := []OrderEvent{}
+	for _, e := range ms.events {
+		if e.OrderId == orderId {
+			events = append(events, e)
+		}
+	}
+
+	return events, nil
+}
+
+// EventsSince retrieves up to `limit` events with an id greater than `afterId`, oldest first
+func (ms *MemoryOrderStore) EventsSince(afterId int64, limit int) ([]OrderEvent, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	events := []OrderEvent{}
+	if afterId >= int64(len(ms.events)) {
+		return events, nil
+	}
+
+	if afterId < 0 {
+		afterId = 0
+	}
+
+	for _, e := range ms.events[afterId:] {
+		if len(events) == limit {
+			break
+		}
+
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// selectOrders returns the orders selected by a query, sorted as requested.
+// The caller must hold ms.mu
+func (ms *MemoryOrderStore) selectOrders(q OrderQuery) []ResolvedOrder {
+	selected := []ResolvedOrder{}
+	for _, o := range ms.orders {
+		if order := o.resolve(); q.matches(order) {
+			selected = append(selected, order)
+		}
+	}
+
+	// orders are kept in id order, which is also their order of creation
+	s := q.sort()
+	if s != DefaultOrderSort {
+		sort.Slice(selected, func(i, j int) bool { return s.less(selected[i], selected[j]) })
+	}
+
+	return selected
+}
+
+// RetrieveOrders retrieves a page of the orders selected by a query given a limit i.e. page size,
+// and a page number, along with the total number of selected orders
+func (ms *MemoryOrderStore) RetrieveOrders(q OrderQuery, limit, page int) ([]ResolvedOrder, int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	selected := ms.selectOrders(q)
+	resolved := []ResolvedOrder{}
+
+	pageOffset := limit * (page - 1)
+	if pageOffset >= len(selected) {
+		return resolved, len(selected), nil
+	}
+
+	end := pageOffset + limit
+	if end > len(selected) {
+		end = len(selected)
+	}
+
+	for _, o := range selected[pageOffset:end] {
+		resolved = append(
+			resolved,
+			ResolvedOrder{Id: o.Id, Distance: o.Distance, Status: o.Status, Version: o.Version},
+		)
+	}
+
+	return resolved, len(selected), nil
+}
+
+// RetrieveOrdersAfter retrieves up to `limit` orders selected by a query positioned after a cursor
+func (ms *MemoryOrderStore) RetrieveOrdersAfter(q OrderQuery, after *OrderCursor, limit int) ([]ResolvedOrder, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	q.Sort = DefaultOrderSort
+
+	resolved := []ResolvedOrder{}
+	for _, o := range ms.selectOrders(q) {
+		if len(resolved) == limit {
+			break
+		}
+
+		if after != nil && !after.precedes(o) {
+			continue
+		}
+
+		resolved = append(
+			resolved,
+			ResolvedOrder{Id: o.Id, Distance: o.Distance, Status: o.Status, CreatedAt: o.CreatedAt, Version: o.Version},
+		)
+	}
+
+	return resolved, nil
+}
+
+// NearbyOrders retrieves up to `limit` UNASSIGN orders whose origin lies within `radius`
+// meters of `position`, nearest first
+func (ms *MemoryOrderStore) NearbyOrders(position maps.LatLng, radius float64, limit int) ([]NearbyOrder, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	nearby := []NearbyOrder{}
+	distances := make(map[int]float64)
+	for _, o := range ms.orders {
+		if o.status != OrderStatusUnassign {
+			continue
+		}
+
+		origin, err := parseLatLng(o.origin.String())
+		if err != nil {
+			return nil, err
+		}
+
+		d := haversine(position, origin)
+		if d <= radius {
+			distances[o.id] = d
+			nearby = append(nearby, NearbyOrder{ResolvedOrder: o.resolve(), DistanceToOrigin: int(math.Round(d))})
+		}
+	}
+
+	sort.Slice(nearby, func(i, j int) bool {
+		di, dj := distances[nearby[i].Id], distances[nearby[j].Id]
+		if di == dj {
+			return nearby[i].Id < nearby[j].Id
+		}
+
+		return di < dj
+	})
+
+	if len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+
+	return nearby, nil
+}
+
+// enqueue adds a delivery of an event to the webhook outbox. The caller must hold ms.mu
+func (ms *MemoryOrderStore) enqueue(subscriptionId int, eventId int64) {
+	ms.lastDeliveryId++
+	ms.deliveries = append(ms.deliveries, &memoryDelivery{
+		id:             ms.lastDeliveryId,
+		subscriptionId: subscriptionId,
+		eventId:        eventId,
+		nextAttemptAt:  time.Now(),
+	})
+}
+
+// lookupWebhook returns the subscription with the given id. The caller must hold ms.mu
+func (ms *MemoryOrderStore) lookupWebhook(id int) (*WebhookSubscription, error) {
+	if id <= 0 || id > len(ms.webhooks) || ms.webhooks[id-1] == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return ms.webhooks[id-1], nil
+}
+
+// copyWebhook returns a copy of a subscription which does not share memory with the store
+func copyWebhook(sub *WebhookSubscription) WebhookSubscription {
+	c := *sub
+	c.EventTypes = append([]string{}, sub.EventTypes...)
+
+	createdAt, updatedAt := *sub.CreatedAt, *sub.UpdatedAt
+	c.CreatedAt, c.UpdatedAt = &createdAt, &updatedAt
+	return c
+}
+
+// InsertWebhook persists a new subscription, assigning it the next sequential id
+func (ms *MemoryOrderStore) InsertWebhook(sub WebhookSubscription) (WebhookSubscription, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	sub.Id = len(ms.webhooks) + 1
+	sub.CreatedAt, sub.UpdatedAt = &now, &now
+
+	stored := copyWebhook(&sub)
+	ms.webhooks = append(ms.webhooks, &stored)
+	return copyWebhook(&stored), nil
+}
+
+// SelectWebhook returns a subscription by id
+func (ms *MemoryOrderStore) SelectWebhook(id int) (WebhookSubscription, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	sub, err := ms.lookupWebhook(id)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+
+	return copyWebhook(sub), nil
+}
+
+// ListWebhooks returns every subscription, oldest first
+func (ms *MemoryOrderStore) ListWebhooks() ([]WebhookSubscription, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	subs := []WebhookSubscription{}
+	for _, sub := range ms.webhooks {
+		if sub != nil {
+			subs = append(subs, copyWebhook(sub))
+		}
+	}
+
+	return subs, nil
+}
+
+// UpdateWebhook replaces the url, secret, event types and active flag of a subscription
+func (ms *MemoryOrderStore) UpdateWebhook(sub WebhookSubscription) (WebhookSubscription, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	stored, err := ms.lookupWebhook(sub.Id)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+
+	now := time.Now()
+	stored.URL = sub.URL
+	stored.Secret = sub.Secret
+	stored.EventTypes = append([]string{}, sub.EventTypes...)
+	stored.Active = sub.Active
+	stored.UpdatedAt = &now
+
+	return copyWebhook(stored), nil
+}
+
+// DeleteWebhook deletes a subscription along with its pending deliveries and dead letters
+func (ms *MemoryOrderStore) DeleteWebhook(id int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, err := ms.lookupWebhook(id); err != nil {
+		return err
+	}
+	ms.webhooks[id-1] = nil
+
+	deliveries := ms.deliveries[:0]
+	for _, d := range ms.deliveries {
+		if d.subscriptionId != id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	ms.deliveries = deliveries
+
+	letters := ms.deadLetters[:0]
+	for _, l := range ms.deadLetters {
+		if l.SubscriptionId != id {
+			letters = append(letters, l)
+		}
+	}
+	ms.deadLetters = letters
+
+	return nil
+}
+
+// ClaimDeliveries returns up to `limit` due deliveries of active subscriptions
+func (ms *MemoryOrderStore) ClaimDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	claimed := []WebhookDelivery{}
+	for _, d := range ms.deliveries {
+		if len(claimed) == limit {
+			break
+		}
+
+		sub := ms.webhooks[d.subscriptionId-1]
+		if !sub.Active || d.nextAttemptAt.After(now) {
+			continue
+		}
+
+		d.attempts++
+		d.nextAttemptAt = now.Add(lease)
+		claimed = append(claimed, WebhookDelivery{
+			Id:           d.id,
+			Subscription: copyWebhook(sub),
+			Event:        ms.events[d.eventId-1],
+			Attempts:     d.attempts,
+		})
+	}
+
+	return claimed, nil
+}
+
+// removeDelivery removes a delivery from the outbox and returns it, or nil if it is
+// no longer there. The caller must hold ms.mu
+func (ms *MemoryOrderStore) removeDelivery(id int) *memoryDelivery {
+	for i, d := range ms.deliveries {
+		if d.id == id {
+			ms.deliveries = append(ms.deliveries[:i], ms.deliveries[i+1:]...)
+			return d
+		}
+	}
+
+	return nil
+}
+
+// CompleteDelivery removes a successful delivery from the outbox
+func (ms *MemoryOrderStore) CompleteDelivery(id int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.removeDelivery(id)
+	return nil
+}
+
+// RetryDelivery records the failure of a delivery and schedules its next attempt
+func (ms *MemoryOrderStore) RetryDelivery(id int, lastError string, at time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, d := range ms.deliveries {
+		if d.id == id {
+			d.lastError = lastError
+			d.nextAttemptAt = at
+		}
+	}
+
+	return nil
+}
+
+// DeadLetterDelivery moves a delivery out of the outbox into the dead letters
+func (ms *MemoryOrderStore) DeadLetterDelivery(id int, lastError string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	d := ms.removeDelivery(id)
+	if d == nil {
+		return nil
+	}
+
+	ms.lastDeadLetterId++
+	ms.deadLetters = append(ms.deadLetters, WebhookDeadLetter{
+		Id:             ms.lastDeadLetterId,
+		SubscriptionId: d.subscriptionId,
+		Event:          ms.events[d.eventId-1],
+		Attempts:       d.attempts,
+		LastError:      lastError,
+		FailedAt:       time.Now(),
+	})
+
+	return nil
+}
+
+// DeadLetters returns the dead letters of a subscription, oldest first
+func (ms *MemoryOrderStore) DeadLetters(subscriptionId int) ([]WebhookDeadLetter, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, err := ms.lookupWebhook(subscriptionId); err != nil {
+		return nil, err
+	}
+
+	letters := []WebhookDeadLetter{}
+	for _, l := range ms.deadLetters {
+		if l.SubscriptionId == subscriptionId {
+			letters = append(letters, l)
+		}
+	}
+
+	return letters, nil
+}
+
+// ReplayDeadLetters moves dead letters of a subscription back into the outbox
+func (ms *MemoryOrderStore) ReplayDeadLetters(subscriptionId int, ids []int) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, err := ms.lookupWebhook(subscriptionId); err != nil {
+		return 0, err
+	}
+
+	selected := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	replayed := 0
+	letters := ms.deadLetters[:0]
+	for _, l := range ms.deadLetters {
+		if l.SubscriptionId == subscriptionId && (len(ids) == 0 || selected[l.Id]) {
+			ms.enqueue(l.SubscriptionId, l.Event.Id)
+			replayed++
+			continue
+		}
+
+		letters = append(letters, l)
+	}
+	ms.deadLetters = letters
+
+	return replayed, nil
+}
+
+// lookupCourier returns the courier with the given id. The caller must hold ms.mu
+func (ms *MemoryOrderStore) lookupCourier(id int) (*Courier, error) {
+	if id <= 0 || id > len(ms.couriers) {
+		return nil, sql.ErrNoRows
+	}
+
+	return ms.couriers[id-1], nil
+}
+
+// heldOrders counts the orders held by a courier. The caller must hold ms.mu
+func (ms *MemoryOrderStore) heldOrders(courierId int) int {
+	held := 0
+	for _, o := range ms.orders {
+		if o.courierId == courierId && isHeldOrderStatus(o.status) {
+			held++
+		}
+	}
+
+	return held
+}
+
+// copyCourier returns a copy of a courier which does not share memory with the store
+func copyCourier(c *Courier) Courier {
+	cp := *c
+
+	createdAt := *c.CreatedAt
+	cp.CreatedAt = &createdAt
+	if c.DeactivatedAt != nil {
+		deactivatedAt := *c.DeactivatedAt
+		cp.DeactivatedAt = &deactivatedAt
+	}
+
+	return cp
+}
+
+// InsertCourier persists a new active courier, assigning it the next sequential id
+func (ms *MemoryOrderStore) InsertCourier(c Courier) (Courier, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	c.Id = len(ms.couriers) + 1
+	c.Active = true
+	c.CreatedAt, c.DeactivatedAt = &now, nil
+	c.Token = ""
+
+	stored := copyCourier(&c)
+	ms.couriers = append(ms.couriers, &stored)
+	return copyCourier(&stored), nil
+}
+
+// SelectCourier returns a courier by id
+func (ms *MemoryOrderStore) SelectCourier(id int) (Courier, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	c, err := ms.lookupCourier(id)
+	if err != nil {
+		return Courier{}, err
+	}
+
+	return copyCourier(c), nil
+}
+
+// ListCouriers returns every courier, oldest first
+func (ms *MemoryOrderStore) ListCouriers() ([]Courier, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	couriers := []Courier{}
+	for _, c := range ms.couriers {
+		couriers = append(couriers, copyCourier(c))
+	}
+
+	return couriers, nil
+}
+
+// DeactivateCourier deactivates a courier, keeping the time of its first deactivation
+func (ms *MemoryOrderStore) DeactivateCourier(id int) (Courier, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	c, err := ms.lookupCourier(id)
+	if err != nil {
+		return Courier{}, err
+	}
+
+	if c.Active {
+		now := time.Now()
+		c.Active, c.DeactivatedAt = false, &now
+	}
+
+	return copyCourier(c), nil
+}
+
+// SetCourierTokenHash replaces the token of a courier
+func (ms *MemoryOrderStore) SetCourierTokenHash(id int, tokenHash string) (Courier, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	c, err := ms.lookupCourier(id)
+	if err != nil {
+		return Courier{}, err
+	}
+
+	c.TokenHash = tokenHash
+	return copyCourier(c), nil
+}
+
+// ReserveIdempotencyKey reserves a key unless it is reserved or has an unexpired stored response.
+// Expired keys are discarded along the way
+func (ms *MemoryOrderStore) ReserveIdempotencyKey(
+	key, requestHash string, lease time.Duration) (IdempotencyRecord, bool, error) {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(ms.idempotencySweptAt) >= idempotencySweepInterval {
+		ms.sweepIdempotencyKeys(now)
+	}
+
+	if stored, ok := ms.idempotencyKeys[key]; ok && now.Before(stored.expiresAt) {
+		record := stored.record
+		record.Body = append([]byte{}, stored.record.Body...)
+		return record, false, nil
+	}
+
+	ms.idempotencyKeys[key] = &memoryIdempotencyKey{
+		record:    IdempotencyRecord{Key: key, RequestHash: requestHash},
+		expiresAt: now.Add(lease),
+	}
+
+	return IdempotencyRecord{}, true, nil
+}
+
+// sweepIdempotencyKeys drops the expired idempotency keys, which would otherwise be kept
+// until reused. The caller must hold ms.mu
+func (ms *MemoryOrderStore) sweepIdempotencyKeys(now time.Time) {
+	for k, stored := range ms.idempotencyKeys {
+		if !now.Before(stored.expiresAt) {
+			delete(ms.idempotencyKeys, k)
+		}
+	}
+
+	ms.idempotencySweptAt = now
+}
+
+// SaveIdempotentResponse stores the response to the request holding a key
+func (ms *MemoryOrderStore) SaveIdempotentResponse(key string, status int, body []byte, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	stored, ok := ms.idempotencyKeys[key]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	stored.record.Status = status
+	stored.record.Body = append([]byte{}, body...)
+	stored.expiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+// ReleaseIdempotencyKey frees a key whose response is not stored
+func (ms *MemoryOrderStore) ReleaseIdempotencyKey(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if stored, ok := ms.idempotencyKeys[key]; ok && stored.record.Status == 0 {
+		delete(ms.idempotencyKeys, key)
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryOrderStoreInsertSelect(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	id, err := ms.InsertOrder(testOrder(1000))
+	assert.Nil(err)
+	assert.Equal(1, id)
+
+	order, err := ms.SelectOrder(id)
+	assert.Nil(err)
+	assert.Equal(id, order.Id)
+	assert.Equal(OrderStatusUnassign, order.Status)
+	assert.Equal(OriginLatLng, order.Origin)
+	assert.Equal(DestLatLng, order.Destination)
+	assert.Equal(1000, order.Distance)
+	assert.NotNil(order.CreatedAt)
+	assert.Equal(order.CreatedAt, order.UpdatedAt)
+
+	for _, missing := range []int{-1, 0, 2} {
+		_, err = ms.SelectOrder(missing)
+		assert.Equal(sql.ErrNoRows, err)
+	}
+}
+
+func TestMemoryOrderStoreRetrieveOrders(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	orders, total, err := ms.RetrieveOrders(OrderQuery{}, 10, 1)
+	assert.Nil(err)
+	assert.Empty(orders)
+	assert.Equal(0, total)
+
+	for i := 0; i < 25; i++ {
+		ms.InsertOrder(testOrder(i))
+	}
+
+	orders, total, _ = ms.RetrieveOrders(OrderQuery{}, 10, 1)
+	assert.Len(orders, 10)
+	assert.Equal(1, orders[0].Id)
+	assert.Equal(25, total)
+
+	orders, _, _ = ms.RetrieveOrders(OrderQuery{}, 10, 3)
+	assert.Len(orders, 5)
+	assert.Equal(21, orders[0].Id)
+
+	orders, total, _ = ms.RetrieveOrders(OrderQuery{}, 10, 4)
+	assert.Empty(orders)
+	assert.Equal(25, total)
+}
+
+func TestMemoryOrderStoreRetrieveOrdersQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	for i := 0; i < 10; i++ {
+		ms.InsertOrder(testOrder(1000 * (i % 3)))
+	}
+	courier, _ := ms.InsertCourier(Courier{Name: "Ada"})
+	ms.UpdateOrderStatus(4, StatusUpdate{Status: OrderStatusTaken, CourierId: courier.Id})
+
+	taken := OrderQuery{Statuses: []string{OrderStatusTaken}}
+	orders, total, _ := ms.RetrieveOrders(taken, 10, 1)
+	assert.Equal(1, total)
+	assert.Equal(4, orders[0].Id)
+
+	// distances are 0, 1000, 2000, 0, 1000...
+	farthestFirst := OrderQuery{Sort: OrderSort{Field: OrderSortDistance, Desc: true}}
+	orders, total, _ = ms.RetrieveOrders(farthestFirst, 4, 1)
+	assert.Equal(10, total)
+	assert.Equal([]int{9, 6, 3, 8}, []int{orders[0].Id, orders[1].Id, orders[2].Id, orders[3].Id})
+
+	// cursors ignore the sort
+	max := 0
+	orders, _ = ms.RetrieveOrdersAfter(OrderQuery{MaxDistance: &max, Sort: farthestFirst.Sort}, nil, 10)
+	assert.Len(orders, 4)
+	assert.Equal(1, orders[0].Id)
+	assert.Equal(10, orders[3].Id)
+}
+
+func TestMemoryOrderStoreRetrieveOrdersAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	orders, err := ms.RetrieveOrdersAfter(OrderQuery{}, nil, 10)
+	assert.Nil(err)
+	assert.Empty(orders)
+
+	for i := 0; i < 25; i++ {
+		ms.InsertOrder(testOrder(i))
+	}
+
+	orders, _ = ms.RetrieveOrdersAfter(OrderQuery{}, nil, 10)
+	assert.Len(orders, 10)
+	assert.Equal(1, orders[0].Id)
+	assert.NotNil(orders[0].CreatedAt)
+
+	// a cursor survives encoding
+	cursor, err := DecodeOrderCursor(cursorOf(orders[9]).Encode())
+	assert.Nil(err)
+
+	orders, _ = ms.RetrieveOrdersAfter(OrderQuery{}, &cursor, 10)
+	assert.Len(orders, 10)
+	assert.Equal(11, orders[0].Id)
+
+	cursor = cursorOf(orders[9])
+	orders, _ = ms.RetrieveOrdersAfter(OrderQuery{}, &cursor, 10)
+	assert.Len(orders, 5)
+	assert.Equal(21, orders[0].Id)
+
+	cursor = cursorOf(orders[4])
+	orders, _ = ms.RetrieveOrdersAfter(OrderQuery{}, &cursor, 10)
+	assert.Empty(orders)
+}
+
+func TestMemoryOrderStoreConcurrentTake(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	id, _ := ms.InsertOrder(testOrder(1000))
+
+	// many concurrent takers, only the first one should win
+	const takers = 50
+	errs := make(chan error, takers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < takers; i++ {
+		courier, _ := ms.InsertCourier(Courier{Name: fmt.Sprintf("courier %d", i)})
+
+		wg.Add(1)
+		go func(courierId int) {
+			defer wg.Done()
+			errs <- ms.UpdateOrderStatus(id, StatusUpdate{Status: OrderStatusTaken, CourierId: courierId})
+		}(courier.Id)
+	}
+	wg.Wait()
+	close(errs)
+
+	won := 0
+	for err := range errs {
+		if err == nil {
+			won++
+		} else {
+			assert.Equal(OrderAlreadyTakenError, err)
+		}
+	}
+
+	assert.Equal(1, won)
+
+	// the order is assigned to the winner
+	order, _ := ms.SelectOrder(id)
+	assert.NotZero(order.AssignedCourierId)
+
+	// only the creation and the winning take are recorded
+	events, err := ms.OrderHistory(id)
+	assert.Nil(err)
+	assert.Len(events, 2)
+
+	_, err = ms.OrderHistory(id + 1)
+	assert.Equal(sql.ErrNoRows, err)
+	assert.Equal(sql.ErrNoRows, ms.UpdateOrderStatus(id+1, StatusUpdate{Status: OrderStatusTaken, CourierId: 1}))
+}
+
+func TestMemoryOrderStoreCourierCapacity(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	ms.CourierCapacity = 2
+
+	var ids []int
+	for i := 0; i < 10; i++ {
+		id, _ := ms.InsertOrder(testOrder(1000))
+		ids = append(ids, id)
+	}
+
+	courier, _ := ms.InsertCourier(Courier{Name: "Ada"})
+	take := StatusUpdate{Status: OrderStatusTaken, CourierId: courier.Id}
+
+	// concurrent takes by one courier never exceed its capacity
+	errs := make(chan error, len(ids))
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			errs <- ms.UpdateOrderStatus(id, take)
+		}(id)
+	}
+	wg.Wait()
+	close(errs)
+
+	won := 0
+	for err := range errs {
+		if err == nil {
+			won++
+		} else {
+			assert.Equal(CourierAtCapacityError, err)
+		}
+	}
+	assert.Equal(2, won)
+
+	held, _, _ := ms.RetrieveOrders(OrderQuery{Statuses: []string{OrderStatusTaken}}, 10, 1)
+	if !assert.Len(held, 2) {
+		return
+	}
+
+	unassigned := OrderQuery{Statuses: []string{OrderStatusUnassign}}
+	free, _, _ := ms.RetrieveOrders(unassigned, 10, 1)
+
+	// releasing or finishing an order frees capacity
+	release := StatusUpdate{Status: OrderStatusUnassign, CourierId: courier.Id}
+	assert.Nil(ms.UpdateOrderStatus(held[0].Id, release))
+	assert.Nil(ms.UpdateOrderStatus(free[0].Id, take))
+	assert.Equal(CourierAtCapacityError, ms.UpdateOrderStatus(free[1].Id, take))
+
+	cancel := StatusUpdate{Status: OrderStatusCancelled, Reason: CancelReasonCustomerRequest}
+	assert.Nil(ms.UpdateOrderStatus(held[1].Id, cancel))
+	assert.Nil(ms.UpdateOrderStatus(free[1].Id, take))
+
+	// a courier's own capacity overrides the default
+	big, _ := ms.InsertCourier(Courier{Name: "Grace", Capacity: 3})
+	free, _, _ = ms.RetrieveOrders(unassigned, 10, 1)
+	for _, o := range free[:3] {
+		assert.Nil(ms.UpdateOrderStatus(o.Id, StatusUpdate{Status: OrderStatusTaken, CourierId: big.Id}))
+	}
+	assert.Equal(CourierAtCapacityError,
+		ms.UpdateOrderStatus(free[3].Id, StatusUpdate{Status: OrderStatusTaken, CourierId: big.Id}))
+}
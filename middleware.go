@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// RequestIdHeader carries the id correlating a client request with the records it produced
+const RequestIdHeader = "X-Request-Id"
+
+// ActorHeader carries a free-form label naming who is making a request, e.g. a dispatcher
+const ActorHeader = "X-Actor"
+
+const (
+	// maxRequestIdLength bounds client request ids, which are stored in VARCHAR(255) columns
+	maxRequestIdLength = 255
+	// maxActorLength bounds actor labels, leaving room in the actor column for the caller's identity
+	maxActorLength = 200
+)
+
+// AdminTokenHeader carries the admin token, which grants operator privileges to a request
+const AdminTokenHeader = "X-Admin-Token"
+
+// adminToken is the configured admin token. No request is an admin one when it is empty
+var adminToken string
+
+// requestIdKey is the context key under which the request id is stored
+type requestIdKey struct{}
+
+// withRequestId assigns every request an id, taken from the X-Request-Id header if the client
+// sent one, stores it in the request context and echoes it in the response.
+// Requests with an overlong request id or actor label are rejected with a 400
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get(RequestIdHeader)) > maxRequestIdLength {
+			writeError(w, http.StatusBadRequest,
+				fmt.Sprintf("%s must be at most %d bytes", RequestIdHeader, maxRequestIdLength))
+			return
+		}
+		if len(r.Header.Get(ActorHeader)) > maxActorLength {
+			writeError(w, http.StatusBadRequest,
+				fmt.Sprintf("%s must be at most %d bytes", ActorHeader, maxActorLength))
+			return
+		}
+
+		requestId := r.Header.Get(RequestIdHeader)
+		if requestId == "" {
+			requestId = uuid.New().String()
+		}
+
+		w.Header().Set(RequestIdHeader, requestId)
+		ctx := context.WithValue(r.Context(), requestIdKey{}, requestId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestActor returns the actor recorded for a change made by a request: the caller's
+// authenticated identity, "admin" or "courier:<id>", or "anonymous" for unauthenticated callers,
+// followed by the X-Actor label if one was sent, e.g. "admin/dispatch"
+func requestActor(r *http.Request, admin bool, courierId int) string {
+	actor := "anonymous"
+	switch {
+	case admin:
+		actor = "admin"
+	case courierId != 0:
+		actor = fmt.Sprintf("courier:%d", courierId)
+	}
+
+	if label := r.Header.Get(ActorHeader); label != "" {
+		actor += "/" + label
+	}
+	return actor
+}
+
+// requestId returns the id assigned to a request by withRequestId
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// requireAdmin rejects requests which do not carry the admin token with a 403
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			writeError(w, http.StatusForbidden, "ADMIN_TOKEN_REQUIRED")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// isAdmin returns if a request carries the configured admin token
+func isAdmin(r *http.Request) bool {
+	token := r.Header.Get(AdminTokenHeader)
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// migrationLockKey identifies the Postgres advisory lock held while migrating
+const migrationLockKey = 4242001
+
+// MigrationStatus describes whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies schema migrations to Postgres, recording the applied versions
+// in the `schema_migrations` table
+//
+// Every operation holds a session-level advisory lock so that replicas starting
+// at the same time apply migrations one after another rather than racing
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator creates a Migrator for the migrations compiled into the binary
+func NewMigrator(db *sql.DB) *Migrator {
+	return &Migrator{db, migrations}
+}
+
+// withLock runs `fn` on a single connection holding the migration advisory lock
+func (m *Migrator) withLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	// advisory locks belong to a session, so lock, migrate and unlock on the same connection
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+	if err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %s", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR (255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %s", err)
+	}
+
+	return fn(ctx, conn)
+}
+
+// applied returns the time at which each applied migration version was applied
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		versions[version] = appliedAt
+	}
+
+	return versions, rows.Err()
+}
+
+// run executes a migration statement and records the outcome in a single transaction
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, stmt, record string, args ...interface{}) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	if _, err = tx.ExecContext(ctx, stmt); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, record, args...)
+	return err
+}
+
+// Up applies every pending migration in version order and returns the ones applied
+func (m *Migrator) Up() (done []Migration, err error) {
+	err = m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			err = m.run(ctx, conn, mig.Up,
+				`INSERT INTO schema_migrations(version, name) VALUES($1, $2)`,
+				mig.Version, mig.Name,
+			)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %s", mig.Version, mig.Name, err)
+			}
+
+			log.Printf("applied migration %d_%s", mig.Version, mig.Name)
+			done = append(done, mig)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Down reverts the most recently applied migration and returns it.
+// A nil Migration is returned if no migration has been applied
+func (m *Migrator) Down() (reverted *Migration, err error) {
+	err = m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+
+			err = m.run(ctx, conn, mig.Down,
+				`DELETE FROM schema_migrations WHERE version = $1`, mig.Version,
+			)
+			if err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %s", mig.Version, mig.Name, err)
+			}
+
+			log.Printf("reverted migration %d_%s", mig.Version, mig.Name)
+			reverted = &mig
+			return nil
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// Status reports whether each migration has been applied
+func (m *Migrator) Status() (statuses []MigrationStatus, err error) {
+	err = m.withLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			appliedAt, ok := applied[mig.Version]
+			statuses = append(statuses, MigrationStatus{mig, ok, appliedAt})
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// runMigrate implements the `migrate up|down|status` command, writing its report to `out`
+func runMigrate(cfg *Config, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: migrate up|down|status")
+	}
+
+	command := args[0]
+	if !(command == "up" || command == "down" || command == "status") {
+		return fmt.Errorf("unknown migrate command: %s", command)
+	}
+
+	if cfg.Store != OrderStorePostgres {
+		return fmt.Errorf("migrations require the %s store", OrderStorePostgres)
+	}
+
+	od, err := NewOrderDatabase(cfg.Postgres)
+	if err != nil {
+		return err
+	}
+	defer od.db.Close()
+
+	m := NewMigrator(od.db)
+
+	switch command {
+	case "up":
+		done, err := m.Up()
+		if err != nil {
+			return err
+		}
+
+		if len(done) == 0 {
+			fmt.Fprintln(out, "schema is up to date")
+		}
+
+		for _, mig := range done {
+			fmt.Fprintf(out, "applied %d_%s\n", mig.Version, mig.Name)
+		}
+	case "down":
+		reverted, err := m.Down()
+		if err != nil {
+			return err
+		}
+
+		if reverted == nil {
+			fmt.Fprintln(out, "no migrations to revert")
+		} else {
+			fmt.Fprintf(out, "reverted %d_%s\n", reverted.Version, reverted.Name)
+		}
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(out, "%d_%s\t%s\n", s.Version, s.Name, state)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	assert := assert.New(t)
+
+	for i, mig := range migrations {
+		// versions start at 1 and increase without gaps
+		assert.Equal(i+1, mig.Version)
+		assert.NotEmpty(mig.Name)
+		assert.NotEmpty(mig.Up)
+		assert.NotEmpty(mig.Down)
+	}
+}
+
+func TestRunMigrateInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := DefaultConfig()
+	var out bytes.Buffer
+
+	badArgs := [][]string{
+		{},
+		{"sideways"},
+		{"up", "down"},
+	}
+
+	for _, args := range badArgs {
+		assert.NotNil(runMigrate(cfg, args, &out))
+	}
+
+	cfg.Store = OrderStoreMemory
+	assert.NotNil(runMigrate(cfg, []string{"up"}, &out))
+	assert.Empty(out.String())
+}
+
+func TestRunMigratePostgres(t *testing.T) {
+	if os.Getenv("ORDERS_STORE") != OrderStorePostgres {
+		t.Skip("set ORDERS_STORE=postgres to run migrations against Postgres")
+	}
+
+	assert := assert.New(t)
+
+	cfg := DefaultConfig()
+	assert.Nil(cfg.loadEnv(os.Getenv))
+
+	// TestMain has applied every migration already
+	var out bytes.Buffer
+	assert.Nil(runMigrate(cfg, []string{"up"}, &out))
+	assert.Equal("schema is up to date\n", out.String())
+
+	out.Reset()
+	assert.Nil(runMigrate(cfg, []string{"status"}, &out))
+	assert.Contains(out.String(), "1_create_orders\tapplied")
+	assert.NotContains(out.String(), "pending")
+}
@@ -0,0 +1,331 @@
+package main
+
+// Migration is a versioned change to the Postgres schema.
+// Up applies the change and Down reverts it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrations is the ordered list of schema migrations applied by Migrator.
+// Migrations are append-only: once released, a migration must never be edited,
+// a new one must be added instead
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_orders",
+		// IF NOT EXISTS adopts databases initialized from the former release/db/SCHEMAS.sql
+		Up: `CREATE TABLE IF NOT EXISTS orders (
+			id serial PRIMARY KEY,
+			origin VARCHAR (50) NOT NULL,
+			destination VARCHAR (50) NOT NULL,
+			distance VARCHAR (50) NOT NULL,
+			status VARCHAR (50) NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW()
+		)`,
+		Down: `DROP TABLE orders`,
+	},
+	{
+		Version: 2,
+		Name:    "typed_order_columns",
+		// status is constrained with a CHECK rather than an ENUM type since
+		// ALTER TYPE ... ADD VALUE cannot run inside a migration's transaction
+		Up: `ALTER TABLE orders
+			ADD COLUMN distance_m INTEGER,
+			ADD COLUMN origin_lat NUMERIC,
+			ADD COLUMN origin_lng NUMERIC,
+			ADD COLUMN dest_lat NUMERIC,
+			ADD COLUMN dest_lng NUMERIC,
+			ADD COLUMN updated_at TIMESTAMP;
+
+		UPDATE orders SET
+			distance_m = distance::INTEGER,
+			origin_lat = split_part(origin, ',', 1)::NUMERIC,
+			origin_lng = split_part(origin, ',', 2)::NUMERIC,
+			dest_lat = split_part(destination, ',', 1)::NUMERIC,
+			dest_lng = split_part(destination, ',', 2)::NUMERIC,
+			created_at = COALESCE(created_at, NOW()),
+			updated_at = COALESCE(created_at, NOW());
+
+		ALTER TABLE orders
+			DROP COLUMN distance,
+			DROP COLUMN origin,
+			DROP COLUMN destination,
+			ALTER COLUMN distance_m SET NOT NULL,
+			ALTER COLUMN origin_lat SET NOT NULL,
+			ALTER COLUMN origin_lng SET NOT NULL,
+			ALTER COLUMN dest_lat SET NOT NULL,
+			ALTER COLUMN dest_lng SET NOT NULL,
+			ALTER COLUMN created_at SET NOT NULL,
+			ALTER COLUMN updated_at SET NOT NULL,
+			ALTER COLUMN updated_at SET DEFAULT NOW(),
+			ADD CONSTRAINT orders_distance_m_check CHECK (distance_m >= 0),
+			ADD CONSTRAINT orders_origin_check
+				CHECK (origin_lat BETWEEN -90 AND 90 AND origin_lng BETWEEN -180 AND 180),
+			ADD CONSTRAINT orders_dest_check
+				CHECK (dest_lat BETWEEN -90 AND 90 AND dest_lng BETWEEN -180 AND 180),
+			ADD CONSTRAINT orders_status_check CHECK (status IN ('UNASSIGN', 'taken'));
+
+		CREATE INDEX orders_created_at_idx ON orders (created_at);
+		CREATE INDEX orders_status_idx ON orders (status)`,
+		Down: `DROP INDEX orders_status_idx;
+		DROP INDEX orders_created_at_idx;
+
+		ALTER TABLE orders
+			DROP CONSTRAINT orders_status_check,
+			ADD COLUMN distance VARCHAR (50),
+			ADD COLUMN origin VARCHAR (50),
+			ADD COLUMN destination VARCHAR (50),
+			ALTER COLUMN created_at DROP NOT NULL;
+
+		UPDATE orders SET
+			distance = distance_m::TEXT,
+			origin = origin_lat::TEXT || ',' || origin_lng::TEXT,
+			destination = dest_lat::TEXT || ',' || dest_lng::TEXT;
+
+		ALTER TABLE orders
+			ALTER COLUMN distance SET NOT NULL,
+			ALTER COLUMN origin SET NOT NULL,
+			ALTER COLUMN destination SET NOT NULL,
+			DROP COLUMN distance_m,
+			DROP COLUMN origin_lat,
+			DROP COLUMN origin_lng,
+			DROP COLUMN dest_lat,
+			DROP COLUMN dest_lng,
+			DROP COLUMN updated_at`,
+	},
+	{
+		Version: 3,
+		Name:    "order_lifecycle_statuses",
+		Up: `ALTER TABLE orders
+			DROP CONSTRAINT orders_status_check,
+			ADD CONSTRAINT orders_status_check CHECK (status IN (
+				'UNASSIGN', 'taken', 'picked_up', 'in_transit', 'delivered', 'cancelled', 'failed'
+			))`,
+		// orders which have moved past `taken` cannot be represented by the previous schema
+		Down: `UPDATE orders SET status = 'taken'
+			WHERE status IN ('picked_up', 'in_transit', 'delivered', 'cancelled', 'failed');
+
+		ALTER TABLE orders
+			DROP CONSTRAINT orders_status_check,
+			ADD CONSTRAINT orders_status_check CHECK (status IN ('UNASSIGN', 'taken'))`,
+	},
+	{
+		Version: 4,
+		Name:    "create_order_events",
+		Up: `CREATE TABLE order_events (
+			id serial PRIMARY KEY,
+			order_id INTEGER NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+			from_status VARCHAR (50) NOT NULL,
+			to_status VARCHAR (50) NOT NULL,
+			actor VARCHAR (255) NOT NULL DEFAULT '',
+			request_id VARCHAR (255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX order_events_order_id_idx ON order_events (order_id, id)`,
+		Down: `DROP TABLE order_events`,
+	},
+	{
+		Version: 5,
+		Name:    "create_webhooks",
+		// webhook_deliveries is the outbox: a row is written for every subscription interested in
+		// an order event, in the same transaction as the event, and deleted once delivered
+		Up: `CREATE TABLE webhook_subscriptions (
+			id serial PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			event_types TEXT[] NOT NULL DEFAULT '{}',
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+
+		CREATE TABLE webhook_deliveries (
+			id serial PRIMARY KEY,
+			subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+			event_id INTEGER NOT NULL REFERENCES order_events (id) ON DELETE CASCADE,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			last_error TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE INDEX webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at);
+
+		CREATE TABLE webhook_dead_letters (
+			id serial PRIMARY KEY,
+			subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+			event_id INTEGER NOT NULL REFERENCES order_events (id) ON DELETE CASCADE,
+			attempts INTEGER NOT NULL,
+			last_error TEXT NOT NULL,
+			failed_at TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX webhook_dead_letters_subscription_id_idx ON webhook_dead_letters (subscription_id, id)`,
+		Down: `DROP TABLE webhook_dead_letters;
+		DROP TABLE webhook_deliveries;
+		DROP TABLE webhook_subscriptions`,
+	},
+	{
+		Version: 6,
+		Name:    "orders_created_at_id_index",
+		// supports listing orders by cursor, and subsumes the index on created_at alone
+		Up: `CREATE INDEX orders_created_at_id_idx ON orders (created_at, id);
+		DROP INDEX orders_created_at_idx`,
+		Down: `CREATE INDEX orders_created_at_idx ON orders (created_at);
+		DROP INDEX orders_created_at_id_idx`,
+	},
+	{
+		Version: 7,
+		Name:    "orders_origin_earth_index",
+		// only unassigned orders are searched by location, see OrderDatabase.NearbyOrders.
+		// The extensions are left installed by Down, other objects may depend on them
+		Up: `CREATE EXTENSION IF NOT EXISTS cube;
+		CREATE EXTENSION IF NOT EXISTS earthdistance;
+
+		CREATE INDEX orders_unassign_origin_earth_idx ON orders
+			USING gist (ll_to_earth(origin_lat::DOUBLE PRECISION, origin_lng::DOUBLE PRECISION))
+			WHERE status = 'UNASSIGN'`,
+		Down: `DROP INDEX orders_unassign_origin_earth_idx`,
+	},
+	{
+		Version: 8,
+		Name:    "create_couriers",
+		// an order is assigned to the courier which took it until it is released
+		Up: `CREATE TABLE couriers (
+			id serial PRIMARY KEY,
+			name VARCHAR (255) NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			deactivated_at TIMESTAMP
+		);
+
+		ALTER TABLE orders ADD COLUMN assigned_courier_id INTEGER REFERENCES couriers (id);
+
+		CREATE INDEX orders_assigned_courier_id_idx ON orders (assigned_courier_id)
+			WHERE assigned_courier_id IS NOT NULL`,
+		Down: `ALTER TABLE orders DROP COLUMN assigned_courier_id;
+		DROP TABLE couriers`,
+	},
+	{
+		Version: 9,
+		Name:    "couriers_capacity",
+		// a NULL capacity applies the configured default, see CourierConfig
+		Up:   `ALTER TABLE couriers ADD COLUMN capacity INTEGER CHECK (capacity > 0)`,
+		Down: `ALTER TABLE couriers DROP COLUMN capacity`,
+	},
+	{
+		Version: 10,
+		Name:    "order_events_reason",
+		// the partial index supports the search for stale orders, see OrderDatabase.ReleaseStaleOrders
+		Up: `ALTER TABLE order_events ADD COLUMN reason VARCHAR (50) NOT NULL DEFAULT '';
+
+		CREATE INDEX orders_taken_updated_at_idx ON orders (updated_at) WHERE status = 'taken'`,
+		Down: `DROP INDEX orders_taken_updated_at_idx;
+		ALTER TABLE order_events DROP COLUMN reason`,
+	},
+	{
+		Version: 11,
+		Name:    "order_events_note",
+		Up:      `ALTER TABLE order_events ADD COLUMN note TEXT NOT NULL DEFAULT ''`,
+		Down:    `ALTER TABLE order_events DROP COLUMN note`,
+	},
+	{
+		Version: 12,
+		Name:    "create_idempotency_keys",
+		// a row with status 0 is held by a request in progress until it expires
+		Up: `CREATE TABLE idempotency_keys (
+			key VARCHAR (255) PRIMARY KEY,
+			request_hash CHAR (64) NOT NULL,
+			status INTEGER NOT NULL DEFAULT 0,
+			body BYTEA,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMP NOT NULL
+		);
+
+		CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at)`,
+		Down: `DROP TABLE idempotency_keys`,
+	},
+	{
+		Version: 13,
+		Name:    "orders_version",
+		Up:      `ALTER TABLE orders ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		Down:    `ALTER TABLE orders DROP COLUMN version`,
+	},
+	{
+		Version: 14,
+		Name:    "create_distance_cache",
+		// keys are origins and destinations rounded to the configured precision
+		Up: `CREATE TABLE distance_cache (
+			key TEXT PRIMARY KEY,
+			meters INTEGER NOT NULL,
+			human_readable TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		Down: `DROP TABLE distance_cache`,
+	},
+	{
+		Version: 15,
+		Name:    "route_durations",
+		// routes cached before now carry no durations, they are dropped so that they are fetched again
+		Up: `ALTER TABLE orders
+			ADD COLUMN duration_s INTEGER,
+			ADD COLUMN duration_in_traffic_s INTEGER,
+			ADD COLUMN departure_time TIMESTAMP;
+
+		DELETE FROM distance_cache;
+
+		ALTER TABLE distance_cache
+			ADD COLUMN duration_s INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN duration_in_traffic_s INTEGER NOT NULL DEFAULT 0`,
+		Down: `ALTER TABLE distance_cache
+			DROP COLUMN duration_s,
+			DROP COLUMN duration_in_traffic_s;
+
+		ALTER TABLE orders
+			DROP COLUMN duration_s,
+			DROP COLUMN duration_in_traffic_s,
+			DROP COLUMN departure_time`,
+	},
+	{
+		Version: 16,
+		Name:    "order_travel_modes",
+		// orders created before travel modes were all routed by car
+		Up: `ALTER TABLE orders
+			ADD COLUMN mode VARCHAR (20) NOT NULL DEFAULT 'driving',
+			ADD COLUMN avoid TEXT[] NOT NULL DEFAULT '{}',
+			ADD CONSTRAINT orders_mode_check
+				CHECK (mode IN ('driving', 'bicycling', 'walking', 'two_wheeler'))`,
+		Down: `ALTER TABLE orders
+			DROP COLUMN mode,
+			DROP COLUMN avoid`,
+	},
+	{
+		Version: 17,
+		Name:    "order_places",
+		// NULL for endpoints given by coordinates
+		Up: `ALTER TABLE orders
+			ADD COLUMN origin_address TEXT,
+			ADD COLUMN origin_place_id TEXT,
+			ADD COLUMN origin_formatted_address TEXT,
+			ADD COLUMN dest_address TEXT,
+			ADD COLUMN dest_place_id TEXT,
+			ADD COLUMN dest_formatted_address TEXT`,
+		Down: `ALTER TABLE orders
+			DROP COLUMN origin_address,
+			DROP COLUMN origin_place_id,
+			DROP COLUMN origin_formatted_address,
+			DROP COLUMN dest_address,
+			DROP COLUMN dest_place_id,
+			DROP COLUMN dest_formatted_address`,
+	},
+	{
+		Version: 18,
+		Name:    "couriers_token",
+		// NULL for couriers registered before tokens, until one is issued to them
+		Up:   `ALTER TABLE couriers ADD COLUMN token_hash CHAR(64)`,
+		Down: `ALTER TABLE couriers DROP COLUMN token_hash`,
+	},
+}
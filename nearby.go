@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"googlemaps.github.io/maps"
+)
+
+const (
+	// DefaultNearbyRadius is the search radius in meters of GET /orders/nearby
+	// when none is given
+	DefaultNearbyRadius = 5000
+
+	// MaxNearbyRadius is the largest search radius in meters of GET /orders/nearby
+	MaxNearbyRadius = 50000
+)
+
+// NearbyOrder is an unassigned order along with how far its origin is from a courier
+type NearbyOrder struct {
+	ResolvedOrder
+
+	// DistanceToOrigin is the distance in meters, as the crow flies,
+	// from the searched position to the order's origin
+	DistanceToOrigin int `json:"distance_to_origin"`
+}
+
+// parseNearbyPosition reads the `lat` and `lng` query parameters
+func parseNearbyPosition(r *http.Request) (maps.LatLng, error) {
+	params := r.URL.Query()
+
+	position := LatLng{params.Get("lat"), params.Get("lng")}
+	if !position.IsValid() {
+		return maps.LatLng{}, fmt.Errorf("lat and lng must be a valid latitude and longitude")
+	}
+
+	return parseLatLng(position.String())
+}
+
+// parseNearbyRadius reads the optional `radius` query parameter, in meters
+func parseNearbyRadius(r *http.Request) (float64, error) {
+	param := r.URL.Query().Get("radius")
+	if param == "" {
+		return DefaultNearbyRadius, nil
+	}
+
+	radius, err := strconv.ParseFloat(param, 64)
+	if err != nil || math.IsNaN(radius) || radius <= 0 || radius > MaxNearbyRadius {
+		return 0, fmt.Errorf("radius must be a number of meters greater than 0 and at most %d", MaxNearbyRadius)
+	}
+
+	return radius, nil
+}
+
+// nearbyOrders lists the unassigned orders whose origin is within `radius` meters of
+// the position `lat`, `lng`, nearest first. It accepts a `limit` query parameter
+func nearbyOrders(w http.ResponseWriter, r *http.Request) {
+	position, err := parseNearbyPosition(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	radius, err := parseNearbyRadius(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := DefaultOrderLimit
+	if limitParam, ok := r.URL.Query()["limit"]; ok {
+		limit, err = validateOrdersListParam(limitParam)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if limit > MaxOrderLimit {
+			limit = MaxOrderLimit
+		}
+	}
+
+	orders, err := defaultOrderStore.NearbyOrders(position, radius, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, orders)
+}
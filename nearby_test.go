@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNearbyOrders(t *testing.T) {
+	assert := assert.New(t)
+
+	// orders around Queenstown, far from the orders created by other tests
+	courier := LatLng{"-45.0312", "168.6626"}
+	origins := []LatLng{
+		{"-45.0400", "168.6626"}, // ~980m
+		{"-45.0312", "168.6700"}, // ~580m
+		{"-45.0312", "168.6626"}, // 0m, taken
+		{"-45.2000", "168.6626"}, // ~18.8km, out of the default radius
+	}
+
+	var ids []int
+	for _, origin := range origins {
+		order := testOrder(1000)
+		order.Origin = origin
+
+		id, err := defaultOrderStore.InsertOrder(order)
+		assert.Nil(err)
+		ids = append(ids, id)
+	}
+	taken := StatusUpdate{Status: OrderStatusTaken, CourierId: newTestCourier(t)}
+	assert.Nil(defaultOrderStore.UpdateOrderStatus(ids[2], taken))
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	client := srv.Client()
+
+	nearbyEndpoint := fmt.Sprintf("%s/orders/nearby?lat=%s&lng=%s", srv.URL, courier[0], courier[1])
+
+	resp, err := client.Get(nearbyEndpoint)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var nearby []NearbyOrder
+	json.NewDecoder(resp.Body).Decode(&nearby)
+	if assert.Len(nearby, 2) {
+		assert.Equal(ids[1], nearby[0].Id)
+		assert.InDelta(580, nearby[0].DistanceToOrigin, 10)
+		assert.Equal(origins[1], nearby[0].Origin)
+		assert.Equal(OrderStatusUnassign, nearby[0].Status)
+
+		assert.Equal(ids[0], nearby[1].Id)
+		assert.InDelta(980, nearby[1].DistanceToOrigin, 10)
+	}
+
+	resp, err = client.Get(nearbyEndpoint + "&radius=20000&limit=1")
+	assert.Nil(err)
+	nearby = nil
+	json.NewDecoder(resp.Body).Decode(&nearby)
+	assert.Len(nearby, 1)
+
+	resp, err = client.Get(nearbyEndpoint + "&radius=20000")
+	assert.Nil(err)
+	nearby = nil
+	json.NewDecoder(resp.Body).Decode(&nearby)
+	assert.Len(nearby, 3)
+
+	for _, bad := range []string{
+		"lat=-45.0312",
+		"lat=-95&lng=168.6626",
+		"lat=abc&lng=168.6626",
+		"lat=-45.0312&lng=168.6626&radius=0",
+		"lat=-45.0312&lng=168.6626&radius=far",
+		fmt.Sprintf("lat=-45.0312&lng=168.6626&radius=%d", MaxNearbyRadius+1),
+		"lat=-45.0312&lng=168.6626&limit=0",
+	} {
+		resp, err := client.Get(fmt.Sprintf("%s/orders/nearby?%s", srv.URL, bad))
+		assert.Nil(err)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, bad)
+	}
+}
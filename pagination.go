@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// OrdersV1MediaType may be accepted by clients of GET /orders which expect the bare array of
+// orders returned before the pagination envelope was introduced
+const OrdersV1MediaType = "application/vnd.orderapi.v1+json"
+
+// orderListPage is a page of orders listed by page number, along with its position in the listing
+type orderListPage struct {
+	Data       []ResolvedOrder `json:"data"`
+	Page       int             `json:"page"`
+	Limit      int             `json:"limit"`
+	Total      int             `json:"total"`
+	TotalPages int             `json:"total_pages"`
+	Links      pageLinks       `json:"links"`
+}
+
+// pageLinks are the URLs of a page and of the pages around it. They are also
+// sent in the Link header
+type pageLinks struct {
+	Self  string `json:"self"`
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+// header formats the links as an RFC 5988 Link header
+func (l pageLinks) header() string {
+	rels := []struct{ rel, url string }{
+		{"first", l.First},
+		{"prev", l.Prev},
+		{"next", l.Next},
+		{"last", l.Last},
+	}
+
+	parts := []string{}
+	for _, r := range rels {
+		if r.url != "" {
+			parts = append(parts, fmt.Sprintf(`<%s>; rel="%s"`, r.url, r.rel))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// pageURL returns the path and query of a request with the query parameters in `set` replaced
+func pageURL(r *http.Request, set map[string]string) string {
+	query := r.URL.Query()
+	for k, v := range set {
+		query.Set(k, v)
+	}
+
+	u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// numberedPageLinks returns the links of page `page` of `totalPages` pages of `limit` orders
+func numberedPageLinks(r *http.Request, page, limit, totalPages int) pageLinks {
+	link := func(p int) string {
+		return pageURL(r, map[string]string{"page": strconv.Itoa(p), "limit": strconv.Itoa(limit)})
+	}
+
+	// an empty listing still has a first page, which is also the last one
+	last := totalPages
+	if last < 1 {
+		last = 1
+	}
+
+	links := pageLinks{Self: link(page), First: link(1), Last: link(last)}
+
+	switch {
+	case page > last+1:
+		links.Prev = link(last)
+	case page > 1:
+		links.Prev = link(page - 1)
+	}
+
+	if page < totalPages {
+		links.Next = link(page + 1)
+	}
+
+	return links
+}
+
+// wantsBareOrderArray returns if the client of GET /orders asked for a bare array of orders,
+// with either `envelope=false` or by accepting OrdersV1MediaType
+func wantsBareOrderArray(r *http.Request) (bool, error) {
+	if envelope := r.URL.Query().Get("envelope"); envelope != "" {
+		wrap, err := strconv.ParseBool(envelope)
+		if err != nil {
+			return false, errors.New("envelope must be true or false")
+		}
+
+		return !wrap, nil
+	}
+
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil && mediaType == OrdersV1MediaType {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumberedPageLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "/orders?page=2&limit=10&envelope=true", nil)
+
+	links := numberedPageLinks(r, 2, 10, 3)
+	assert.Equal(pageLinks{
+		Self:  "/orders?envelope=true&limit=10&page=2",
+		First: "/orders?envelope=true&limit=10&page=1",
+		Prev:  "/orders?envelope=true&limit=10&page=1",
+		Next:  "/orders?envelope=true&limit=10&page=3",
+		Last:  "/orders?envelope=true&limit=10&page=3",
+	}, links)
+	assert.Equal(`</orders?envelope=true&limit=10&page=1>; rel="first", `+
+		`</orders?envelope=true&limit=10&page=1>; rel="prev", `+
+		`</orders?envelope=true&limit=10&page=3>; rel="next", `+
+		`</orders?envelope=true&limit=10&page=3>; rel="last"`, links.header())
+
+	// the first and last pages have no prev and next
+	links = numberedPageLinks(r, 1, 10, 1)
+	assert.Empty(links.Prev)
+	assert.Empty(links.Next)
+
+	// an empty listing has a single, empty page
+	links = numberedPageLinks(r, 1, 10, 0)
+	assert.Equal("/orders?envelope=true&limit=10&page=1", links.Last)
+	assert.Empty(links.Next)
+
+	// past the last page, prev leads back to the last page
+	links = numberedPageLinks(r, 7, 10, 3)
+	assert.Equal("/orders?envelope=true&limit=10&page=3", links.Prev)
+	assert.Empty(links.Next)
+}
+
+func TestWantsBareOrderArray(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		target, accept string
+		bare           bool
+	}{
+		{"/orders", "", false},
+		{"/orders", "application/json", false},
+		{"/orders?envelope=false", "", true},
+		{"/orders?envelope=true", OrdersV1MediaType, false},
+		{"/orders", OrdersV1MediaType, true},
+		{"/orders", "text/html, " + OrdersV1MediaType + "; q=0.9", true},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.target, nil)
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+
+		bare, err := wantsBareOrderArray(r)
+		assert.Nil(err)
+		assert.Equal(c.bare, bare, "%s %s", c.target, c.accept)
+	}
+
+	_, err := wantsBareOrderArray(httptest.NewRequest("GET", "/orders?envelope=maybe", nil))
+	assert.NotNil(err)
+}
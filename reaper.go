@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// ReleaseReasonHoldTimeout is the reason recorded when the reaper releases an order
+	ReleaseReasonHoldTimeout = "hold_timeout"
+
+	// reaperActor is the actor recorded when the reaper releases an order
+	reaperActor = "reaper"
+
+	// reaperBatchSize is the number of stale orders released in one transaction
+	reaperBatchSize = 100
+)
+
+// OrderReaper returns orders held in `taken` for longer than the hold timeout to UNASSIGN,
+// e.g. when a courier's app crashed. Several reapers, e.g. one per replica, may share a store
+type OrderReaper struct {
+	Store  OrderStore
+	Config ReaperConfig
+}
+
+// NewOrderReaper creates an OrderReaper
+func NewOrderReaper(store OrderStore, cfg ReaperConfig) *OrderReaper {
+	return &OrderReaper{Store: store, Config: cfg}
+}
+
+// Run releases stale orders every interval until `ctx` is done
+func (or *OrderReaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(or.Config.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		if _, err := or.ReleaseStale(); err != nil {
+			log.Printf("failed to release stale orders: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReleaseStale releases every order held for longer than the hold timeout, a batch at a time,
+// and returns the number of orders released
+func (or *OrderReaper) ReleaseStale() (int, error) {
+	total := 0
+	for {
+		released, err := or.Store.ReleaseStaleOrders(or.Config.HoldTimeout.Duration, reaperBatchSize)
+		if err != nil {
+			return total, err
+		}
+
+		for _, id := range released {
+			log.Printf("released order %d held for longer than %s", id, or.Config.HoldTimeout)
+		}
+
+		total += len(released)
+		if len(released) < reaperBatchSize {
+			return total, nil
+		}
+	}
+}
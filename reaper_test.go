@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderReaper(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	ms.CourierCapacity = 2
+	courier, _ := ms.InsertCourier(Courier{Name: "Ada"})
+
+	var ids []int
+	for i := 0; i < 4; i++ {
+		id, _ := ms.InsertOrder(testOrder(1000))
+		ids = append(ids, id)
+	}
+
+	take := StatusUpdate{Status: OrderStatusTaken, CourierId: courier.Id}
+	assert.Nil(ms.UpdateOrderStatus(ids[0], take))
+	assert.Nil(ms.UpdateOrderStatus(ids[1], take))
+	assert.Nil(ms.UpdateOrderStatus(ids[1], StatusUpdate{Status: OrderStatusPickedUp, CourierId: courier.Id}))
+
+	// both orders were last updated two hours ago, only the taken one is stale
+	for _, id := range ids[:2] {
+		ms.orders[id-1].updatedAt = time.Now().Add(-2 * time.Hour)
+	}
+
+	reaper := NewOrderReaper(ms, ReaperConfig{HoldTimeout: Duration{time.Hour}})
+	released, err := reaper.ReleaseStale()
+	assert.Nil(err)
+	assert.Equal(1, released)
+
+	order, _ := ms.SelectOrder(ids[0])
+	assert.Equal(OrderStatusUnassign, order.Status)
+	assert.Zero(order.AssignedCourierId)
+
+	order, _ = ms.SelectOrder(ids[1])
+	assert.Equal(OrderStatusPickedUp, order.Status)
+
+	events, _ := ms.OrderHistory(ids[0])
+	if assert.Len(events, 3) {
+		assert.Equal(OrderEventReleased, events[2].Type)
+		assert.Equal(reaperActor, events[2].Actor)
+		assert.Equal(ReleaseReasonHoldTimeout, events[2].Reason)
+	}
+
+	// the release freed the courier's capacity
+	assert.Nil(ms.UpdateOrderStatus(ids[2], take))
+
+	// a fresh take is not stale
+	released, err = reaper.ReleaseStale()
+	assert.Nil(err)
+	assert.Equal(0, released)
+}
+
+func TestOrderReaperConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	ms.CourierCapacity = 2 * reaperBatchSize
+
+	courier, _ := ms.InsertCourier(Courier{Name: "Ada"})
+	take := StatusUpdate{Status: OrderStatusTaken, CourierId: courier.Id}
+
+	const stale = reaperBatchSize + 50
+	for i := 0; i < stale; i++ {
+		id, _ := ms.InsertOrder(testOrder(1000))
+		assert.Nil(ms.UpdateOrderStatus(id, take))
+		ms.orders[id-1].updatedAt = time.Now().Add(-time.Minute)
+	}
+
+	// reapers of several replicas release every stale order exactly once
+	const reapers = 4
+	releases := make(chan int, reapers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < reapers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			released, err := NewOrderReaper(ms, ReaperConfig{HoldTimeout: Duration{time.Second}}).ReleaseStale()
+			assert.Nil(err)
+			releases <- released
+		}()
+	}
+	wg.Wait()
+	close(releases)
+
+	total := 0
+	for released := range releases {
+		total += released
+	}
+	assert.Equal(stale, total)
+
+	events, _ := ms.EventsSince(0, 3*stale+1)
+	assert.Len(events, 3*stale)
+}
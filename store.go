@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+const (
+	OrderStorePostgres = "postgres"
+	OrderStoreMemory   = "memory"
+)
+
+// StatusUpdate describes a requested change of an order's status
+type StatusUpdate struct {
+	Status string
+
+	// CourierId is the courier requesting the change, it is required to take an order
+	// and must be the order's assignee to release, progress or cancel it, see authorizeUpdate
+	CourierId int
+
+	// Admin requests may release, progress or cancel an order assigned to any courier
+	Admin bool
+
+	// Actor and RequestId identify who requested the change, they are recorded in the order's history
+	Actor     string
+	RequestId string
+
+	// Reason and Note explain the change in the order's history. A cancellation requires a reason
+	Reason string
+	Note   string
+
+	// IfVersions, when not nil, lists the versions of the order the change was made against,
+	// the change is refused with a *VersionMismatchError unless the current version is listed
+	IfVersions []int
+}
+
+// OrderEvent records the creation or a status transition of an order.
+// The creation of an order is recorded as a transition from the empty status
+type OrderEvent struct {
+	// Id increases with every event across all orders
+	Id        int64  `json:"id"`
+	Type      string `json:"type"`
+	OrderId   int    `json:"order_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Actor     string `json:"actor,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+
+	// Reason explains why the change was made, e.g. ReleaseReasonHoldTimeout when the
+	// OrderReaper releases an order, Note optionally details it
+	Reason    string    `json:"reason,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	OrderEventCreated  = "created"
+	OrderEventReleased = "released"
+)
+
+// orderEventType names an event: `created` for a new order, `released` for an order
+// returned to UNASSIGN, and the new status for any other transition e.g. `taken`
+func orderEventType(from, to string) string {
+	switch {
+	case from == "":
+		return OrderEventCreated
+	case to == OrderStatusUnassign:
+		return OrderEventReleased
+	default:
+		return to
+	}
+}
+
+// IsValidOrderEventType returns if `t` is the type of some order event
+func IsValidOrderEventType(t string) bool {
+	return t == OrderEventCreated || t == OrderEventReleased || IsValidOrderStatus(t)
+}
+
+// OrderStore is the persistence layer used by the HTTP handlers to create, read and
+// update orders. OrderDatabase is the Postgres backed implementation, MemoryOrderStore
+// keeps orders in process memory for local development and testing
+type OrderStore interface {
+	// InsertOrder persists a new order, records its creation in the order's history,
+	// and returns its id. The id, timestamps and version of `order` are ignored
+	InsertOrder(order ResolvedOrder) (orderId int, err error)
+
+	// SelectOrder returns an order by id. sql.ErrNoRows is returned
+	// if no order exists with the given id
+	SelectOrder(orderId int) (ResolvedOrder, error)
+
+	// UpdateOrderStatus changes the status of an order and records the transition in the
+	// order's history. Implementations must validate the change with validateTransition and
+	// authorizeUpdate, and guarantee that if two requests try to update the same order, only
+	// the first one wins. The version of the order must pass checkVersion before the transition
+	// is validated, and increases with every change. Taking an order assigns it to the requesting courier, which must
+	// exist, be active and hold fewer orders than its capacity, releasing it clears the
+	// assignment. Two takes by the same courier must not both pass the capacity check
+	UpdateOrderStatus(orderId int, update StatusUpdate) error
+
+	// ReleaseStaleOrders returns up to `limit` orders which have been `taken` for longer than
+	// `holdTimeout` to UNASSIGN, clearing their assignment and recording the release with
+	// ReleaseReasonHoldTimeout, and returns their ids. Several replicas may call it at once,
+	// implementations must not release an order twice nor wait on orders being updated
+	ReleaseStaleOrders(holdTimeout time.Duration, limit int) ([]int, error)
+
+	// OrderHistory returns the creation and status transitions of an order, oldest first.
+	// sql.ErrNoRows is returned if no order exists with the given id
+	OrderHistory(orderId int) ([]OrderEvent, error)
+
+	// EventsSince returns up to `limit` events of any order with an id greater than `afterId`,
+	// oldest first
+	EventsSince(afterId int64, limit int) ([]OrderEvent, error)
+
+	// RetrieveOrders retrieves a page of the orders selected by `q` given a limit i.e. page size,
+	// and a page number, along with the total number of selected orders.
+	// Orders are sorted as requested by `q`, by creation time then id by default
+	RetrieveOrders(q OrderQuery, limit, page int) (orders []ResolvedOrder, total int, err error)
+
+	// RetrieveOrdersAfter retrieves up to `limit` orders selected by `q` positioned after the
+	// cursor `after`, or from the first order if it is nil. The sort of `q` is ignored: orders
+	// are ordered by creation time, then id. The orders include their creation time
+	RetrieveOrdersAfter(q OrderQuery, after *OrderCursor, limit int) ([]ResolvedOrder, error)
+
+	// NearbyOrders retrieves up to `limit` UNASSIGN orders whose origin lies within `radius`
+	// meters of `position`, nearest first
+	NearbyOrders(position maps.LatLng, radius float64, limit int) ([]NearbyOrder, error)
+}
+
+// NewOrderStore creates the OrderStore selected by the configuration
+func NewOrderStore(cfg *Config) (OrderStore, error) {
+	switch cfg.Store {
+	case OrderStorePostgres:
+		od, err := NewOrderDatabase(cfg.Postgres)
+		if err != nil {
+			return nil, err
+		}
+
+		od.CourierCapacity = cfg.Couriers.Capacity
+		return od, nil
+	case OrderStoreMemory:
+		ms := NewMemoryOrderStore()
+		ms.CourierCapacity = cfg.Couriers.Capacity
+		return ms, nil
+	default:
+		return nil, fmt.Errorf("unknown order store: %s", cfg.Store)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// subscriberBufferSize is the number of events buffered for a stream client.
+	// A client which falls further behind is disconnected and must resume with Last-Event-ID
+	subscriberBufferSize = 64
+
+	// replayBatchSize is the number of events fetched at a time when resuming a stream
+	replayBatchSize = 500
+
+	// streamHeartbeatInterval is how often a comment is sent to keep idle streams open
+	streamHeartbeatInterval = 15 * time.Second
+)
+
+// OrderBroker fans out order events to every subscribed stream client of this replica
+type OrderBroker struct {
+	mu   sync.Mutex
+	subs map[chan OrderEvent]struct{}
+}
+
+// NewOrderBroker creates an OrderBroker without subscribers
+func NewOrderBroker() *OrderBroker {
+	return &OrderBroker{subs: make(map[chan OrderEvent]struct{})}
+}
+
+// Subscribe registers a new subscriber. The returned channel is closed on Unsubscribe,
+// or when the subscriber falls too far behind
+func (b *OrderBroker) Subscribe() chan OrderEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan OrderEvent, subscriberBufferSize)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe removes a subscriber registered with Subscribe
+func (b *OrderBroker) Unsubscribe(ch chan OrderEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Publish delivers an event to every subscriber without blocking.
+// Subscribers whose buffer is full are dropped
+func (b *OrderBroker) Publish(e OrderEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("dropping slow order stream subscriber")
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// listenOrderEvents relays the events announced by any replica on orderEventsChannel
+// to `broker`. Events missed while the listener reconnects are fetched from `od`
+func listenOrderEvents(pc PostgresConfig, od *OrderDatabase, broker *OrderBroker) (*pq.Listener, error) {
+	listener := pq.NewListener(pc.DSN(), time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("order event listener: %s", err)
+			}
+		},
+	)
+
+	if err := listener.Listen(orderEventsChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	// start from the latest event so that a reconnection only fetches events announced
+	// after listening, not the whole history
+	lastId, err := od.LastEventId()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	go func() {
+		for n := range listener.Notify {
+			// a nil notification signals that the connection was re-established
+			if n == nil {
+				lastId, err = publishEventsSince(od, broker, lastId)
+				if err != nil {
+					log.Printf("failed to fetch events missed by the listener: %s", err)
+				}
+
+				continue
+			}
+
+			var e OrderEvent
+			if err := json.Unmarshal([]byte(n.Extra), &e); err != nil {
+				log.Printf("malformed order event notification: %s", err)
+				continue
+			}
+
+			broker.Publish(e)
+			if e.Id > lastId {
+				lastId = e.Id
+			}
+		}
+	}()
+
+	return listener, nil
+}
+
+// publishEventsSince publishes every event of `store` with an id greater than `afterId`, a batch at
+// a time, and returns the id of the last one published
+func publishEventsSince(store OrderStore, broker *OrderBroker, afterId int64) (int64, error) {
+	for {
+		events, err := store.EventsSince(afterId, replayBatchSize)
+		if err != nil {
+			return afterId, err
+		}
+
+		for _, e := range events {
+			broker.Publish(e)
+			afterId = e.Id
+		}
+
+		if len(events) < replayBatchSize {
+			return afterId, nil
+		}
+	}
+}
+
+// streamFilter selects the events sent to a stream client. Empty criteria match every event
+type streamFilter struct {
+	types   map[string]bool
+	status  map[string]bool
+	orderId int
+}
+
+// parseStreamFilter reads the `type`, `status` and `order_id` query parameters.
+// `type` and `status` may be repeated
+func parseStreamFilter(params url.Values) (f streamFilter, err error) {
+	f.types = make(map[string]bool)
+	for _, t := range params["type"] {
+		if !IsValidOrderEventType(t) {
+			return f, fmt.Errorf("Unknown event type: %s", t)
+		}
+
+		f.types[t] = true
+	}
+
+	f.status = make(map[string]bool)
+	for _, s := range params["status"] {
+		if !IsValidOrderStatus(s) {
+			return f, fmt.Errorf("Unknown status: %s", s)
+		}
+
+		f.status[s] = true
+	}
+
+	if orderIdParam, ok := params["order_id"]; ok {
+		f.orderId, err = validateOrdersListParam(orderIdParam)
+		if err != nil {
+			return f, fmt.Errorf("order_id must be a positive integer")
+		}
+	}
+
+	return f, nil
+}
+
+// matches returns if `e` satisfies every criterion of the filter
+func (f streamFilter) matches(e OrderEvent) bool {
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+
+	if len(f.status) > 0 && !f.status[e.To] {
+		return false
+	}
+
+	return f.orderId == 0 || f.orderId == e.OrderId
+}
+
+// writeStreamEvent writes an event in the text/event-stream format
+func writeStreamEvent(w http.ResponseWriter, e OrderEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+	return err
+}
+
+// streamOrders streams order events to the client as Server-Sent Events.
+//
+// Only events occurring after the client connects are sent, unless the client resumes
+// with a Last-Event-ID header (or `last_event_id` query parameter), in which case every
+// event after that id is replayed first
+func streamOrders(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	filter, err := parseStreamFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+
+	var afterId int64 = -1
+	if lastEventId != "" {
+		afterId, err = strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil || afterId < 0 {
+			writeError(w, http.StatusBadRequest, "Last-Event-ID must be a non-negative integer")
+			return
+		}
+	}
+
+	// subscribe before replaying so that no event falls between the replay and the live stream
+	events := defaultOrderBroker.Subscribe()
+	defer defaultOrderBroker.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for afterId >= 0 {
+		batch, err := defaultOrderStore.EventsSince(afterId, replayBatchSize)
+		if err != nil {
+			log.Printf("failed to replay order events: %s", err)
+			return
+		}
+
+		for _, e := range batch {
+			afterId = e.Id
+
+			if filter.matches(e) {
+				if err := writeStreamEvent(w, e); err != nil {
+					return
+				}
+			}
+		}
+
+		if len(batch) < replayBatchSize {
+			break
+		}
+	}
+	flusher.Flush()
+
+	// live events up to the last replayed one were already sent, or filtered out
+	replayedUpTo := afterId
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-events:
+			if !ok {
+				// dropped by the broker for falling behind, the client resumes with Last-Event-ID
+				return
+			}
+
+			if e.Id <= replayedUpTo || !filter.matches(e) {
+				continue
+			}
+
+			if err := writeStreamEvent(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderBroker(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewOrderBroker()
+	a, c := b.Subscribe(), b.Subscribe()
+
+	b.Publish(OrderEvent{Id: 1})
+	assert.Equal(int64(1), (<-a).Id)
+	assert.Equal(int64(1), (<-c).Id)
+
+	// an unsubscribed channel is closed and receives nothing further
+	b.Unsubscribe(a)
+	_, ok := <-a
+	assert.False(ok)
+	b.Unsubscribe(a)
+
+	// a subscriber which falls behind is dropped rather than blocking Publish
+	for i := 0; i <= subscriberBufferSize; i++ {
+		b.Publish(OrderEvent{Id: int64(i + 2)})
+	}
+
+	received := 0
+	for range c {
+		received++
+	}
+	assert.Equal(subscriberBufferSize, received)
+}
+
+func TestPublishEventsSince(t *testing.T) {
+	assert := assert.New(t)
+
+	// more events than fit in a single batch were missed
+	ms := NewMemoryOrderStore()
+	for i := 0; i < replayBatchSize+10; i++ {
+		ms.InsertOrder(testOrder(1000))
+	}
+	events, _ := ms.EventsSince(0, 2*replayBatchSize)
+
+	b := NewOrderBroker()
+	lastId, err := publishEventsSince(ms, b, 0)
+	assert.Nil(err)
+	assert.Equal(events[len(events)-1].Id, lastId)
+
+	sub := b.Subscribe()
+	lastId, err = publishEventsSince(ms, b, events[len(events)-3].Id)
+	assert.Nil(err)
+	assert.Equal(events[len(events)-1].Id, lastId)
+	assert.Equal(events[len(events)-2].Id, (<-sub).Id)
+	assert.Equal(events[len(events)-1].Id, (<-sub).Id)
+
+	// nothing new leaves the id unchanged
+	lastId, err = publishEventsSince(ms, b, lastId)
+	assert.Nil(err)
+	assert.Equal(events[len(events)-1].Id, lastId)
+}
+
+func TestParseStreamFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := parseStreamFilter(url.Values{})
+	assert.Nil(err)
+	assert.True(f.matches(OrderEvent{OrderId: 3, Type: OrderEventCreated, To: OrderStatusUnassign}))
+
+	f, err = parseStreamFilter(url.Values{
+		"type":     {OrderStatusTaken, OrderEventReleased},
+		"order_id": {"3"},
+	})
+	assert.Nil(err)
+	assert.True(f.matches(OrderEvent{OrderId: 3, Type: OrderStatusTaken, To: OrderStatusTaken}))
+	assert.True(f.matches(OrderEvent{OrderId: 3, Type: OrderEventReleased, To: OrderStatusUnassign}))
+	assert.False(f.matches(OrderEvent{OrderId: 3, Type: OrderEventCreated, To: OrderStatusUnassign}))
+	assert.False(f.matches(OrderEvent{OrderId: 4, Type: OrderStatusTaken, To: OrderStatusTaken}))
+
+	f, err = parseStreamFilter(url.Values{"status": {OrderStatusUnassign}})
+	assert.Nil(err)
+	assert.True(f.matches(OrderEvent{Type: OrderEventCreated, To: OrderStatusUnassign}))
+	assert.True(f.matches(OrderEvent{Type: OrderEventReleased, To: OrderStatusUnassign}))
+	assert.False(f.matches(OrderEvent{Type: OrderStatusTaken, To: OrderStatusTaken}))
+
+	for _, params := range []url.Values{
+		{"type": {"shipped"}},
+		{"status": {"shipped"}},
+		{"order_id": {"0"}},
+		{"order_id": {"abc"}},
+	} {
+		_, err = parseStreamFilter(params)
+		assert.NotNil(err)
+	}
+}
+
+// readStreamEvent reads the next event from a text/event-stream, skipping comments
+func readStreamEvent(r *bufio.Reader) (id, event string, e OrderEvent, err error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return id, event, e, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && id != "":
+			return id, event, e, nil
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+		}
+	}
+}
+
+func TestStreamOrders(t *testing.T) {
+	assert := assert.New(t)
+
+	id, err := defaultOrderStore.InsertOrder(testOrder(1000))
+	assert.Nil(err)
+
+	history, err := defaultOrderStore.OrderHistory(id)
+	assert.Nil(err)
+	created := history[0]
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+
+	streamEndpoint := fmt.Sprintf("%s/orders/stream?order_id=%d", srv.URL, id)
+
+	for _, bad := range []string{"&type=shipped", "&last_event_id=abc", "&last_event_id=-1"} {
+		resp, err := client.Get(streamEndpoint + bad)
+		assert.Nil(err)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// resuming from just before the creation replays it
+	req, _ := http.NewRequest("GET", streamEndpoint, nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(created.Id-1))
+	resp, err := client.Do(req.WithContext(ctx))
+	if !assert.Nil(err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	stream := bufio.NewReader(resp.Body)
+
+	eventId, eventType, e, err := readStreamEvent(stream)
+	assert.Nil(err)
+	assert.Equal(fmt.Sprint(created.Id), eventId)
+	assert.Equal(OrderEventCreated, eventType)
+	assert.Equal(id, e.OrderId)
+
+	// events occurring after the client connects are streamed live
+	orderEndpoint := fmt.Sprintf("%s/order/%d", srv.URL, id)
+	courierId := newTestCourier(t)
+	for _, status := range []string{OrderStatusTaken, OrderStatusUnassign} {
+		body := []byte(fmt.Sprintf(`{"status": "%s", "courier_id": %d}`, status, courierId))
+		req, _ := http.NewRequest("PUT", orderEndpoint, bytes.NewReader(body))
+		req.Header.Set(CourierTokenHeader, testCourierToken)
+		putResp, err := client.Do(req)
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, putResp.StatusCode)
+	}
+
+	_, eventType, e, err = readStreamEvent(stream)
+	assert.Nil(err)
+	assert.Equal(OrderStatusTaken, eventType)
+	assert.Equal(OrderStatusUnassign, e.From)
+
+	_, eventType, e, err = readStreamEvent(stream)
+	assert.Nil(err)
+	assert.Equal(OrderEventReleased, eventType)
+	assert.Equal(OrderStatusUnassign, e.To)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"googlemaps.github.io/maps"
+)
+
+const (
+	TravelModeDriving    = "driving"
+	TravelModeBicycling  = "bicycling"
+	TravelModeWalking    = "walking"
+	TravelModeTwoWheeler = "two_wheeler"
+
+	AvoidTolls    = "tolls"
+	AvoidHighways = "highways"
+	AvoidFerries  = "ferries"
+)
+
+// travelMode describes how the routes of a travel mode are looked up
+type travelMode struct {
+	// matrixMode is the Distance Matrix mode the route is looked up with, and avoid the
+	// features always avoided on top of those requested
+	matrixMode maps.Mode
+	avoid      []string
+
+	// speed is the average speed, in meters per second, assumed when estimating the travel
+	// time of a route without a routing service
+	speed float64
+}
+
+// travelModes lists the travel modes an order may be routed with.
+// The Distance Matrix API has no two-wheeler mode: motorbikes and scooters are routed as cars
+// kept off highways, which many cities close to them
+var travelModes = map[string]travelMode{
+	TravelModeDriving:    {matrixMode: maps.TravelModeDriving, speed: 30 * 1000 / 3600.0},
+	TravelModeTwoWheeler: {matrixMode: maps.TravelModeDriving, avoid: []string{AvoidHighways}, speed: 30 * 1000 / 3600.0},
+	TravelModeBicycling:  {matrixMode: maps.TravelModeBicycling, speed: 15 * 1000 / 3600.0},
+	TravelModeWalking:    {matrixMode: maps.TravelModeWalking, speed: 5 * 1000 / 3600.0},
+}
+
+// IsValidTravelMode returns if `mode` is a known travel mode
+func IsValidTravelMode(mode string) bool {
+	_, ok := travelModes[mode]
+	return ok
+}
+
+// IsValidAvoid returns if `avoid` is a route feature which may be avoided
+func IsValidAvoid(avoid string) bool {
+	return avoid == AvoidTolls || avoid == AvoidHighways || avoid == AvoidFerries
+}
+
+// validateTravel checks the travel mode and avoided features requested for an order
+func validateTravel(mode string, avoid []string) error {
+	if mode != "" && !IsValidTravelMode(mode) {
+		return fmt.Errorf("Unknown travel mode: %s", mode)
+	}
+
+	for _, a := range avoid {
+		if !IsValidAvoid(a) {
+			return fmt.Errorf("Unknown avoid option: %s", a)
+		}
+	}
+
+	return nil
+}
+
+// normalizeAvoid sorts avoided features and drops duplicates, so that equal requests
+// look the same
+func normalizeAvoid(avoid []string) []string {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, a := range avoid {
+		if !seen[a] {
+			seen[a] = true
+			normalized = append(normalized, a)
+		}
+	}
+
+	sort.Strings(normalized)
+	return normalized
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTravel(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(validateTravel("", nil))
+	for mode := range travelModes {
+		assert.Nil(validateTravel(mode, []string{AvoidTolls, AvoidHighways, AvoidFerries}), mode)
+	}
+
+	assert.EqualError(validateTravel("flying", nil), "Unknown travel mode: flying")
+	assert.EqualError(validateTravel("Driving", nil), "Unknown travel mode: Driving")
+	assert.EqualError(validateTravel(TravelModeWalking, []string{"stairs"}), "Unknown avoid option: stairs")
+
+	assert.Equal([]string{}, normalizeAvoid(nil))
+	assert.Equal(
+		[]string{AvoidFerries, AvoidTolls},
+		normalizeAvoid([]string{AvoidTolls, AvoidFerries, AvoidTolls}),
+	)
+}
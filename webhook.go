@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// InternalWebhookTargetError is returned for deliveries to, or redirected to, a loopback,
+// private or link-local address
+var InternalWebhookTargetError = errors.New("WEBHOOK_TARGET_INTERNAL")
+
+const (
+	// WebhookEventHeader carries the type of the delivered event
+	WebhookEventHeader = "X-Orders-Event"
+
+	// WebhookTimestampHeader carries the unix time at which a delivery was signed
+	WebhookTimestampHeader = "X-Orders-Timestamp"
+
+	// WebhookSignatureHeader carries "sha256=" followed by the hex encoded HMAC-SHA256
+	// of "<timestamp>.<body>", keyed with the subscription's secret
+	WebhookSignatureHeader = "X-Orders-Signature"
+
+	// webhookBatchSize is the number of deliveries claimed and attempted at once
+	webhookBatchSize = 20
+)
+
+// WebhookSubscription is an endpoint which receives order events.
+// An empty EventTypes subscribes to every event type
+type WebhookSubscription struct {
+	Id         int        `json:"id"`
+	URL        string     `json:"url"`
+	Secret     string     `json:"secret,omitempty"`
+	EventTypes []string   `json:"event_types"`
+	Active     bool       `json:"active"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+// wants returns if the subscription receives events of type `eventType`
+func (sub *WebhookSubscription) wants(eventType string) bool {
+	if !sub.Active {
+		return false
+	}
+
+	if len(sub.EventTypes) == 0 {
+		return true
+	}
+
+	for _, t := range sub.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookDelivery is an order event claimed from the outbox for delivery to a subscription
+type WebhookDelivery struct {
+	Id           int
+	Subscription WebhookSubscription
+	Event        OrderEvent
+
+	// Attempts counts the attempts made so far, including the current one
+	Attempts int
+}
+
+// WebhookDeadLetter is an order event which could not be delivered to a subscription
+// within the configured number of attempts
+type WebhookDeadLetter struct {
+	Id             int        `json:"id"`
+	SubscriptionId int        `json:"subscription_id"`
+	Event          OrderEvent `json:"event"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"last_error"`
+	FailedAt       time.Time  `json:"failed_at"`
+}
+
+// WebhookStore persists webhook subscriptions and the outbox of their pending deliveries.
+//
+// Implementations must add a delivery to the outbox for every active subscription wanting an
+// order event, atomically with the recording of the event, so that no event is ever lost
+type WebhookStore interface {
+	// InsertWebhook persists a new subscription and returns it with its id
+	InsertWebhook(sub WebhookSubscription) (WebhookSubscription, error)
+
+	// SelectWebhook returns a subscription by id. sql.ErrNoRows is returned
+	// if no subscription exists with the given id
+	SelectWebhook(id int) (WebhookSubscription, error)
+
+	// ListWebhooks returns every subscription, oldest first
+	ListWebhooks() ([]WebhookSubscription, error)
+
+	// UpdateWebhook replaces the url, secret, event types and active flag of a subscription
+	UpdateWebhook(sub WebhookSubscription) (WebhookSubscription, error)
+
+	// DeleteWebhook deletes a subscription along with its pending deliveries and dead letters
+	DeleteWebhook(id int) error
+
+	// ClaimDeliveries returns up to `limit` due deliveries of active subscriptions, counting
+	// an attempt for each one. A claimed delivery is not due again until `lease` elapses, so
+	// that it is retried if the claimant dies before reporting the outcome
+	ClaimDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error)
+
+	// CompleteDelivery removes a successful delivery from the outbox
+	CompleteDelivery(id int) error
+
+	// RetryDelivery records the failure of a delivery and schedules its next attempt
+	RetryDelivery(id int, lastError string, at time.Time) error
+
+	// DeadLetterDelivery moves a delivery out of the outbox into the dead letters
+	DeadLetterDelivery(id int, lastError string) error
+
+	// DeadLetters returns the dead letters of a subscription, oldest first
+	DeadLetters(subscriptionId int) ([]WebhookDeadLetter, error)
+
+	// ReplayDeadLetters moves dead letters of a subscription back into the outbox for
+	// immediate delivery, and returns how many were moved. An empty `ids` replays them all
+	ReplayDeadLetters(subscriptionId int, ids []int) (int, error)
+}
+
+// signWebhook returns the value of WebhookSignatureHeader for a delivery
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newSecret generates a random secret, e.g. for a subscription created without one
+// or for a courier's token
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// webhookBackoff returns the delay before retrying a delivery after its attempt number
+// `attempts` failed: base, 2*base, 4*base and so on, capped at max
+func webhookBackoff(attempts int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	return d
+}
+
+// WebhookWorker delivers the order events queued in the outbox of a WebhookStore.
+// Several workers, e.g. one per replica, may share a store
+type WebhookWorker struct {
+	Store  WebhookStore
+	Client *http.Client
+	Config WebhookConfig
+}
+
+// NewWebhookWorker creates a WebhookWorker whose deliveries cannot reach internal addresses
+func NewWebhookWorker(store WebhookStore, cfg WebhookConfig) *WebhookWorker {
+	return &WebhookWorker{
+		Store:  store,
+		Client: newWebhookClient(cfg.Timeout.Duration),
+		Config: cfg,
+	}
+}
+
+// newWebhookClient creates the HTTP client delivering webhooks. Subscription URLs are checked
+// when subscribing, but a host name may resolve, or be redirected, to an internal address
+// later on, so the address of every connection is checked when dialing it, after resolution.
+// Proxies are not used, since the address dialed would then be the proxy's
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+				return InternalWebhookTargetError
+			}
+
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			if isInternalHost(req.URL.Hostname()) {
+				return InternalWebhookTargetError
+			}
+
+			return nil
+		},
+	}
+}
+
+// Run delivers due events every poll interval until `ctx` is done
+func (ww *WebhookWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(ww.Config.PollInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		// keep going while full batches are claimed, the outbox may have a backlog
+		for {
+			claimed, err := ww.DeliverDue()
+			if err != nil {
+				log.Printf("failed to deliver webhooks: %s", err)
+			}
+
+			if err != nil || claimed < webhookBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue claims a batch of due deliveries, attempts them concurrently and records the
+// outcomes. It returns the number of deliveries claimed
+func (ww *WebhookWorker) DeliverDue() (int, error) {
+	// the lease outlasts the attempts, which all run at once under the client timeout
+	deliveries, err := ww.Store.ClaimDeliveries(webhookBatchSize, 2*ww.Config.Timeout.Duration)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func(d WebhookDelivery) {
+			defer wg.Done()
+
+			if err := ww.record(d, ww.deliver(d)); err != nil {
+				log.Printf("failed to record outcome of webhook delivery %d: %s", d.Id, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+// record stores the outcome `deliveryErr` of an attempt at delivery `d`
+func (ww *WebhookWorker) record(d WebhookDelivery, deliveryErr error) error {
+	if deliveryErr == nil {
+		return ww.Store.CompleteDelivery(d.Id)
+	}
+
+	log.Printf("webhook delivery %d of event %d to subscription %d failed on attempt %d: %s",
+		d.Id, d.Event.Id, d.Subscription.Id, d.Attempts, deliveryErr)
+
+	if d.Attempts >= ww.Config.MaxAttempts {
+		return ww.Store.DeadLetterDelivery(d.Id, deliveryErr.Error())
+	}
+
+	backoff := webhookBackoff(d.Attempts, ww.Config.RetryBackoff.Duration, ww.Config.MaxRetryBackoff.Duration)
+	return ww.Store.RetryDelivery(d.Id, deliveryErr.Error(), time.Now().Add(backoff))
+}
+
+// deliver POSTs the signed event of a delivery to its subscription. Any response other
+// than a 2xx is a failure
+func (ww *WebhookWorker) deliver(d WebhookDelivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", d.Subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, d.Event.Type)
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, signWebhook(d.Subscription.Secret, timestamp, body))
+
+	resp, err := ww.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// webhookRequest describes a subscription submitted by a client. When updating a
+// subscription, omitted fields are left unchanged
+type webhookRequest struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"event_types"`
+	Active     *bool    `json:"active"`
+}
+
+// apply validates the request and copies the fields it sets onto `sub`
+func (wr webhookRequest) apply(sub *WebhookSubscription) error {
+	if wr.URL != "" {
+		u, err := url.Parse(wr.URL)
+		if err != nil || !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+			return fmt.Errorf("url must be an absolute http or https URL")
+		}
+
+		if isInternalHost(u.Hostname()) {
+			return fmt.Errorf("url must not target a loopback, private or link-local address")
+		}
+
+		sub.URL = wr.URL
+	}
+
+	if wr.EventTypes != nil {
+		for _, t := range wr.EventTypes {
+			if !IsValidOrderEventType(t) {
+				return fmt.Errorf("Unknown event type: %s", t)
+			}
+		}
+
+		sub.EventTypes = wr.EventTypes
+	}
+
+	if wr.Secret != "" {
+		sub.Secret = wr.Secret
+	}
+
+	if wr.Active != nil {
+		sub.Active = *wr.Active
+	}
+
+	return nil
+}
+
+// isInternalHost returns if `host` is localhost or an internal IP address, so that such URLs
+// are refused upfront. Other names are checked once resolved, see newWebhookClient
+func isInternalHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && isInternalIP(ip)
+}
+
+// isInternalIP returns if `ip` is an address of this machine or of a private or link-local
+// network, which deliveries must not reach
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// writeWebhookError writes the error response for an error returned by
+// the WebhookStore while operating on subscription `id`
+func writeWebhookError(w http.ResponseWriter, id int, err error) {
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No webhook present with id %d", id))
+		return
+	}
+
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// createWebhook subscribes a URL to order events. The response is the only one to
+// include the secret, which is generated if the client did not send one
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
+		return
+	}
+
+	if req.URL == "" {
+		writeError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+
+	sub := WebhookSubscription{EventTypes: []string{}, Active: true}
+	if err := req.apply(&sub); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if sub.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		sub.Secret = secret
+	}
+
+	sub, err := defaultWebhookStore.InsertWebhook(sub)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("new webhook subscription: %d", sub.Id)
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// listWebhooks lists the webhook subscriptions
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	subs, err := defaultWebhookStore.ListWebhooks()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+
+	writeJSON(w, http.StatusOK, subs)
+}
+
+// getWebhook returns a single webhook subscription by id
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIdVar(w, r, "webhook")
+	if !ok {
+		return
+	}
+
+	sub, err := defaultWebhookStore.SelectWebhook(id)
+	if err != nil {
+		writeWebhookError(w, id, err)
+		return
+	}
+
+	sub.Secret = ""
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// updateWebhook changes the url, secret, event types or active flag of a subscription
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIdVar(w, r, "webhook")
+	if !ok {
+		return
+	}
+
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
+		return
+	}
+
+	sub, err := defaultWebhookStore.SelectWebhook(id)
+	if err != nil {
+		writeWebhookError(w, id, err)
+		return
+	}
+
+	if err := req.apply(&sub); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sub, err = defaultWebhookStore.UpdateWebhook(sub)
+	if err != nil {
+		writeWebhookError(w, id, err)
+		return
+	}
+
+	sub.Secret = ""
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// deleteWebhook unsubscribes a webhook, discarding its pending deliveries
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIdVar(w, r, "webhook")
+	if !ok {
+		return
+	}
+
+	if err := defaultWebhookStore.DeleteWebhook(id); err != nil {
+		writeWebhookError(w, id, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDeadLetters lists the events which could not be delivered to a subscription
+func listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIdVar(w, r, "webhook")
+	if !ok {
+		return
+	}
+
+	letters, err := defaultWebhookStore.DeadLetters(id)
+	if err != nil {
+		writeWebhookError(w, id, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, letters)
+}
+
+// replayRequest selects the dead letters to replay. No ids replays every dead letter
+type replayRequest struct {
+	Ids []int `json:"ids"`
+}
+
+// replayResponse reports how many dead letters were queued for delivery again
+type replayResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+// replayDeadLetters queues dead letters of a subscription for delivery again
+func replayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIdVar(w, r, "webhook")
+	if !ok {
+		return
+	}
+
+	var req replayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%v", err))
+		return
+	}
+
+	replayed, err := defaultWebhookStore.ReplayDeadLetters(id, req.Ids)
+	if err != nil {
+		writeWebhookError(w, id, err)
+		return
+	}
+
+	log.Printf("replayed %d dead letters of webhook subscription %d", replayed, id)
+	writeJSON(w, http.StatusOK, replayResponse{Replayed: replayed})
+}
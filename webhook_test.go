@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	base, max := 10*time.Second, time.Minute
+	assert.Equal(10*time.Second, webhookBackoff(1, base, max))
+	assert.Equal(20*time.Second, webhookBackoff(2, base, max))
+	assert.Equal(40*time.Second, webhookBackoff(3, base, max))
+	assert.Equal(time.Minute, webhookBackoff(4, base, max))
+	assert.Equal(time.Minute, webhookBackoff(100, base, max))
+}
+
+// webhookReceiver records the deliveries it receives, failing with a 500
+// while its status is not 2xx
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	wr.received = append(wr.received, r)
+	wr.bodies = append(wr.bodies, body)
+	w.WriteHeader(wr.status)
+}
+
+func TestWebhookWorker(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := &webhookReceiver{status: http.StatusInternalServerError}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	ms := NewMemoryOrderStore()
+	all, err := ms.InsertWebhook(WebhookSubscription{URL: srv.URL, Secret: "s3cret", Active: true})
+	assert.Nil(err)
+	_, err = ms.InsertWebhook(WebhookSubscription{
+		URL: srv.URL, Secret: "other", EventTypes: []string{OrderStatusDelivered}, Active: true,
+	})
+	assert.Nil(err)
+
+	worker := NewWebhookWorker(ms, WebhookConfig{
+		MaxAttempts:     2,
+		RetryBackoff:    Duration{time.Millisecond},
+		MaxRetryBackoff: Duration{time.Millisecond},
+		Timeout:         Duration{time.Second},
+	})
+
+	// the receiver listens on loopback, which the worker's own client refuses to reach
+	worker.Client = srv.Client()
+
+	// the creation is queued for the subscription to every event type only
+	id, err := ms.InsertOrder(testOrder(1000))
+	assert.Nil(err)
+
+	claimed, err := worker.DeliverDue()
+	assert.Nil(err)
+	assert.Equal(1, claimed)
+
+	// a failed delivery is not attempted again before its backoff elapses
+	claimed, err = worker.DeliverDue()
+	assert.Nil(err)
+	assert.Equal(0, claimed)
+
+	time.Sleep(5 * time.Millisecond)
+	claimed, err = worker.DeliverDue()
+	assert.Nil(err)
+	assert.Equal(1, claimed)
+
+	// after MaxAttempts the delivery is dead-lettered
+	time.Sleep(5 * time.Millisecond)
+	claimed, err = worker.DeliverDue()
+	assert.Nil(err)
+	assert.Equal(0, claimed)
+
+	letters, err := ms.DeadLetters(all.Id)
+	assert.Nil(err)
+	if assert.Len(letters, 1) {
+		assert.Equal(2, letters[0].Attempts)
+		assert.Equal(OrderEventCreated, letters[0].Event.Type)
+		assert.Equal(id, letters[0].Event.OrderId)
+		assert.Contains(letters[0].LastError, "500")
+	}
+
+	// replaying queues the dead letter for immediate delivery
+	receiver.status = http.StatusNoContent
+	replayed, err := ms.ReplayDeadLetters(all.Id, nil)
+	assert.Nil(err)
+	assert.Equal(1, replayed)
+
+	claimed, err = worker.DeliverDue()
+	assert.Nil(err)
+	assert.Equal(1, claimed)
+
+	letters, err = ms.DeadLetters(all.Id)
+	assert.Nil(err)
+	assert.Len(letters, 0)
+
+	claimed, err = worker.DeliverDue()
+	assert.Nil(err)
+	assert.Equal(0, claimed)
+
+	if !assert.Len(receiver.received, 3) {
+		return
+	}
+
+	// deliveries are signed with the subscription's secret
+	req, body := receiver.received[2], receiver.bodies[2]
+	assert.Equal(OrderEventCreated, req.Header.Get(WebhookEventHeader))
+
+	timestamp, err := strconv.ParseInt(req.Header.Get(WebhookTimestampHeader), 10, 64)
+	assert.Nil(err)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp, body)))
+	assert.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), req.Header.Get(WebhookSignatureHeader))
+
+	var e OrderEvent
+	assert.Nil(json.Unmarshal(body, &e))
+	assert.Equal(id, e.OrderId)
+	assert.Equal(OrderStatusUnassign, e.To)
+}
+
+func TestWebhookClientInternal(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(&webhookReceiver{status: http.StatusNoContent})
+	defer srv.Close()
+
+	client := newWebhookClient(time.Second)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	// internal addresses are refused once resolved, whatever the URL names
+	for _, target := range []string{srv.URL, "http://localhost:" + port} {
+		_, err := client.Post(target, "application/json", nil)
+		if assert.NotNil(err, target) {
+			assert.Contains(err.Error(), InternalWebhookTargetError.Error())
+		}
+	}
+
+	// and so are redirects to them
+	for _, target := range []string{"http://169.254.169.254/latest/meta-data", "http://10.1.2.3/", "http://localhost/"} {
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		assert.Equal(InternalWebhookTargetError, client.CheckRedirect(req, nil), target)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/hook", nil)
+	assert.Nil(client.CheckRedirect(req, nil))
+}
+
+func TestWebhookWorkerInactive(t *testing.T) {
+	assert := assert.New(t)
+
+	ms := NewMemoryOrderStore()
+	sub, err := ms.InsertWebhook(WebhookSubscription{URL: "http://localhost", Active: true})
+	assert.Nil(err)
+
+	_, err = ms.InsertOrder(testOrder(1000))
+	assert.Nil(err)
+
+	// deliveries of inactive subscriptions wait until they are reactivated
+	sub.Active = false
+	_, err = ms.UpdateWebhook(sub)
+	assert.Nil(err)
+
+	deliveries, err := ms.ClaimDeliveries(10, time.Minute)
+	assert.Nil(err)
+	assert.Len(deliveries, 0)
+
+	sub.Active = true
+	_, err = ms.UpdateWebhook(sub)
+	assert.Nil(err)
+
+	deliveries, err = ms.ClaimDeliveries(10, time.Minute)
+	assert.Nil(err)
+	assert.Len(deliveries, 1)
+
+	// a claimed delivery is leased to its claimant
+	deliveries, err = ms.ClaimDeliveries(10, time.Minute)
+	assert.Nil(err)
+	assert.Len(deliveries, 0)
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "let-me-in"
+
+	r := Router()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := srv.Client()
+
+	webhooksEndpoint := fmt.Sprintf("%s/webhooks", srv.URL)
+
+	send := func(method, endpoint, body, token string) *http.Response {
+		req, _ := http.NewRequest(method, endpoint, bytes.NewReader([]byte(body)))
+		if token != "" {
+			req.Header.Set(AdminTokenHeader, token)
+		}
+
+		resp, err := client.Do(req)
+		assert.Nil(err)
+		return resp
+	}
+
+	// subscriptions are managed by admins only
+	for _, token := range []string{"", "guess"} {
+		resp := send(http.MethodPost, webhooksEndpoint, `{"url": "https://example.com/hook"}`, token)
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+		resp = send(http.MethodGet, webhooksEndpoint, "", token)
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+	}
+
+	for _, bad := range []string{
+		`{"url": "not a url"}`,
+		`{"url": "ftp://example.com"}`,
+		`{"secret": "no url"}`,
+		`{"url": "https://example.com", "event_types": ["shipped"]}`,
+		`{"url": `,
+		`{"url": "http://localhost:8080/hook"}`,
+		`{"url": "http://127.0.0.1/hook"}`,
+		`{"url": "http://10.0.0.7/hook"}`,
+		`{"url": "http://192.168.1.1/hook"}`,
+		`{"url": "http://169.254.169.254/latest/meta-data"}`,
+		`{"url": "http://[::1]:8080/hook"}`,
+		`{"url": "http://[fd00::1]/hook"}`,
+		`{"url": "http://0.0.0.0/hook"}`,
+	} {
+		resp := send(http.MethodPost, webhooksEndpoint, bad, adminToken)
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, bad)
+	}
+
+	// the secret is generated and returned on creation only
+	resp := send(http.MethodPost, webhooksEndpoint,
+		`{"url": "https://example.com/hook", "event_types": ["taken"]}`, adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var created WebhookSubscription
+	json.NewDecoder(resp.Body).Decode(&created)
+	assert.NotEmpty(created.Secret)
+	assert.True(created.Active)
+	assert.Equal([]string{OrderStatusTaken}, created.EventTypes)
+
+	webhookEndpoint := fmt.Sprintf("%s/%d", webhooksEndpoint, created.Id)
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		resp = send(method, webhookEndpoint, `{"active": false}`, "")
+		assert.Equal(http.StatusForbidden, resp.StatusCode, method)
+	}
+
+	resp = send(http.MethodGet, webhookEndpoint, "", adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var fetched WebhookSubscription
+	json.NewDecoder(resp.Body).Decode(&fetched)
+	assert.Equal("https://example.com/hook", fetched.URL)
+	assert.Empty(fetched.Secret)
+
+	resp = send(http.MethodGet, webhooksEndpoint, "", adminToken)
+	var listed []WebhookSubscription
+	json.NewDecoder(resp.Body).Decode(&listed)
+	assert.NotEmpty(listed)
+
+	// internal targets are refused on update too
+	resp = send(http.MethodPut, webhookEndpoint, `{"url": "http://127.0.0.1:6379"}`, adminToken)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// omitted fields are left unchanged by an update
+	resp = send(http.MethodPut, webhookEndpoint, `{"active": false}`, adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var updated WebhookSubscription
+	json.NewDecoder(resp.Body).Decode(&updated)
+	assert.False(updated.Active)
+	assert.Equal("https://example.com/hook", updated.URL)
+	assert.Equal([]string{OrderStatusTaken}, updated.EventTypes)
+
+	resp = send(http.MethodGet, webhookEndpoint+"/dead_letters", "", adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal("[]\n", string(respBody))
+
+	resp = send(http.MethodPost, webhookEndpoint+"/dead_letters/replay", "", "")
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	resp = send(http.MethodPost, webhookEndpoint+"/dead_letters/replay", "", adminToken)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	respBody, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal("{\"replayed\":0}\n", string(respBody))
+
+	resp = send(http.MethodDelete, webhookEndpoint, "", adminToken)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+
+	for _, path := range []string{"", "/dead_letters"} {
+		resp = send(http.MethodGet, webhookEndpoint+path, "", adminToken)
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+	}
+
+	resp = send(http.MethodGet, webhooksEndpoint+"/abc", "", adminToken)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}